@@ -0,0 +1,248 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// AuditOperationPut and AuditOperationDelete are the operations recorded in
+	// the audit log.
+	AuditOperationPut    = "put"
+	AuditOperationDelete = "delete"
+
+	// AuditOutcomeSuccess and AuditOutcomeFailure are the outcomes recorded in
+	// the audit log.
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// auditEntry is a single line in the audit log.
+type auditEntry struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Operation         string    `json:"operation"`
+	SourceDatacenter  string    `json:"source_datacenter,omitempty"`
+	SourceKey         string    `json:"source_key"`
+	SourceModifyIndex uint64    `json:"source_modify_index,omitempty"`
+	DestinationKey    string    `json:"destination_key"`
+	ValueSHA256       string    `json:"value_sha256,omitempty"`
+	Outcome           string    `json:"outcome"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// auditLog is an append-only log of every write and delete in a destination,
+// written as JSON lines. The file is rotated when it reaches the maximum size,
+// keeping a fixed number of old files named with a numeric suffix.
+type auditLog struct {
+	sync.Mutex
+
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	// file is nil if the file could not be reopened after a rotation, in
+	// which case it is opened again by the next Record.
+	file *os.File
+	size int64
+
+	// refs is the number of runners using the audit log, guarded by
+	// auditLogs.
+	refs int
+}
+
+// auditLogs are the open audit logs by path. A runner that is restarted on
+// reload starts before the previous one stops, so it shares the previous
+// runner's audit log rather than opening and rotating the same file twice.
+var auditLogs = struct {
+	sync.Mutex
+	m map[string]*auditLog
+}{m: make(map[string]*auditLog)}
+
+// newAuditLog opens the audit log described by the given config, or returns
+// nil if the audit log is disabled. If the audit log is already open, it is
+// shared, taking on the rotation options of the config.
+func newAuditLog(c *AuditConfig) (*auditLog, error) {
+	if !config.BoolVal(c.Enabled) {
+		return nil, nil
+	}
+
+	path := config.StringVal(c.Path)
+	if path == "" {
+		return nil, fmt.Errorf("audit: missing path")
+	}
+	path = filepath.Clean(path)
+
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+
+	if a, ok := auditLogs.m[path]; ok {
+		a.Lock()
+		a.maxBytes = int64(config.IntVal(c.MaxBytes))
+		a.maxFiles = config.IntVal(c.MaxFiles)
+		a.Unlock()
+		a.refs++
+		return a, nil
+	}
+
+	a := &auditLog{
+		path:     path,
+		maxBytes: int64(config.IntVal(c.MaxBytes)),
+		maxFiles: config.IntVal(c.MaxFiles),
+		refs:     1,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	auditLogs.m[path] = a
+	return a, nil
+}
+
+// Record appends an entry for an operation on a destination key. The value is
+// recorded as a hash; err is the result of the operation. It is a no-op if the
+// audit log is nil.
+func (a *auditLog) Record(operation, sourceDC, sourceKey string, sourceIndex uint64, destKey string, value []byte, err error) error {
+	if a == nil {
+		return nil
+	}
+
+	e := &auditEntry{
+		Timestamp:         time.Now().UTC(),
+		Operation:         operation,
+		SourceDatacenter:  sourceDC,
+		SourceKey:         sourceKey,
+		SourceModifyIndex: sourceIndex,
+		DestinationKey:    destKey,
+		Outcome:           AuditOutcomeSuccess,
+	}
+	if operation == AuditOperationPut {
+		sum := sha256.Sum256(value)
+		e.ValueSHA256 = hex.EncodeToString(sum[:])
+	}
+	if err != nil {
+		e.Outcome = AuditOutcomeFailure
+		e.Error = err.Error()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("audit: failed to rotate: %s", err)
+		}
+	}
+
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+	return nil
+}
+
+// Close closes the audit log once every runner using it has closed it. It is
+// a no-op if the audit log is nil.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+
+	if a.refs--; a.refs > 0 {
+		return nil
+	}
+	delete(auditLogs.m, a.path)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// open opens the audit log for appending.
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: %s", err)
+	}
+
+	a.file, a.size = f, stat.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, shifting older files up and
+// removing those beyond the maximum, then opens a new file. If the files
+// cannot be renamed, the current file is reopened, so entries are still
+// appended to it.
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return err
+	}
+
+	if err := a.shift(); err != nil {
+		if oerr := a.open(); oerr != nil {
+			return fmt.Errorf("%s, and could not reopen: %s", err, oerr)
+		}
+		return err
+	}
+	return a.open()
+}
+
+// shift renames the current file to path.1, shifting older files up and
+// removing those beyond the maximum. If no old files are kept, the current
+// file is removed.
+func (a *auditLog) shift() error {
+	if a.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+		for i := a.maxFiles - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return nil
+}
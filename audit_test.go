@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "audit.log")
+	a, err := newAuditLog(&AuditConfig{
+		Enabled:  config.Bool(true),
+		MaxBytes: config.Int(600),
+		MaxFiles: config.Int(2),
+		Path:     config.String(path),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if err := a.Record(AuditOperationPut, "dc1", "global/foo", 12, "global/foo", []byte("bar"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Record(AuditOperationDelete, "dc1", "global/zip", 0, "global/zip", nil, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &e)
+	}
+	f.Close()
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.SourceModifyIndex != 12 || e.Outcome != AuditOutcomeSuccess ||
+		e.ValueSHA256 != "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9" {
+		t.Errorf("unexpected put entry: %#v", e)
+	}
+	if e := entries[1]; e.Outcome != AuditOutcomeFailure || e.Error != "boom" || e.ValueSHA256 != "" {
+		t.Errorf("unexpected delete entry: %#v", e)
+	}
+
+	// Each entry is roughly 250 bytes, so writing more rotates the file
+	for i := 0; i < 10; i++ {
+		if err := a.Record(AuditOperationPut, "dc1", "global/foo", 12, "global/foo", []byte("bar"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %s to exist: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "audit.log.3")); !os.IsNotExist(err) {
+		t.Errorf("expected audit.log.3 to be removed")
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() > 600 {
+		t.Errorf("expected %s to be rotated", path)
+	}
+
+	var nilLog *auditLog
+	if err := nilLog.Record(AuditOperationPut, "", "", 0, "", nil, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditLog_RotateFailure(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "audit.log")
+	a, err := newAuditLog(&AuditConfig{
+		Enabled:  config.Bool(true),
+		MaxBytes: config.Int(1),
+		MaxFiles: config.Int(1),
+		Path:     config.String(path),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// A directory in the way of the rotated file makes the rename fail
+	blocker := filepath.Join(root, "audit.log.1", "blocker")
+	if err := os.MkdirAll(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Record(AuditOperationPut, "dc1", "global/foo", 1, "global/foo", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Record(AuditOperationPut, "dc1", "global/foo", 2, "global/foo", nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if a.file == nil {
+		t.Fatal("expected the audit log to be reopened")
+	}
+
+	if err := os.RemoveAll(filepath.Dir(blocker)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Record(AuditOperationPut, "dc1", "global/foo", 3, "global/foo", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected the audit log to be rotated: %s", err)
+	}
+}
+
+func TestAuditLog_Shared(t *testing.T) {
+	c := &AuditConfig{
+		Enabled: config.Bool(true),
+		Path:    config.String(filepath.Join(t.TempDir(), "audit.log")),
+	}
+	a, err := newAuditLog(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newAuditLog(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("expected the audit log to be shared")
+	}
+
+	// The file stays open until both users have closed it
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Record(AuditOperationPut, "dc1", "global/foo", 1, "global/foo", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b.file != nil {
+		t.Error("expected the audit log to be closed")
+	}
+}
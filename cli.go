@@ -4,12 +4,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
@@ -64,6 +66,26 @@ func NewCLI(out, err io.Writer) *CLI {
 // Run accepts a slice of arguments and returns an int representing the exit
 // status from the command.
 func (cli *CLI) Run(args []string) int {
+	// Dispatch to any subcommand
+	if len(args) > 1 {
+		switch args[1] {
+		case "decrypt":
+			return cli.runDecrypt(args[2:])
+		case "export":
+			return cli.runExport(args[2:])
+		case "import":
+			return cli.runImport(args[2:])
+		case "pause":
+			return cli.runPause(args[2:])
+		case "resume":
+			return cli.runResume(args[2:])
+		case "rollback":
+			return cli.runRollback(args[2:])
+		case "validate":
+			return cli.runValidate(args[2:])
+		}
+	}
+
 	// Parse the flags and args
 	cfg, paths, once, isVersion, err := cli.ParseFlags(args[1:])
 	if err != nil {
@@ -100,10 +122,17 @@ func (cli *CLI) Run(args []string) int {
 	// print their version on stderr anyway.
 	if isVersion {
 		log.Printf("[DEBUG] (cli) version flag was given, exiting now")
-		fmt.Fprintf(cli.errStream, "%s\n", version.HumanVersion)
+		cli.printf("%s\n", version.HumanVersion)
 		return ExitCodeOK
 	}
 
+	// Add the prefixes and excludes from the config_source key, if any
+	source, remote, err := readConfigSource(cfg)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+	cfg = mergeConfigSource(cfg, remote)
+
 	// Initial runner
 	runner, err := NewRunner(cfg, once)
 	if err != nil {
@@ -111,6 +140,51 @@ func (cli *CLI) Run(args []string) int {
 	}
 	go runner.Start()
 
+	// Watch the config_source key for changes
+	if source != nil && !once {
+		go source.Start()
+	} else {
+		source = nil
+	}
+	defer func() {
+		if source != nil {
+			source.Stop()
+		}
+	}()
+
+	// Watch the configuration paths for changes if requested
+	watcher := updateConfigWatcher(nil, cfg, paths, once)
+	defer func() {
+		if watcher != nil {
+			watcher.Stop()
+		}
+	}()
+
+	// reload applies the configuration on disk along with the given
+	// config_source contents. If the result is invalid, the previous
+	// configuration keeps running.
+	reload := func(next *Config) {
+		r, c, err := cli.reload(runner, paths, cliConfig, next, once)
+		if err != nil {
+			logf(logFields{"error": err.Error()}, "[ERR] (cli) failed to reload, "+
+				"keeping the previous configuration: %s", err)
+			return
+		}
+		restarted := r != runner
+		runner, cfg, remote = r, c, next
+		watcher = updateConfigWatcher(watcher, cfg, paths, once)
+
+		// A restart may change the config_source key or how Consul is
+		// reached, so watch the key again. The new watcher delivers the
+		// current contents, which are then applied in place.
+		if restarted {
+			if source, err = restartConfigSource(source, cfg, once); err != nil {
+				logf(logFields{"error": err.Error()}, "[ERR] (cli) failed to watch "+
+					"config_source: %s", err)
+			}
+		}
+	}
+
 	// Listen for signals
 	signal.Notify(cli.signalCh)
 
@@ -120,40 +194,24 @@ func (cli *CLI) Run(args []string) int {
 			// Check if the runner's error returned a specific exit status, and return
 			// that value. If no value was given, return a generic exit status.
 			code := ExitCodeRunnerError
-			if typed, ok := err.(manager.ErrExitable); ok {
+			var typed manager.ErrExitable
+			if errors.As(err, &typed) {
 				code = typed.ExitStatus()
 			}
+			runner.Stop()
 			return logError(err, code)
 		case <-runner.DoneCh:
+			runner.Stop()
 			return ExitCodeOK
 		case s := <-cli.signalCh:
 			log.Printf("[DEBUG] (cli) receiving signal %q", s)
 
 			switch s {
 			case *cfg.ReloadSignal:
-				fmt.Fprintf(cli.errStream, "Reloading configuration...\n")
-				runner.Stop()
-
-				// Re-parse any configuration files or paths
-				cfg, err = loadConfigs(paths, cliConfig)
-				if err != nil {
-					return logError(err, ExitCodeConfigError)
-				}
-				cfg.Finalize()
-
-				// Load the new configuration from disk
-				cfg, err = cli.setup(cfg)
-				if err != nil {
-					return logError(err, ExitCodeConfigError)
-				}
-
-				runner, err = NewRunner(cfg, once)
-				if err != nil {
-					return logError(err, ExitCodeRunnerError)
-				}
-				go runner.Start()
+				cli.printf("Reloading configuration...\n")
+				reload(remote)
 			case *cfg.KillSignal:
-				fmt.Fprintf(cli.errStream, "Cleaning up...\n")
+				cli.printf("Cleaning up...\n")
 				runner.Stop()
 				return ExitCodeInterrupt
 			case signals.SignalLookup["SIGCHLD"]:
@@ -166,12 +224,134 @@ func (cli *CLI) Run(args []string) int {
 			default:
 				// Do nothing
 			}
+		case <-watcher.ChangeCh():
+			cli.printf("Configuration changed, reloading...\n")
+			reload(remote)
+		case b := <-source.DataCh():
+			next, err := parseConfigSource(b)
+			if err != nil {
+				logf(logFields{"error": err.Error()}, "[ERR] (cli) invalid "+
+					"config_source, keeping the previous configuration: %s", err)
+				continue
+			}
+			cli.printf("Configuration changed in Consul, reloading...\n")
+			reload(next)
 		case <-cli.stopCh:
 			return ExitCodeOK
 		}
 	}
 }
 
+// reload re-parses the configuration paths, adds the given config_source
+// contents, and applies the result to the runner. Changes to the prefixes and
+// excludes are applied in place, keeping the watches of unchanged prefixes;
+// anything else replaces the runner. If the new configuration is invalid, an
+// error is returned and the current runner is left running.
+func (cli *CLI) reload(runner *Runner, paths []string, cliConfig, remote *Config, once bool) (*Runner, *Config, error) {
+	cfg, err := loadConfigs(paths, cliConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg = mergeConfigSource(cfg, remote)
+
+	if err := validatePrefixes(cfg.Prefixes); err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err = cli.setup(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = runner.Reload(cfg)
+	if err == nil {
+		return runner, cfg, nil
+	}
+	if err != errRestartRequired {
+		return nil, nil, err
+	}
+
+	log.Printf("[INFO] (cli) %s, restarting runner", err)
+	newRunner, err := NewRunner(cfg, once)
+	if err != nil {
+		return nil, nil, err
+	}
+	runner.Stop()
+	go newRunner.Start()
+
+	return newRunner, cfg, nil
+}
+
+// readConfigSource reads the prefixes and excludes from the config_source key
+// of the given configuration, returning them along with the watcher used to
+// read the key. Both are nil if no config_source is given.
+func readConfigSource(c *Config) (*configSourceWatcher, *Config, error) {
+	if !config.BoolVal(c.ConfigSource.Enabled) {
+		return nil, nil, nil
+	}
+
+	clients, err := newClientSet(c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config_source: %s", err)
+	}
+
+	key := config.StringVal(c.ConfigSource.Key)
+	w := newConfigSourceWatcher(clients.Consul().KV(), c.ConfigSource)
+	b, err := w.Fetch()
+	if err != nil {
+		return nil, nil, fmt.Errorf("config_source: failed to read %q: %s", key, err)
+	}
+	if b == nil {
+		log.Printf("[WARN] (cli) config_source %q does not exist", key)
+	}
+
+	remote, err := parseConfigSource(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config_source: %q: %s", key, err)
+	}
+
+	return w, remote, nil
+}
+
+// updateConfigWatcher starts or stops watching the configuration paths so that
+// it matches the watch_config option of the given configuration, returning the
+// watcher to use from now on.
+func updateConfigWatcher(w *configWatcher, c *Config, paths []string, once bool) *configWatcher {
+	enabled := config.BoolVal(c.WatchConfig) && len(paths) > 0 && !once
+
+	switch {
+	case enabled && w == nil:
+		w = newConfigWatcher(paths, DefaultWatchConfigInterval)
+		go w.Start()
+	case !enabled && w != nil:
+		w.Stop()
+		w = nil
+	}
+
+	return w
+}
+
+// restartConfigSource stops the given config_source watcher, if any, and starts
+// watching the config_source key of the given configuration, returning the
+// watcher to use from now on. The new watcher delivers the current contents
+// of the key as its first change.
+func restartConfigSource(w *configSourceWatcher, c *Config, once bool) (*configSourceWatcher, error) {
+	if w != nil {
+		w.Stop()
+	}
+	if !config.BoolVal(c.ConfigSource.Enabled) || once {
+		return nil, nil
+	}
+
+	clients, err := newClientSet(c)
+	if err != nil {
+		return nil, fmt.Errorf("config_source: %s", err)
+	}
+	w = newConfigSourceWatcher(clients.Consul().KV(), c.ConfigSource)
+	go w.Start()
+	return w, nil
+}
+
 // ParseFlags is a helper function for parsing command line flags using Go's
 // Flag library. This is extracted into a helper to keep the main function
 // small, but it also makes writing tests for parsing command line arguments
@@ -184,12 +364,41 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 	configPaths := make([]string, 0, 6)
 
 	// Parse the flags and options
+	flags := newFlagSet(c, &configPaths)
+	flags.BoolVar(&once, "once", false, "")
+	flags.BoolVar(&isVersion, "v", false, "")
+	flags.BoolVar(&isVersion, "version", false, "")
+
+	// If there was a parser error, stop
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, false, false, err
+	}
+
+	// Error if extra arguments are present
+	args = flags.Args()
+	if len(args) > 0 {
+		return nil, nil, false, false, fmt.Errorf("cli: extra argument(s): %q",
+			args)
+	}
+
+	return c, configPaths, once, isVersion, nil
+}
+
+// newFlagSet creates a flag set for the configuration options that are shared
+// by all commands. Each option is applied to the given config as it is parsed,
+// and any configuration paths are appended to configPaths.
+func newFlagSet(c *Config, configPaths *[]string) *flag.FlagSet {
 	flags := flag.NewFlagSet(version.Name, flag.ContinueOnError)
 	flags.SetOutput(io.Discard)
 	flags.Usage = func() {}
 
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.AntiEntropyInterval = config.TimeDuration(d)
+		return nil
+	}), "anti-entropy-interval", "")
+
 	flags.Var((funcVar)(func(s string) error {
-		configPaths = append(configPaths, s)
+		*configPaths = append(*configPaths, s)
 		return nil
 	}), "config", "")
 
@@ -301,6 +510,21 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "exclude", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.Audit.Path = config.String(s)
+		return nil
+	}), "audit-path", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.History.Path = config.String(s)
+		return nil
+	}), "history-path", "")
+
+	flags.Var((funcIntVar)(func(i int) error {
+		c.History.Versions = config.Int(i)
+		return nil
+	}), "history-versions", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		sig, err := signals.Parse(s)
 		if err != nil {
@@ -310,6 +534,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "kill-signal", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.LogFormat = config.String(s)
+		return nil
+	}), "log-format", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.LogLevel = config.String(s)
 		return nil
@@ -320,8 +549,6 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "max-stale", "")
 
-	flags.BoolVar(&once, "once", false, "")
-
 	flags.Var((funcVar)(func(s string) error {
 		c.PidFile = config.String(s)
 		return nil
@@ -369,8 +596,10 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "wait", "")
 
-	flags.BoolVar(&isVersion, "v", false, "")
-	flags.BoolVar(&isVersion, "version", false, "")
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.WatchConfig = config.Bool(b)
+		return nil
+	}), "watch-config", "")
 
 	// Deprecations
 	// TODO remove in 0.5.0
@@ -432,19 +661,7 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 	// End deprecations
 	// TODO remove in 0.5.0
 
-	// If there was a parser error, stop
-	if err := flags.Parse(args); err != nil {
-		return nil, nil, false, false, err
-	}
-
-	// Error if extra arguments are present
-	args = flags.Args()
-	if len(args) > 0 {
-		return nil, nil, false, false, fmt.Errorf("cli: extra argument(s): %q",
-			args)
-	}
-
-	return c, configPaths, once, isVersion, nil
+	return flags
 }
 
 // handleError outputs the given error's Error() to the errStream and returns
@@ -470,32 +687,137 @@ func loadConfigs(paths []string, o *Config) (*Config, error) {
 }
 
 // logError logs an error message and then returns the given status.
+// printf writes a message for the user to the error stream, regardless of the
+// log level. With the JSON log format, it is written as an INFO line from the
+// cli component instead, so that every line on the error stream is JSON.
+func (cli *CLI) printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !logFieldsEnabled.Load() {
+		fmt.Fprint(cli.errStream, msg)
+		return
+	}
+
+	w := &jsonLogWriter{out: cli.errStream}
+	fmt.Fprintf(w, "%s [INFO] (cli) %s\n", time.Now().Format(logTimeFormat),
+		strings.TrimRight(msg, "\n"))
+}
+
 func logError(err error, status int) int {
-	log.Printf("[ERR] (cli) %s", err)
+	logf(logFields{"error": err.Error()}, "[ERR] (cli) %s", err)
 	return status
 }
 
+// setupCommand loads the configuration for a subcommand from the given paths,
+// with the configuration from the flags taking precedence, sets up logging,
+// and adds any prefixes and excludes from the config_source key.
+func (cli *CLI) setupCommand(o *Config, paths []string) (*Config, error) {
+	c, err := loadConfigs(paths, o)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err = cli.setup(c)
+	if err != nil {
+		return nil, err
+	}
+
+	_, remote, err := readConfigSource(c)
+	if err != nil {
+		return nil, err
+	}
+	return mergeConfigSource(c, remote), nil
+}
+
 func (cli *CLI) setup(conf *Config) (*Config, error) {
+	format := config.StringVal(conf.LogFormat)
+
+	var w io.Writer
+	switch format {
+	case LogFormatText:
+		w = cli.errStream
+	case LogFormatJSON:
+		w = &jsonLogWriter{out: cli.errStream}
+	default:
+		return nil, fmt.Errorf("invalid log_format %q, valid formats are %s, %s",
+			format, LogFormatText, LogFormatJSON)
+	}
+
 	if err := logging.Setup(&logging.Config{
 		SyslogName:     version.Name,
 		Level:          config.StringVal(conf.LogLevel),
 		Syslog:         config.BoolVal(conf.Syslog.Enabled),
 		SyslogFacility: config.StringVal(conf.Syslog.Facility),
-		Writer:         cli.errStream,
+		Writer:         w,
 	}); err != nil {
 		return nil, err
 	}
+	logFieldsEnabled.Store(format == LogFormatJSON)
 
 	return conf, nil
 }
 
-const usage = `Usage: %s [options]
+const usage = `Usage: %[1]s [options]
+       %[1]s decrypt [options] <key>
+       %[1]s export [options]
+       %[1]s import [options] <path>
+       %[1]s rollback [options]
+       %[1]s pause [options]
+       %[1]s resume [options]
+       %[1]s validate [options]
 
   Replicates key-value data from a source datacenter to the datacenter(s) of a
   Consul agent.
 
+Commands:
+
+  decrypt <key>
+      Reads the given key from the local datacenter, or the datacenter given
+      with -datacenter=<dc>, and writes its value to standard out decrypted
+      with the keys in -key-file=<path>. This is meant for debugging prefixes
+      that encrypt their values.
+
+  export
+      Writes a snapshot of the current keys, flags, and values of each prefix
+      to standard out as JSON, skipping any excluded keys.
+
+  import <path>
+      Writes the keys in the snapshot at the given path into the local
+      datacenter, applying the same excludes and destination rewriting as
+      replication. Use -destination=<prefix> to override the destination
+      stored in the snapshot.
+
+  rollback
+      Lists the stored versions of the prefix when history is enabled. Use
+      -to=<version> to restore the destination of the prefix to that version
+      and pause replication of the prefix until it is resumed.
+
+  pause
+      Pauses replication of each prefix. Running daemons keep watching the
+      prefix but stop writing to its destination until it is resumed.
+
+  resume
+      Resumes replication of each paused prefix. Running daemons catch up with
+      any changes made while it was paused, and every key is replicated again
+      on the next pass after a rollback.
+
+  validate
+      Loads the configuration and reports every problem with it, such as
+      prefixes that write to overlapping destinations, destinations that
+      overlap the status directory or a source in the local datacenter, and
+      excludes that do not match any prefix. This does not contact Consul. Use
+      -local-datacenter=<dc> to also report prefixes that replicate from the
+      local datacenter. config_source keys are not checked.
+
 Options:
 
+  -anti-entropy-interval=<duration>
+      Sets the interval at which every prefix is replicated, even if it has
+      not changed. By default, only prefixes that changed are replicated.
+
+  -audit-path=<path>
+      Sets the path of a file to append a JSON line to for every key written
+      or deleted in a destination. The file is rotated at 100MB by default.
+
   -config=<path>
       Sets the path to a configuration file or folder on disk. This can be
       specified multiple times to load multiple files or folders. If multiple
@@ -565,9 +887,22 @@ Options:
   -exclude=<src>
       Provides a prefix to exclude from replication.
 
+  -history-path=<path>
+      Sets the directory on disk to store previous versions of each prefix.
+      By default, versions are stored in the KV store under the status dir.
+
+  -history-versions=<int>
+      Sets the number of previous versions of each prefix to keep for
+      rollback. History is disabled by default.
+
   -kill-signal=<signal>
       Signal to listen to gracefully terminate the process
 
+  -log-format=<format>
+      Set the format of log messages - values are "text" (the default) and
+      "json", which writes one JSON object per message with fields describing
+      the prefix, key and operation
+
   -log-level=<level>
       Set the logging level - values are "debug", "info", "warn", and "err"
 
@@ -606,6 +941,10 @@ Options:
       Sets the 'min(:max)' amount of time to wait before writing a template (and
       triggering a command)
 
+  -watch-config
+      Reload the configuration when any of the files or folders given with
+      -config change on disk
+
   -v, -version
       Print the version of this daemon
 `
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/hashicorp/consul-replicate/version"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+)
+
+// runDecrypt reads an encrypted key and writes its decrypted value to the out
+// stream, for debugging.
+func (cli *CLI) runDecrypt(args []string) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	var keyFile, datacenter string
+	flags.StringVar(&keyFile, "key-file", "", "")
+	flags.StringVar(&datacenter, "datacenter", "", "")
+
+	keys, err := parseInterspersed(flags, args)
+	if err == nil && len(keys) != 1 {
+		err = fmt.Errorf("cli: decrypt requires exactly one key")
+	}
+	if err == nil && keyFile == "" {
+		err = fmt.Errorf("cli: decrypt requires a -key-file")
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err := cli.setupCommand(c, configPaths)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	clients, err := newClientSet(cfg)
+	if err != nil {
+		return logError(err, ExitCodeError)
+	}
+
+	value, err := decryptKey(clients, keyFile, keys[0], datacenter)
+	if err != nil {
+		return logError(fmt.Errorf("decrypt: %s", err), ExitCodeError)
+	}
+
+	if _, err := cli.outStream.Write(value); err != nil {
+		return logError(fmt.Errorf("decrypt: %s", err), ExitCodeError)
+	}
+	return ExitCodeOK
+}
+
+// decryptKey reads the given key from the given datacenter, or the local
+// datacenter if empty, and decrypts its value with the keys in the key file.
+func decryptKey(clients *dep.ClientSet, keyFile, key, datacenter string) ([]byte, error) {
+	keys, err := loadKeyring(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %s", err)
+	}
+
+	pair, _, err := clients.Consul().KV().Get(key, &api.QueryOptions{
+		Datacenter: datacenter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, fmt.Errorf("key %q not found", key)
+	}
+
+	value, ok, err := keys.open(pair.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: value is not encrypted", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/hashicorp/consul-replicate/version"
+)
+
+// runPause pauses replication of the configured prefixes.
+func (cli *CLI) runPause(args []string) int {
+	return cli.runPrefixCommand("pause", args, func(r *Runner, prefix *PrefixConfig) error {
+		if err := r.Pause(prefix); err != nil {
+			return err
+		}
+		cli.printf("Paused replication of %s.\n", prefix.Dependency)
+		return nil
+	})
+}
+
+// runResume resumes replication of the configured prefixes.
+func (cli *CLI) runResume(args []string) int {
+	return cli.runPrefixCommand("resume", args, func(r *Runner, prefix *PrefixConfig) error {
+		if err := r.Resume(prefix); err != nil {
+			return err
+		}
+		cli.printf("Resumed replication of %s.\n", prefix.Dependency)
+		return nil
+	})
+}
+
+// runPrefixCommand parses the flags and configuration for the named command
+// and calls fn for each configured prefix.
+func (cli *CLI) runPrefixCommand(name string, args []string, fn func(*Runner, *PrefixConfig) error) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	extra, err := parseInterspersed(flags, args)
+	if err == nil && len(extra) > 0 {
+		err = fmt.Errorf("cli: extra argument(s): %q", extra)
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err := cli.setupCommand(c, configPaths)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	if len(*cfg.Prefixes) == 0 {
+		return logError(fmt.Errorf("%s: no prefixes given", name), ExitCodeConfigError)
+	}
+
+	runner, err := NewRunner(cfg, true)
+	if err != nil {
+		return logError(err, ExitCodeRunnerError)
+	}
+
+	// Stopping the runner sends any queued notify events and closes the audit
+	// log before the command exits
+	defer runner.Stop()
+
+	for _, prefix := range *cfg.Prefixes {
+		if err := fn(runner, prefix); err != nil {
+			return logError(fmt.Errorf("%s: %s: %s", name, prefix.Dependency, err),
+				ExitCodeError)
+		}
+	}
+
+	return ExitCodeOK
+}
@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/hashicorp/consul-replicate/version"
+)
+
+// runRollback lists the stored versions of the configured prefix or, if a
+// version is given, rolls its destination back to that version and pauses
+// replication of the prefix.
+func (cli *CLI) runRollback(args []string) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	var to uint64
+	flags.Uint64Var(&to, "to", 0, "")
+
+	extra, err := parseInterspersed(flags, args)
+	if err == nil && len(extra) > 0 {
+		err = fmt.Errorf("cli: extra argument(s): %q", extra)
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err := cli.setupCommand(c, configPaths)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	if len(*cfg.Prefixes) != 1 {
+		return logError(fmt.Errorf("rollback: exactly one prefix is required"),
+			ExitCodeConfigError)
+	}
+	prefix := (*cfg.Prefixes)[0]
+
+	runner, err := NewRunner(cfg, true)
+	if err != nil {
+		return logError(err, ExitCodeRunnerError)
+	}
+
+	// Stopping the runner sends any queued notify events and closes the audit
+	// log before the command exits
+	defer runner.Stop()
+
+	if to != 0 {
+		if err := runner.Rollback(prefix, to); err != nil {
+			return logError(fmt.Errorf("rollback: %s", err), ExitCodeError)
+		}
+		cli.printf("Rolled back %s to version %d. Replication "+
+			"of this prefix is paused until it is resumed.\n", prefix.Dependency, to)
+		return ExitCodeOK
+	}
+
+	indexes, err := runner.History(prefix)
+	if err != nil {
+		return logError(fmt.Errorf("rollback: %s", err), ExitCodeError)
+	}
+
+	w := tabwriter.NewWriter(cli.outStream, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "VERSION\tCREATED\tKEYS\n")
+	for _, index := range indexes {
+		s, err := runner.Version(prefix, index)
+		if err != nil {
+			return logError(fmt.Errorf("rollback: %s", err), ExitCodeError)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\n", index, s.Created.Format("2006-01-02T15:04:05Z"),
+			len(s.Prefixes[0].Pairs))
+	}
+	w.Flush()
+
+	return ExitCodeOK
+}
@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/consul-replicate/version"
+	"github.com/hashicorp/consul-template/config"
+)
+
+// runExport writes a snapshot of the configured prefixes to the out stream.
+func (cli *CLI) runExport(args []string) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	extra, err := parseInterspersed(flags, args)
+	if err == nil && len(extra) > 0 {
+		err = fmt.Errorf("cli: extra argument(s): %q", extra)
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err := cli.setupCommand(c, configPaths)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	if len(*cfg.Prefixes) == 0 {
+		return logError(fmt.Errorf("export: no prefixes given"), ExitCodeConfigError)
+	}
+
+	clients, err := newClientSet(cfg)
+	if err != nil {
+		return logError(err, ExitCodeError)
+	}
+
+	s, err := exportSnapshot(cfg.Prefixes, cfg.Excludes, clients,
+		config.TimeDurationVal(cfg.MaxStale) != 0)
+	if err != nil {
+		return logError(fmt.Errorf("export: %s", err), ExitCodeError)
+	}
+
+	enc := json.NewEncoder(cli.outStream)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return logError(fmt.Errorf("export: %s", err), ExitCodeError)
+	}
+
+	return ExitCodeOK
+}
+
+// runImport writes the keys in a snapshot file into the local datacenter.
+func (cli *CLI) runImport(args []string) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	var destination string
+	flags.StringVar(&destination, "destination", "", "")
+
+	paths, err := parseInterspersed(flags, args)
+	if err == nil && len(paths) != 1 {
+		err = fmt.Errorf("cli: import requires exactly one snapshot path")
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err := cli.setupCommand(c, configPaths)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	b, err := os.ReadFile(paths[0])
+	if err != nil {
+		return logError(fmt.Errorf("import: %s", err), ExitCodeError)
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return logError(fmt.Errorf("import: %s: %s", paths[0], err), ExitCodeError)
+	}
+
+	clients, err := newClientSet(cfg)
+	if err != nil {
+		return logError(err, ExitCodeError)
+	}
+
+	if err := importSnapshot(&s, destination, cfg.Prefixes, cfg.Excludes, clients); err != nil {
+		return logError(fmt.Errorf("import: %s", err), ExitCodeError)
+	}
+
+	return ExitCodeOK
+}
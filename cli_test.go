@@ -129,6 +129,24 @@ func TestCLI_ParseFlags(t *testing.T) {
 		// End Depreations
 		// TODO remove in 0.8.0
 
+		{
+			"anti-entropy-interval",
+			[]string{"-anti-entropy-interval", "1h"},
+			&Config{
+				AntiEntropyInterval: config.TimeDuration(1 * time.Hour),
+			},
+			false,
+		},
+		{
+			"audit-path",
+			[]string{"-audit-path", "/var/log/consul-replicate/audit.log"},
+			&Config{
+				Audit: &AuditConfig{
+					Path: config.String("/var/log/consul-replicate/audit.log"),
+				},
+			},
+			false,
+		},
 		{
 			"config",
 			[]string{"-config", f.Name()},
@@ -417,6 +435,26 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"history-path",
+			[]string{"-history-path", "/var/lib/consul-replicate"},
+			&Config{
+				History: &HistoryConfig{
+					Path: config.String("/var/lib/consul-replicate"),
+				},
+			},
+			false,
+		},
+		{
+			"history-versions",
+			[]string{"-history-versions", "5"},
+			&Config{
+				History: &HistoryConfig{
+					Versions: config.Int(5),
+				},
+			},
+			false,
+		},
 		{
 			"kill-signal",
 			[]string{"-kill-signal", "SIGUSR1"},
@@ -425,6 +463,14 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"log-format",
+			[]string{"-log-format", "json"},
+			&Config{
+				LogFormat: config.String("json"),
+			},
+			false,
+		},
 		{
 			"log-level",
 			[]string{"-log-level", "DEBUG"},
@@ -535,6 +581,14 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"watch-config",
+			[]string{"-watch-config"},
+			&Config{
+				WatchConfig: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"wait_min",
 			[]string{"-wait", "10s"},
@@ -0,0 +1,183 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul-replicate/version"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// runValidate loads the configuration and reports every problem with it,
+// including logical errors that are otherwise only found at runtime, without
+// contacting Consul.
+func (cli *CLI) runValidate(args []string) int {
+	c := DefaultConfig()
+	configPaths := make([]string, 0, 6)
+	flags := newFlagSet(c, &configPaths)
+
+	var localDatacenter string
+	flags.StringVar(&localDatacenter, "local-datacenter", "", "")
+
+	extra, err := parseInterspersed(flags, args)
+	if err == nil && len(extra) > 0 {
+		err = fmt.Errorf("cli: extra argument(s): %q", extra)
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.errStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	// Load each file separately to keep track of where each prefix and exclude
+	// is defined. Blocks are merged in order, so origins line up with the
+	// final lists.
+	var problems int
+	var prefixOrigins, excludeOrigins []string
+	cfg := DefaultConfig()
+	for _, path := range configPaths {
+		files, err := configFiles(path)
+		if err != nil {
+			fmt.Fprintf(cli.errStream, "%s: %s\n", path, err)
+			problems++
+			continue
+		}
+
+		for _, file := range files {
+			fc, err := FromFile(file)
+			if err != nil {
+				fmt.Fprintf(cli.errStream, "%s\n", err)
+				problems++
+				continue
+			}
+
+			// Files without any prefix or exclude blocks leave them nil
+			if fc.Prefixes != nil {
+				prefixOrigins = append(prefixOrigins,
+					blockOrigins(file, "prefix", len(*fc.Prefixes))...)
+			}
+			if fc.Excludes != nil {
+				excludeOrigins = append(excludeOrigins,
+					blockOrigins(file, "exclude", len(*fc.Excludes))...)
+			}
+			cfg = cfg.Merge(fc)
+		}
+	}
+	for range *c.Prefixes {
+		prefixOrigins = append(prefixOrigins, "command line")
+	}
+	for range *c.Excludes {
+		excludeOrigins = append(excludeOrigins, "command line")
+	}
+	cfg = cfg.Merge(c)
+	cfg.Finalize()
+
+	origins := make(map[interface{}]string)
+	for i, prefix := range *cfg.Prefixes {
+		origins[prefix] = prefixOrigins[i]
+	}
+	for i, exclude := range *cfg.Excludes {
+		origins[exclude] = excludeOrigins[i]
+	}
+
+	for _, p := range checkConfig(cfg, localDatacenter) {
+		switch {
+		case p.Prefix != nil:
+			fmt.Fprintf(cli.errStream, "%s: %s\n", origins[p.Prefix], p)
+		case p.Exclude != nil:
+			fmt.Fprintf(cli.errStream, "%s: %s\n", origins[p.Exclude], p)
+		default:
+			fmt.Fprintf(cli.errStream, "%s\n", p)
+		}
+		problems++
+	}
+
+	if problems > 0 {
+		fmt.Fprintf(cli.errStream, "Found %d problem(s) in the configuration.\n", problems)
+		return ExitCodeConfigError
+	}
+
+	fmt.Fprintf(cli.errStream, "The configuration is valid.\n")
+	return ExitCodeOK
+}
+
+// configFiles returns the configuration files at the given path in the order
+// they are loaded by FromPath.
+func configFiles(path string) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Mode().IsRegular() {
+		return []string{path}, nil
+	}
+	if !stat.Mode().IsDir() {
+		return nil, fmt.Errorf("unknown filetype: %q", stat.Mode().String())
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// blockOrigins returns the "file:line" of each top-level block with the given
+// name in the file. If the lines cannot be determined, such as when a list is
+// used instead of repeated blocks, only the file name is returned for each of
+// the n blocks.
+func blockOrigins(file, name string, n int) []string {
+	origins := make([]string, n)
+	for i := range origins {
+		origins[i] = file
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return origins
+	}
+	root, err := hcl.ParseBytes(b)
+	if err != nil {
+		return origins
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return origins
+	}
+
+	var lines []int
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			continue
+		}
+		key := item.Keys[0].Token
+		if strings.Trim(key.Text, `"`) == name {
+			lines = append(lines, key.Pos.Line)
+		}
+	}
+	if len(lines) != n {
+		return origins
+	}
+
+	for i, line := range lines {
+		origins[i] = fmt.Sprintf("%s:%d", file, line)
+	}
+	return origins
+}
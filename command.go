@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// maxCommandEnvKeys is the maximum size in bytes of the list of keys in each of
+// the CONSUL_REPLICATE_UPDATED_KEYS and CONSUL_REPLICATE_DELETED_KEYS variables,
+// well under the limit on the size of a single environment variable. The full
+// lists are always written to files.
+const maxCommandEnvKeys = 32 * 1024
+
+// commandError is returned when a prefix command exits with a non-zero status.
+// It implements manager.ErrExitable, so consul-replicate exits with the same
+// status as the command.
+type commandError struct {
+	prefix string
+	code   int
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("command for %q exited with status %d", e.prefix, e.code)
+}
+
+// ExitStatus returns the exit status of the command.
+func (e *commandError) ExitStatus() int {
+	return e.code
+}
+
+// runCommand runs the command of the prefix, if any, after a pass that wrote
+// the updates and deleted the deletes. The command is run through the shell
+// with the environment describing the pass, and is killed if it does not
+// finish within the command timeout. The keys written and deleted are written
+// to temporary files, which are removed once the command exits.
+func (r *Runner) runCommand(prefix *PrefixConfig, updates, deletes []string) error {
+	command := config.StringVal(prefix.Command)
+	if command == "" {
+		return nil
+	}
+
+	timeout := config.TimeDurationVal(prefix.CommandTimeout)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	updatesFile, err := writeKeysFile(updates)
+	if err != nil {
+		return fmt.Errorf("command for %q: %s", prefix.Dependency, err)
+	}
+	defer os.Remove(updatesFile)
+
+	deletesFile, err := writeKeysFile(deletes)
+	if err != nil {
+		return fmt.Errorf("command for %q: %s", prefix.Dependency, err)
+	}
+	defer os.Remove(deletesFile)
+
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+
+	cmd := exec.CommandContext(ctx, shell, flag, command)
+	cmd.Env = append(os.Environ(), commandEnv(prefix, updates, deletes, updatesFile, deletesFile)...)
+	cmd.Stdout = r.outStream
+	cmd.Stderr = r.errStream
+	cmd.WaitDelay = time.Second
+
+	logf(prefixLogFields(prefix), "[INFO] (runner) running command %q", command)
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command for %q timed out after %s", prefix.Dependency, timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &commandError{prefix: prefixName(prefix), code: exitErr.ExitCode()}
+	}
+	if err != nil {
+		return fmt.Errorf("command for %q: %s", prefix.Dependency, err)
+	}
+	return nil
+}
+
+// commandEnv returns the environment variables describing a pass of the
+// prefix. Keys are separated by newlines. The lists of keys in the environment
+// are truncated to maxCommandEnvKeys, while the given files hold every key.
+func commandEnv(prefix *PrefixConfig, updates, deletes []string, updatesFile, deletesFile string) []string {
+	updatedKeys, updatesTruncated := joinKeys(updates, maxCommandEnvKeys)
+	deletedKeys, deletesTruncated := joinKeys(deletes, maxCommandEnvKeys)
+	return []string{
+		"CONSUL_REPLICATE_SOURCE=" + config.StringVal(prefix.Source),
+		"CONSUL_REPLICATE_DATACENTER=" + config.StringVal(prefix.Datacenter),
+		"CONSUL_REPLICATE_DESTINATION=" + config.StringVal(prefix.Destination),
+		"CONSUL_REPLICATE_UPDATES=" + strconv.Itoa(len(updates)),
+		"CONSUL_REPLICATE_DELETES=" + strconv.Itoa(len(deletes)),
+		"CONSUL_REPLICATE_UPDATED_KEYS=" + updatedKeys,
+		"CONSUL_REPLICATE_DELETED_KEYS=" + deletedKeys,
+		"CONSUL_REPLICATE_KEYS_TRUNCATED=" + strconv.FormatBool(updatesTruncated || deletesTruncated),
+		"CONSUL_REPLICATE_UPDATED_KEYS_FILE=" + updatesFile,
+		"CONSUL_REPLICATE_DELETED_KEYS_FILE=" + deletesFile,
+	}
+}
+
+// joinKeys joins as many whole keys as fit in max bytes with newlines, and
+// returns true if any keys were left out.
+func joinKeys(keys []string, max int) (string, bool) {
+	var size int
+	for i, key := range keys {
+		size += len(key)
+		if i > 0 {
+			size++
+		}
+		if size > max {
+			return strings.Join(keys[:i], "\n"), true
+		}
+	}
+	return strings.Join(keys, "\n"), false
+}
+
+// writeKeysFile writes the keys, one per line, to a new temporary file and
+// returns its path.
+func writeKeysFile(keys []string) (string, error) {
+	f, err := os.CreateTemp("", "consul-replicate-keys-")
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(f, key); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/manager"
+	"github.com/hashicorp/go-multierror"
+)
+
+func TestRunner_runCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run with sh")
+	}
+
+	cases := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		out     string
+		code    int
+		err     bool
+	}{
+		{
+			"none",
+			"",
+			0,
+			"",
+			0,
+			false,
+		},
+		{
+			"env",
+			`echo "$CONSUL_REPLICATE_SOURCE@$CONSUL_REPLICATE_DATACENTER:$CONSUL_REPLICATE_DESTINATION" ` +
+				`"$CONSUL_REPLICATE_UPDATES/$CONSUL_REPLICATE_DELETES"; ` +
+				`echo "$CONSUL_REPLICATE_UPDATED_KEYS"; echo "$CONSUL_REPLICATE_DELETED_KEYS"`,
+			time.Second,
+			"global@dc1:default 2/1\ndefault/a\ndefault/b\ndefault/c\n",
+			0,
+			false,
+		},
+		{
+			"env_files",
+			`cat "$CONSUL_REPLICATE_UPDATED_KEYS_FILE" "$CONSUL_REPLICATE_DELETED_KEYS_FILE"; ` +
+				`echo "$CONSUL_REPLICATE_KEYS_TRUNCATED"`,
+			time.Second,
+			"default/a\ndefault/b\ndefault/c\nfalse\n",
+			0,
+			false,
+		},
+		{
+			"exit_status",
+			"exit 3",
+			time.Second,
+			"",
+			3,
+			true,
+		},
+		{
+			"timeout",
+			"sleep 5",
+			50 * time.Millisecond,
+			"",
+			0,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var out bytes.Buffer
+			r := &Runner{outStream: &out, errStream: &out}
+
+			prefix := &PrefixConfig{
+				Command:        config.String(tc.command),
+				CommandTimeout: config.TimeDuration(tc.timeout),
+				Datacenter:     config.String("dc1"),
+				Destination:    config.String("default"),
+				Source:         config.String("global"),
+			}
+
+			err := r.runCommand(prefix, []string{"default/a", "default/b"}, []string{"default/c"})
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+
+			if act := out.String(); act != tc.out {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.out, act)
+			}
+
+			// The exit status is preserved through the runner's multierror
+			var typed manager.ErrExitable
+			if errors.As(multierror.Append(nil, err), &typed) {
+				if act := typed.ExitStatus(); act != tc.code {
+					t.Errorf("\nexp: %#v\nact: %#v", tc.code, act)
+				}
+			} else if tc.code != 0 {
+				t.Errorf("expected exit status %d, got %v", tc.code, err)
+			}
+
+			if tc.name == "timeout" && !strings.Contains(err.Error(), "timed out") {
+				t.Errorf("expected timeout error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestJoinKeys(t *testing.T) {
+	keys := []string{"default/a", "default/b", "default/c"}
+
+	cases := []struct {
+		name      string
+		max       int
+		exp       string
+		truncated bool
+	}{
+		{
+			"all",
+			29,
+			"default/a\ndefault/b\ndefault/c",
+			false,
+		},
+		{
+			"truncated",
+			28,
+			"default/a\ndefault/b",
+			true,
+		},
+		{
+			"none",
+			5,
+			"",
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			act, truncated := joinKeys(keys, tc.max)
+			if act != tc.exp {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, act)
+			}
+			if truncated != tc.truncated {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.truncated, truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+const (
+	// CompressionNone copies values to the destination as-is.
+	CompressionNone = "none"
+
+	// CompressionGzip compresses values with gzip before writing them to the
+	// destination. Values that are already compressed are copied as-is.
+	CompressionGzip = "gzip"
+
+	// CompressionGunzip decompresses values that were compressed with gzip in
+	// the source before writing them to the destination. Other values, and
+	// values that cannot be decompressed, are copied as-is.
+	CompressionGunzip = "gunzip"
+)
+
+// maxGunzipBytes is the largest value that is decompressed for a prefix
+// without a max_bytes, so that a small value cannot expand without bound.
+const maxGunzipBytes = 64 * 1024 * 1024
+
+// gzipMagic is the header that every gzip stream begins with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip returns true if the value is compressed with gzip.
+func isGzip(value []byte) bool {
+	return bytes.HasPrefix(value, gzipMagic)
+}
+
+// compressValue compresses or decompresses the value for the given compression
+// mode. Compressing the same value always gives the same result, so unchanged
+// values are still recognized in the destination. Decompressing a value larger
+// than limit bytes is an error.
+func compressValue(mode string, value []byte, limit int) ([]byte, error) {
+	switch mode {
+	case CompressionGzip:
+		if isGzip(value) {
+			return value, nil
+		}
+
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionGunzip:
+		if !isGzip(value) {
+			return value, nil
+		}
+
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, fmt.Errorf("decompressed value is larger than %d bytes", limit)
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
+
+// decodeValue returns the value of the source key at path as it is written to
+// the prefix's destination, before it is encrypted. Values encrypted in the
+// source are decrypted first if the prefix decrypts them, and then compressed
+// or decompressed.
+func decodeValue(prefix *PrefixConfig, keys *keyring, path string, value []byte) ([]byte, error) {
+	if encryptMode(prefix, keys) == EncryptModeDecrypt {
+		var err error
+		if value, _, err = keys.open(value); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := config.IntVal(prefix.MaxBytes)
+	if limit <= 0 {
+		limit = maxGunzipBytes
+	}
+	mode := config.StringVal(prefix.Compression)
+	out, err := compressValue(mode, value, limit)
+	if err != nil && mode == CompressionGunzip {
+		// The value only begins like gzip, or is too large to decompress
+		log.Printf("[WARN] (runner) could not decompress %q, copying it as-is: %s",
+			path, err)
+		return value, nil
+	}
+	return out, err
+}
+
+// encodeValue returns the value of the source key at path as it is written to
+// the prefix's destination.
+func encodeValue(prefix *PrefixConfig, keys *keyring, path string, value []byte) ([]byte, error) {
+	value, err := decodeValue(prefix, keys, path, value)
+	if err != nil {
+		return nil, err
+	}
+	if encryptMode(prefix, keys) == EncryptModeEncrypt {
+		return keys.seal(value)
+	}
+	return value, nil
+}
+
+// decodeFailure is a pair whose value could not be decoded, such as a value
+// encrypted with a key that is not in the key file.
+type decodeFailure struct {
+	pair *dep.KeyPair
+	err  error
+}
+
+// encodePairs returns the pairs with their values as they are written to the
+// prefix's destination, before they are encrypted. The pairs are shared with
+// the watch, so changed pairs are copied rather than modified. Pairs that
+// cannot be decoded are left out and returned as failures, so that a single
+// bad value does not fail every pass of the prefix.
+func encodePairs(prefix *PrefixConfig, keys *keyring, pairs []*dep.KeyPair) ([]*dep.KeyPair, []*decodeFailure) {
+	if config.StringVal(prefix.Compression) == CompressionNone &&
+		encryptMode(prefix, keys) != EncryptModeDecrypt {
+		return pairs, nil
+	}
+
+	encoded := make([]*dep.KeyPair, 0, len(pairs))
+	var failures []*decodeFailure
+	for _, pair := range pairs {
+		value, err := decodeValue(prefix, keys, pair.Path, []byte(pair.Value))
+		if err != nil {
+			failures = append(failures, &decodeFailure{pair: pair, err: err})
+			continue
+		}
+
+		p := *pair
+		p.Value = string(value)
+		encoded = append(encoded, &p)
+	}
+	return encoded, failures
+}
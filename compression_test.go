@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestCompressValue(t *testing.T) {
+	value := []byte(`{"config": "` + string(bytes.Repeat([]byte("a"), 1024)) + `"}`)
+	compressed, err := compressValue(CompressionGzip, value, maxGunzipBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGzip(compressed) || len(compressed) >= len(value) {
+		t.Fatalf("expected a smaller gzip value, got %d bytes", len(compressed))
+	}
+
+	cases := []struct {
+		name  string
+		mode  string
+		value []byte
+		exp   []byte
+	}{
+		{
+			"none",
+			CompressionNone,
+			value,
+			value,
+		},
+		{
+			"none_compressed",
+			CompressionNone,
+			compressed,
+			compressed,
+		},
+		{
+			"gzip",
+			CompressionGzip,
+			value,
+			compressed,
+		},
+		{
+			"gzip_compressed",
+			CompressionGzip,
+			compressed,
+			compressed,
+		},
+		{
+			"gunzip",
+			CompressionGunzip,
+			compressed,
+			value,
+		},
+		{
+			"gunzip_plain",
+			CompressionGunzip,
+			value,
+			value,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			act, err := compressValue(tc.mode, tc.value, maxGunzipBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tc.exp, act) {
+				t.Errorf("\nexp: %q\nact: %q", tc.exp, act)
+			}
+		})
+	}
+
+	t.Run("gunzip_invalid", func(t *testing.T) {
+		if _, err := compressValue(CompressionGunzip, compressed[:10], maxGunzipBytes); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("gunzip_limit", func(t *testing.T) {
+		if _, err := compressValue(CompressionGunzip, compressed, len(value)-1); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	// Values that cannot be decompressed are copied as-is
+	t.Run("gunzip_fallback", func(t *testing.T) {
+		prefix := &PrefixConfig{
+			Compression: config.String(CompressionGunzip),
+			MaxBytes:    config.Int(len(value) - 1),
+		}
+		for _, v := range [][]byte{compressed[:10], compressed} {
+			act, err := decodeValue(prefix, nil, "global/a", v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v, act) {
+				t.Errorf("\nexp: %q\nact: %q", v, act)
+			}
+		}
+	})
+}
+
+func TestEncodePairs(t *testing.T) {
+	prefix := &PrefixConfig{Compression: config.String(CompressionGzip)}
+	pairs := []*dep.KeyPair{{Path: "global/a", Value: "a", ModifyIndex: 5}}
+
+	encoded, failures := encodePairs(prefix, nil, pairs)
+	if len(failures) != 0 {
+		t.Fatalf("expected no failures, got %d", len(failures))
+	}
+
+	// The source pairs are not modified
+	if pairs[0].Value != "a" {
+		t.Errorf("\nexp: %#v\nact: %#v", "a", pairs[0].Value)
+	}
+	if !isGzip([]byte(encoded[0].Value)) {
+		t.Errorf("expected a gzip value, got %q", encoded[0].Value)
+	}
+	if encoded[0].ModifyIndex != 5 {
+		t.Errorf("\nexp: %#v\nact: %#v", 5, encoded[0].ModifyIndex)
+	}
+}
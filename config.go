@@ -36,19 +36,57 @@ const (
 
 	// DefaultStatusDir is the default directory to post status information.
 	DefaultStatusDir = "service/consul-replicate/statuses"
+
+	// DefaultWatchConfigInterval is the interval at which configuration files
+	// are checked for changes when watch_config is enabled.
+	DefaultWatchConfigInterval = 2 * time.Second
+
+	// DefaultConfigSourceRetryInterval is the time to wait before reading the
+	// config_source key again after an error.
+	DefaultConfigSourceRetryInterval = 5 * time.Second
+
+	// DefaultCommandTimeout is the default time to wait for a prefix command
+	// to finish.
+	DefaultCommandTimeout = 30 * time.Second
+
+	// DefaultShardRefreshInterval is the interval at which the shards of a
+	// sharded prefix are listed again to find added and removed subtrees.
+	DefaultShardRefreshInterval = 30 * time.Second
 )
 
 // Config is used to configure Consul ENV
 type Config struct {
+	// AntiEntropyInterval is the interval at which every prefix is replicated,
+	// whether or not it changed. Zero disables the periodic sweep.
+	AntiEntropyInterval *time.Duration `mapstructure:"anti_entropy_interval"`
+
+	// Audit is the configuration for the audit log of every write and delete.
+	Audit *AuditConfig `mapstructure:"audit"`
+
+	// ConfigSource is the configuration for reading prefixes and excludes from
+	// the Consul KV store.
+	ConfigSource *ConfigSourceConfig `mapstructure:"config_source"`
+
 	// Consul is the configuration for connecting to a Consul cluster.
 	Consul *config.ConsulConfig `mapstructure:"consul"`
 
+	// DestinationIndex is the configuration for the in-memory index of the
+	// keys in each destination.
+	DestinationIndex *DestinationIndexConfig `mapstructure:"destination_index"`
+
 	// Excludes is the list of key prefixes to exclude from replication.
 	Excludes *ExcludeConfigs `mapstructure:"exclude"`
 
+	// History is the configuration for keeping previous versions of each
+	// prefix for rollback.
+	History *HistoryConfig `mapstructure:"history"`
+
 	// KillSignal is the signal to listen for a graceful terminate event.
 	KillSignal *os.Signal `mapstructure:"kill_signal"`
 
+	// LogFormat is the format of log messages, either "text" or "json".
+	LogFormat *string `mapstructure:"log_format"`
+
 	// LogLevel is the level with which to log for this config.
 	LogLevel *string `mapstructure:"log_level"`
 
@@ -56,6 +94,9 @@ type Config struct {
 	// by LastContact.
 	MaxStale *time.Duration `mapstructure:"max_stale"`
 
+	// Notifies is the list of HTTP endpoints to notify of replication events.
+	Notifies *NotifyConfigs `mapstructure:"notify"`
+
 	// PidFile is the path on disk where a PID file should be written containing
 	// this processes PID.
 	PidFile *string `mapstructure:"pid_file"`
@@ -73,8 +114,23 @@ type Config struct {
 	// Syslog is the configuration for syslog.
 	Syslog *config.SyslogConfig `mapstructure:"syslog"`
 
+	// Tracing is the configuration for exporting OpenTelemetry traces.
+	Tracing *TracingConfig `mapstructure:"tracing"`
+
 	// Wait is the quiescence timers.
 	Wait *config.WaitConfig `mapstructure:"wait"`
+
+	// WatchConfig enables reloading the configuration when any of the
+	// configuration files or folders change on disk.
+	WatchConfig *bool `mapstructure:"watch_config"`
+
+	// WriteConcurrency is the maximum number of writes to destinations in
+	// flight at once across all prefixes. Zero means no limit.
+	WriteConcurrency *int `mapstructure:"write_concurrency"`
+
+	// WriteRateLimit limits the rate of writes to destinations across all
+	// prefixes.
+	WriteRateLimit *RateLimitConfig `mapstructure:"write_rate_limit"`
 }
 
 // Copy returns a deep copy of the current configuration. This is useful because
@@ -82,20 +138,44 @@ type Config struct {
 func (c *Config) Copy() *Config {
 	var o Config
 
+	o.AntiEntropyInterval = c.AntiEntropyInterval
+
+	if c.Audit != nil {
+		o.Audit = c.Audit.Copy()
+	}
+
+	if c.ConfigSource != nil {
+		o.ConfigSource = c.ConfigSource.Copy()
+	}
+
 	if c.Consul != nil {
 		o.Consul = c.Consul.Copy()
 	}
 
+	if c.DestinationIndex != nil {
+		o.DestinationIndex = c.DestinationIndex.Copy()
+	}
+
 	if c.Excludes != nil {
 		o.Excludes = c.Excludes.Copy()
 	}
 
+	if c.History != nil {
+		o.History = c.History.Copy()
+	}
+
 	o.KillSignal = c.KillSignal
 
+	o.LogFormat = c.LogFormat
+
 	o.LogLevel = c.LogLevel
 
 	o.MaxStale = c.MaxStale
 
+	if c.Notifies != nil {
+		o.Notifies = c.Notifies.Copy()
+	}
+
 	o.PidFile = c.PidFile
 
 	if c.Prefixes != nil {
@@ -110,10 +190,22 @@ func (c *Config) Copy() *Config {
 		o.Syslog = c.Syslog.Copy()
 	}
 
+	if c.Tracing != nil {
+		o.Tracing = c.Tracing.Copy()
+	}
+
 	if c.Wait != nil {
 		o.Wait = c.Wait.Copy()
 	}
 
+	o.WatchConfig = c.WatchConfig
+
+	o.WriteConcurrency = c.WriteConcurrency
+
+	if c.WriteRateLimit != nil {
+		o.WriteRateLimit = c.WriteRateLimit.Copy()
+	}
+
 	return &o
 }
 
@@ -131,18 +223,42 @@ func (c *Config) Merge(o *Config) *Config {
 
 	r := c.Copy()
 
+	if o.AntiEntropyInterval != nil {
+		r.AntiEntropyInterval = o.AntiEntropyInterval
+	}
+
+	if o.Audit != nil {
+		r.Audit = r.Audit.Merge(o.Audit)
+	}
+
+	if o.ConfigSource != nil {
+		r.ConfigSource = r.ConfigSource.Merge(o.ConfigSource)
+	}
+
 	if o.Consul != nil {
 		r.Consul = r.Consul.Merge(o.Consul)
 	}
 
+	if o.DestinationIndex != nil {
+		r.DestinationIndex = r.DestinationIndex.Merge(o.DestinationIndex)
+	}
+
 	if o.Excludes != nil {
 		r.Excludes = r.Excludes.Merge(o.Excludes)
 	}
 
+	if o.History != nil {
+		r.History = r.History.Merge(o.History)
+	}
+
 	if o.KillSignal != nil {
 		r.KillSignal = o.KillSignal
 	}
 
+	if o.LogFormat != nil {
+		r.LogFormat = o.LogFormat
+	}
+
 	if o.LogLevel != nil {
 		r.LogLevel = o.LogLevel
 	}
@@ -151,6 +267,10 @@ func (c *Config) Merge(o *Config) *Config {
 		r.MaxStale = o.MaxStale
 	}
 
+	if o.Notifies != nil {
+		r.Notifies = r.Notifies.Merge(o.Notifies)
+	}
+
 	if o.PidFile != nil {
 		r.PidFile = o.PidFile
 	}
@@ -171,10 +291,26 @@ func (c *Config) Merge(o *Config) *Config {
 		r.Syslog = r.Syslog.Merge(o.Syslog)
 	}
 
+	if o.Tracing != nil {
+		r.Tracing = r.Tracing.Merge(o.Tracing)
+	}
+
 	if o.Wait != nil {
 		r.Wait = r.Wait.Merge(o.Wait)
 	}
 
+	if o.WatchConfig != nil {
+		r.WatchConfig = o.WatchConfig
+	}
+
+	if o.WriteConcurrency != nil {
+		r.WriteConcurrency = o.WriteConcurrency
+	}
+
+	if o.WriteRateLimit != nil {
+		r.WriteRateLimit = r.WriteRateLimit.Merge(o.WriteRateLimit)
+	}
+
 	return r
 }
 
@@ -185,29 +321,51 @@ func (c *Config) GoString() string {
 	}
 
 	return fmt.Sprintf("&Config{"+
+		"AntiEntropyInterval:%s, "+
+		"Audit:%s, "+
+		"ConfigSource:%s, "+
 		"Consul:%s, "+
+		"DestinationIndex:%s, "+
 		"Excludes:%s, "+
+		"History:%s, "+
 		"KillSignal:%s, "+
+		"LogFormat:%s, "+
 		"LogLevel:%s, "+
 		"MaxStale:%s, "+
+		"Notifies:%s, "+
 		"PidFile:%s, "+
 		"Prefixes:%s, "+
 		"ReloadSignal:%s, "+
 		"StatusDir:%s, "+
 		"Syslog:%s, "+
-		"Wait:%s"+
+		"Tracing:%s, "+
+		"Wait:%s, "+
+		"WatchConfig:%s, "+
+		"WriteConcurrency:%s, "+
+		"WriteRateLimit:%s"+
 		"}",
+		config.TimeDurationGoString(c.AntiEntropyInterval),
+		c.Audit.GoString(),
+		c.ConfigSource.GoString(),
 		c.Consul.GoString(),
+		c.DestinationIndex.GoString(),
 		c.Excludes.GoString(),
+		c.History.GoString(),
 		config.SignalGoString(c.KillSignal),
+		config.StringGoString(c.LogFormat),
 		config.StringGoString(c.LogLevel),
 		config.TimeDurationGoString(c.MaxStale),
+		c.Notifies.GoString(),
 		config.StringGoString(c.PidFile),
 		c.Prefixes.GoString(),
 		config.SignalGoString(c.ReloadSignal),
 		config.StringGoString(c.StatusDir),
 		c.Syslog.GoString(),
+		c.Tracing.GoString(),
 		c.Wait.GoString(),
+		config.BoolGoString(c.WatchConfig),
+		config.IntGoString(c.WriteConcurrency),
+		c.WriteRateLimit.GoString(),
 	)
 }
 
@@ -215,12 +373,19 @@ func (c *Config) GoString() string {
 // variables may be set which control the values for the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		Consul:    config.DefaultConsulConfig(),
-		Excludes:  DefaultExcludeConfigs(),
-		Prefixes:  DefaultPrefixConfigs(),
-		StatusDir: config.String(DefaultStatusDir),
-		Syslog:    config.DefaultSyslogConfig(),
-		Wait:      config.DefaultWaitConfig(),
+		Audit:            DefaultAuditConfig(),
+		ConfigSource:     DefaultConfigSourceConfig(),
+		Consul:           config.DefaultConsulConfig(),
+		DestinationIndex: DefaultDestinationIndexConfig(),
+		Excludes:         DefaultExcludeConfigs(),
+		History:          DefaultHistoryConfig(),
+		Notifies:         DefaultNotifyConfigs(),
+		Prefixes:         DefaultPrefixConfigs(),
+		StatusDir:        config.String(DefaultStatusDir),
+		Syslog:           config.DefaultSyslogConfig(),
+		Tracing:          DefaultTracingConfig(),
+		Wait:             config.DefaultWaitConfig(),
+		WriteRateLimit:   DefaultRateLimitConfig(),
 	}
 }
 
@@ -234,20 +399,48 @@ func (c *Config) Finalize() {
 		return
 	}
 
+	if c.AntiEntropyInterval == nil {
+		c.AntiEntropyInterval = config.TimeDuration(0)
+	}
+
+	if c.Audit == nil {
+		c.Audit = DefaultAuditConfig()
+	}
+	c.Audit.Finalize()
+
+	if c.ConfigSource == nil {
+		c.ConfigSource = DefaultConfigSourceConfig()
+	}
+	c.ConfigSource.Finalize()
+
 	if c.Consul == nil {
 		c.Consul = config.DefaultConsulConfig()
 	}
 	c.Consul.Finalize()
 
+	if c.DestinationIndex == nil {
+		c.DestinationIndex = DefaultDestinationIndexConfig()
+	}
+	c.DestinationIndex.Finalize()
+
 	if c.Excludes == nil {
 		c.Excludes = DefaultExcludeConfigs()
 	}
 	c.Excludes.Finalize()
 
+	if c.History == nil {
+		c.History = DefaultHistoryConfig()
+	}
+	c.History.Finalize()
+
 	if c.KillSignal == nil {
 		c.KillSignal = config.Signal(DefaultKillSignal)
 	}
 
+	if c.LogFormat == nil {
+		c.LogFormat = config.String(LogFormatText)
+	}
+
 	if c.LogLevel == nil {
 		c.LogLevel = stringFromEnv([]string{
 			"CR_LOG",
@@ -259,6 +452,11 @@ func (c *Config) Finalize() {
 		c.MaxStale = config.TimeDuration(DefaultMaxStale)
 	}
 
+	if c.Notifies == nil {
+		c.Notifies = DefaultNotifyConfigs()
+	}
+	c.Notifies.Finalize()
+
 	if c.Prefixes == nil {
 		c.Prefixes = DefaultPrefixConfigs()
 	}
@@ -281,10 +479,28 @@ func (c *Config) Finalize() {
 	}
 	c.Syslog.Finalize()
 
+	if c.Tracing == nil {
+		c.Tracing = DefaultTracingConfig()
+	}
+	c.Tracing.Finalize()
+
 	if c.Wait == nil {
 		c.Wait = config.DefaultWaitConfig()
 	}
 	c.Wait.Finalize()
+
+	if c.WatchConfig == nil {
+		c.WatchConfig = config.Bool(false)
+	}
+
+	if c.WriteConcurrency == nil {
+		c.WriteConcurrency = config.Int(0)
+	}
+
+	if c.WriteRateLimit == nil {
+		c.WriteRateLimit = DefaultRateLimitConfig()
+	}
+	c.WriteRateLimit.Finalize()
 }
 
 // Parse parses the given string contents as a config
@@ -301,15 +517,31 @@ func Parse(s string) (*Config, error) {
 	}
 
 	flattenKeys(parsed, []string{
+		"audit",
+		"config_source",
 		"consul",
 		"consul.auth",
 		"consul.retry",
 		"consul.ssl",
 		"consul.transport",
+		"destination_index",
+		"history",
 		"syslog",
+		"tracing",
 		"wait",
+		"write_rate_limit",
 	})
 
+	// Each notify block is a list item, so flatten its nested stanzas in place
+	if notifies, ok := parsed["notify"].([]map[string]interface{}); ok {
+		for _, n := range notifies {
+			flattenKeys(n, []string{
+				"headers",
+				"retry",
+			})
+		}
+	}
+
 	// Deprecations
 	// TODO remove in 0.5.0
 	flattenKeys(parsed, []string{
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultAuditMaxBytes is the default size at which the audit log is
+	// rotated.
+	DefaultAuditMaxBytes = 100 * 1024 * 1024
+
+	// DefaultAuditMaxFiles is the default number of rotated audit logs to keep.
+	DefaultAuditMaxFiles = 5
+)
+
+// AuditConfig is the configuration for the audit log, which records every
+// write and delete performed in a destination.
+type AuditConfig struct {
+	// Enabled determines if the audit log is written. It is enabled
+	// automatically if a path is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// MaxBytes is the size in bytes at which the audit log is rotated. Zero
+	// disables rotation.
+	MaxBytes *int `mapstructure:"max_bytes"`
+
+	// MaxFiles is the number of rotated audit logs to keep.
+	MaxFiles *int `mapstructure:"max_files"`
+
+	// Path is the path of the audit log on disk.
+	Path *string `mapstructure:"path"`
+}
+
+func DefaultAuditConfig() *AuditConfig {
+	return &AuditConfig{}
+}
+
+func (c *AuditConfig) Copy() *AuditConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o AuditConfig
+
+	o.Enabled = c.Enabled
+
+	o.MaxBytes = c.MaxBytes
+
+	o.MaxFiles = c.MaxFiles
+
+	o.Path = c.Path
+
+	return &o
+}
+
+func (c *AuditConfig) Merge(o *AuditConfig) *AuditConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.MaxBytes != nil {
+		r.MaxBytes = o.MaxBytes
+	}
+
+	if o.MaxFiles != nil {
+		r.MaxFiles = o.MaxFiles
+	}
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	return r
+}
+
+func (c *AuditConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.Path))
+	}
+
+	if c.MaxBytes == nil {
+		c.MaxBytes = config.Int(DefaultAuditMaxBytes)
+	}
+
+	if c.MaxFiles == nil {
+		c.MaxFiles = config.Int(DefaultAuditMaxFiles)
+	}
+
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+}
+
+func (c *AuditConfig) GoString() string {
+	if c == nil {
+		return "(*AuditConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&AuditConfig{"+
+		"Enabled:%s, "+
+		"MaxBytes:%s, "+
+		"MaxFiles:%s, "+
+		"Path:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.IntGoString(c.MaxBytes),
+		config.IntGoString(c.MaxFiles),
+		config.StringGoString(c.Path),
+	)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// FileDestinationConfig is the configuration for replicating a prefix into a
+// directory tree on the local disk instead of the Consul KV store.
+type FileDestinationConfig struct {
+	// Path is the root directory on disk. Each replicated key is written to a
+	// file at the key's path relative to this directory.
+	Path *string `mapstructure:"path"`
+
+	// Perms are the file system permissions to use when creating files. If
+	// unset, existing permissions are preserved and new files are created with
+	// 0644.
+	Perms *os.FileMode `mapstructure:"perms"`
+
+	// User and Group are the user and group name or id that will own the files
+	// written to disk. If unset, the ownership is left unchanged.
+	User  *string `mapstructure:"user"`
+	Group *string `mapstructure:"group"`
+}
+
+func DefaultFileDestinationConfig() *FileDestinationConfig {
+	return &FileDestinationConfig{}
+}
+
+func (c *FileDestinationConfig) Copy() *FileDestinationConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o FileDestinationConfig
+
+	o.Path = c.Path
+
+	o.Perms = c.Perms
+
+	o.User = c.User
+
+	o.Group = c.Group
+
+	return &o
+}
+
+func (c *FileDestinationConfig) Merge(o *FileDestinationConfig) *FileDestinationConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.Perms != nil {
+		r.Perms = o.Perms
+	}
+
+	if o.User != nil {
+		r.User = o.User
+	}
+
+	if o.Group != nil {
+		r.Group = o.Group
+	}
+
+	return r
+}
+
+func (c *FileDestinationConfig) Finalize() {
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.Perms == nil {
+		c.Perms = config.FileMode(0)
+	}
+
+	if c.User == nil {
+		c.User = config.String("")
+	}
+
+	if c.Group == nil {
+		c.Group = config.String("")
+	}
+}
+
+func (c *FileDestinationConfig) GoString() string {
+	if c == nil {
+		return "(*FileDestinationConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&FileDestinationConfig{"+
+		"Path:%s, "+
+		"Perms:%s, "+
+		"User:%s, "+
+		"Group:%s"+
+		"}",
+		config.StringGoString(c.Path),
+		config.FileModeGoString(c.Perms),
+		config.StringGoString(c.User),
+		config.StringGoString(c.Group),
+	)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// DestinationIndexConfig is the configuration for the in-memory index of the
+// keys in each destination, which is used to find keys to delete without
+// listing the destination on every pass.
+type DestinationIndexConfig struct {
+	// Enabled determines if the index is used. If disabled, the destination is
+	// listed on every pass. It is disabled by default, since keys written into
+	// a destination by other processes are only deleted if the index is
+	// refreshed.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Refresh keeps the index of Consul KV destinations up to date with a
+	// blocking query, so that keys written by other processes are noticed.
+	Refresh *bool `mapstructure:"refresh"`
+}
+
+func DefaultDestinationIndexConfig() *DestinationIndexConfig {
+	return &DestinationIndexConfig{}
+}
+
+func (c *DestinationIndexConfig) Copy() *DestinationIndexConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o DestinationIndexConfig
+
+	o.Enabled = c.Enabled
+
+	o.Refresh = c.Refresh
+
+	return &o
+}
+
+func (c *DestinationIndexConfig) Merge(o *DestinationIndexConfig) *DestinationIndexConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Refresh != nil {
+		r.Refresh = o.Refresh
+	}
+
+	return r
+}
+
+func (c *DestinationIndexConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(false)
+	}
+
+	if c.Refresh == nil {
+		c.Refresh = config.Bool(false)
+	}
+}
+
+func (c *DestinationIndexConfig) GoString() string {
+	if c == nil {
+		return "(*DestinationIndexConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&DestinationIndexConfig{"+
+		"Enabled:%s, "+
+		"Refresh:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.BoolGoString(c.Refresh),
+	)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// EncryptModeEncrypt encrypts values before writing them to the
+	// destination.
+	EncryptModeEncrypt = "encrypt"
+
+	// EncryptModeDecrypt decrypts values that were encrypted in the source
+	// before writing them to the destination.
+	EncryptModeDecrypt = "decrypt"
+)
+
+// EncryptConfig is the configuration for the envelope encryption of the values
+// of a prefix.
+type EncryptConfig struct {
+	// Enabled determines if values are encrypted or decrypted. It is enabled
+	// automatically if a key file is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// KeyFile is the path of the file holding the keys, one per line as a key
+	// ID and a base64 encoded AES key. The first key encrypts new values, and
+	// every key can decrypt.
+	KeyFile *string `mapstructure:"key_file"`
+
+	// Mode is either "encrypt" (default) or "decrypt".
+	Mode *string `mapstructure:"mode"`
+}
+
+func DefaultEncryptConfig() *EncryptConfig {
+	return &EncryptConfig{}
+}
+
+func (c *EncryptConfig) Copy() *EncryptConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o EncryptConfig
+
+	o.Enabled = c.Enabled
+
+	o.KeyFile = c.KeyFile
+
+	o.Mode = c.Mode
+
+	return &o
+}
+
+func (c *EncryptConfig) Merge(o *EncryptConfig) *EncryptConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.KeyFile != nil {
+		r.KeyFile = o.KeyFile
+	}
+
+	if o.Mode != nil {
+		r.Mode = o.Mode
+	}
+
+	return r
+}
+
+func (c *EncryptConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.KeyFile))
+	}
+
+	if c.KeyFile == nil {
+		c.KeyFile = config.String("")
+	}
+
+	if c.Mode == nil {
+		c.Mode = config.String(EncryptModeEncrypt)
+	}
+}
+
+func (c *EncryptConfig) GoString() string {
+	if c == nil {
+		return "(*EncryptConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&EncryptConfig{"+
+		"Enabled:%s, "+
+		"KeyFile:%s, "+
+		"Mode:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.KeyFile),
+		config.StringGoString(c.Mode),
+	)
+}
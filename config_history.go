@@ -0,0 +1,109 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// DefaultHistoryVersions is the number of versions kept for each prefix if
+// history is enabled without a number of versions.
+const DefaultHistoryVersions = 10
+
+// HistoryConfig is the configuration for keeping previous versions of each
+// prefix, so that a destination can be rolled back to an earlier pass.
+type HistoryConfig struct {
+	// Enabled determines if history is kept. It is enabled automatically if a
+	// number of versions is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Path is the directory on disk where versions are stored. If empty,
+	// versions are stored in the Consul KV store under the status directory.
+	Path *string `mapstructure:"path"`
+
+	// Versions is the number of versions to keep for each prefix. It must be
+	// at least one if history is enabled.
+	Versions *int `mapstructure:"versions"`
+}
+
+func DefaultHistoryConfig() *HistoryConfig {
+	return &HistoryConfig{}
+}
+
+func (c *HistoryConfig) Copy() *HistoryConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o HistoryConfig
+
+	o.Enabled = c.Enabled
+
+	o.Path = c.Path
+
+	o.Versions = c.Versions
+
+	return &o
+}
+
+func (c *HistoryConfig) Merge(o *HistoryConfig) *HistoryConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.Versions != nil {
+		r.Versions = o.Versions
+	}
+
+	return r
+}
+
+func (c *HistoryConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.IntPresent(c.Versions))
+	}
+
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.Versions == nil {
+		c.Versions = config.Int(DefaultHistoryVersions)
+	}
+}
+
+func (c *HistoryConfig) GoString() string {
+	if c == nil {
+		return "(*HistoryConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&HistoryConfig{"+
+		"Enabled:%s, "+
+		"Path:%s, "+
+		"Versions:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.Path),
+		config.IntGoString(c.Versions),
+	)
+}
@@ -0,0 +1,291 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultNotifyBatchMax is the default maximum number of events sent in a
+	// single request.
+	DefaultNotifyBatchMax = 100
+
+	// DefaultNotifyBatchWait is the default time to wait for more events
+	// before sending a request.
+	DefaultNotifyBatchWait = 5 * time.Second
+
+	// DefaultNotifyRetryAttempts is the default number of times a failed
+	// request is retried.
+	DefaultNotifyRetryAttempts = 5
+
+	// DefaultNotifyTimeout is the default timeout of a single request.
+	DefaultNotifyTimeout = 10 * time.Second
+)
+
+// NotifyConfig is the configuration for an HTTP endpoint that is sent a JSON
+// payload when replication events occur.
+type NotifyConfig struct {
+	// BatchMax is the maximum number of events sent in a single request.
+	BatchMax *int `mapstructure:"batch_max"`
+
+	// BatchWait is the time to wait for more events after the first one
+	// before sending a request.
+	BatchWait *time.Duration `mapstructure:"batch_wait"`
+
+	// Body is a template for the request body. It is given the batch of
+	// events as .Events. If empty, the events are sent as a JSON object.
+	Body *string `mapstructure:"body"`
+
+	// Events is the list of events to send. If empty, all events are sent.
+	Events *[]string `mapstructure:"events"`
+
+	// Headers are added to each request. They are not included in the
+	// configuration that is logged, since they often contain tokens.
+	Headers map[string]string `mapstructure:"headers" json:"-"`
+
+	// Retry is the configuration for retrying failed requests.
+	Retry *config.RetryConfig `mapstructure:"retry"`
+
+	// Timeout is the timeout of a single request.
+	Timeout *time.Duration `mapstructure:"timeout"`
+
+	// URL is the endpoint to POST events to.
+	URL *string `mapstructure:"url"`
+}
+
+func DefaultNotifyConfig() *NotifyConfig {
+	return &NotifyConfig{}
+}
+
+func (c *NotifyConfig) Copy() *NotifyConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o NotifyConfig
+
+	o.BatchMax = c.BatchMax
+
+	o.BatchWait = c.BatchWait
+
+	o.Body = c.Body
+
+	if c.Events != nil {
+		events := make([]string, len(*c.Events))
+		copy(events, *c.Events)
+		o.Events = &events
+	}
+
+	if c.Headers != nil {
+		o.Headers = make(map[string]string, len(c.Headers))
+		for k, v := range c.Headers {
+			o.Headers[k] = v
+		}
+	}
+
+	if c.Retry != nil {
+		o.Retry = c.Retry.Copy()
+	}
+
+	o.Timeout = c.Timeout
+
+	o.URL = c.URL
+
+	return &o
+}
+
+func (c *NotifyConfig) Merge(o *NotifyConfig) *NotifyConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.BatchMax != nil {
+		r.BatchMax = o.BatchMax
+	}
+
+	if o.BatchWait != nil {
+		r.BatchWait = o.BatchWait
+	}
+
+	if o.Body != nil {
+		r.Body = o.Body
+	}
+
+	if o.Events != nil {
+		r.Events = o.Copy().Events
+	}
+
+	if o.Headers != nil {
+		if r.Headers == nil {
+			r.Headers = make(map[string]string, len(o.Headers))
+		}
+		for k, v := range o.Headers {
+			r.Headers[k] = v
+		}
+	}
+
+	if o.Retry != nil {
+		r.Retry = r.Retry.Merge(o.Retry)
+	}
+
+	if o.Timeout != nil {
+		r.Timeout = o.Timeout
+	}
+
+	if o.URL != nil {
+		r.URL = o.URL
+	}
+
+	return r
+}
+
+func (c *NotifyConfig) Finalize() {
+	if c.BatchMax == nil {
+		c.BatchMax = config.Int(DefaultNotifyBatchMax)
+	}
+
+	if c.BatchWait == nil {
+		c.BatchWait = config.TimeDuration(DefaultNotifyBatchWait)
+	}
+
+	if c.Body == nil {
+		c.Body = config.String("")
+	}
+
+	if c.Events == nil {
+		c.Events = &[]string{}
+	}
+
+	if c.Headers == nil {
+		c.Headers = make(map[string]string)
+	}
+
+	if c.Retry == nil {
+		c.Retry = config.DefaultRetryConfig()
+	}
+	if c.Retry.Attempts == nil {
+		c.Retry.Attempts = config.Int(DefaultNotifyRetryAttempts)
+	}
+	c.Retry.Finalize()
+
+	if c.Timeout == nil {
+		c.Timeout = config.TimeDuration(DefaultNotifyTimeout)
+	}
+
+	if c.URL == nil {
+		c.URL = config.String("")
+	}
+}
+
+func (c *NotifyConfig) GoString() string {
+	if c == nil {
+		return "(*NotifyConfig)(nil)"
+	}
+
+	events := "(*[]string)(nil)"
+	if c.Events != nil {
+		events = fmt.Sprintf("%q", *c.Events)
+	}
+
+	headers := make([]string, 0, len(c.Headers))
+	for k, v := range c.Headers {
+		headers = append(headers, fmt.Sprintf("%q:%q", k, v))
+	}
+	sort.Strings(headers)
+
+	return fmt.Sprintf("&NotifyConfig{"+
+		"BatchMax:%s, "+
+		"BatchWait:%s, "+
+		"Body:%s, "+
+		"Events:%s, "+
+		"Headers:{%s}, "+
+		"Retry:%s, "+
+		"Timeout:%s, "+
+		"URL:%s"+
+		"}",
+		config.IntGoString(c.BatchMax),
+		config.TimeDurationGoString(c.BatchWait),
+		config.StringGoString(c.Body),
+		events,
+		strings.Join(headers, ", "),
+		c.Retry.GoString(),
+		config.TimeDurationGoString(c.Timeout),
+		config.StringGoString(c.URL),
+	)
+}
+
+type NotifyConfigs []*NotifyConfig
+
+func DefaultNotifyConfigs() *NotifyConfigs {
+	return &NotifyConfigs{}
+}
+
+func (c *NotifyConfigs) Copy() *NotifyConfigs {
+	if c == nil {
+		return nil
+	}
+
+	o := make(NotifyConfigs, len(*c))
+	for i, t := range *c {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (c *NotifyConfigs) Merge(o *NotifyConfigs) *NotifyConfigs {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (c *NotifyConfigs) Finalize() {
+	if c == nil {
+		*c = *DefaultNotifyConfigs()
+	}
+
+	for _, t := range *c {
+		t.Finalize()
+	}
+}
+
+func (c *NotifyConfigs) GoString() string {
+	if c == nil {
+		return "(*NotifyConfigs)(nil)"
+	}
+
+	s := make([]string, len(*c))
+	for i, t := range *c {
+		s[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
@@ -6,17 +6,99 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/consul-template/config"
 	dep "github.com/hashicorp/consul-template/dependency"
 )
 
+const (
+	// PrefixTypeKV replicates into the Consul KV store of the local datacenter.
+	PrefixTypeKV = "kv"
+
+	// PrefixTypeFile replicates into, or from, a directory tree on the local
+	// disk.
+	PrefixTypeFile = "file"
+)
+
 // PrefixConfig is the representation of a key prefix.
 type PrefixConfig struct {
-	Datacenter  *string          `mapstructure:"datacenter"`
-	Dependency  *dep.KVListQuery `mapstructure:"-"`
-	Destination *string          `mapstructure:"destination"`
-	Source      *string          `mapstructure:"source"`
+	// Command is run after a pass that wrote or deleted at least one key.
+	Command *string `mapstructure:"command"`
+
+	// CommandTimeout is the maximum time to wait for the command to finish.
+	CommandTimeout *time.Duration `mapstructure:"command_timeout"`
+
+	// Compression is how values are compressed on their way to the
+	// destination: "none" (default) copies them as-is, "gzip" compresses them,
+	// and "gunzip" decompresses values that were compressed in the source.
+	Compression *string `mapstructure:"compression"`
+
+	Datacenter  *string        `mapstructure:"datacenter"`
+	Dependency  dep.Dependency `mapstructure:"-"`
+	Destination *string        `mapstructure:"destination"`
+
+	// DestinationFile is the configuration for the "file" destination type.
+	DestinationFile *FileDestinationConfig `mapstructure:"destination_file"`
+
+	// DestinationType is where replicated keys are written, either "kv"
+	// (default) or "file".
+	DestinationType *string `mapstructure:"destination_type"`
+
+	// Encrypt is the configuration for encrypting values on their way to the
+	// destination, or decrypting them.
+	Encrypt *EncryptConfig `mapstructure:"encrypt"`
+
+	// MaxBytes is the maximum size of the keys and values of a single listing
+	// of the source, which is the whole prefix, or a page if the prefix is
+	// paged. If set, the subtrees of a paged prefix are read in batches so the
+	// limit bounds memory; other prefixes are only checked after they are
+	// read. Zero is unlimited.
+	MaxBytes *int `mapstructure:"max_bytes"`
+
+	// MaxDeletes is the maximum number of keys a single pass may delete from
+	// the destination. A pass that would delete more deletes none of them and
+	// fails without a checkpoint. Zero is unlimited.
+	MaxDeletes *int `mapstructure:"max_deletes"`
+
+	// MaxKeys is the maximum number of keys in the prefix. Zero is unlimited.
+	MaxKeys *int `mapstructure:"max_keys"`
+
+	// Paged reads the source one subtree at a time instead of holding the
+	// whole prefix in memory. Only "kv" sources can be paged.
+	Paged *bool `mapstructure:"paged"`
+
+	// ShardDepth splits the prefix into one watch for each subtree at this
+	// depth below the source. Zero does not shard the prefix.
+	ShardDepth *int `mapstructure:"shard_depth"`
+
+	// ShardRefreshInterval is the interval at which the subtrees of a sharded
+	// prefix are listed again.
+	ShardRefreshInterval *time.Duration `mapstructure:"shard_refresh_interval"`
+
+	Source *string `mapstructure:"source"`
+
+	// SourceFile is the configuration for the "file" source type.
+	SourceFile *FileSourceConfig `mapstructure:"source_file"`
+
+	// SourceType is where keys are replicated from, either "kv" (default) for
+	// a prefix in a Consul datacenter or "file" for a directory on disk.
+	SourceType *string `mapstructure:"source_type"`
+
+	// Wait is the quiescence timers of this prefix. If nil, the global timers
+	// are used.
+	Wait *config.WaitConfig `mapstructure:"wait"`
+
+	// WriteConcurrency is the number of keys of this prefix written to the
+	// destination at once.
+	WriteConcurrency *int `mapstructure:"write_concurrency"`
+
+	// WriteRateLimit limits the rate of writes of this prefix. If enabled, it
+	// is used instead of the global rate limit.
+	WriteRateLimit *RateLimitConfig `mapstructure:"write_rate_limit"`
+
+	// shardOf is the sharded prefix that this prefix is a shard of, or nil.
+	shardOf *PrefixConfig
 }
 
 // ParsePrefixConfig parses a prefix of the format "source@dc:destination" into
@@ -70,6 +152,36 @@ func ParsePrefixConfig(s string) (*PrefixConfig, error) {
 	}, nil
 }
 
+// ParseFilePrefixConfig parses a prefix of the format "source:destination"
+// where the source is a path relative to the root of a "file" source. The
+// dependency is created once the source_file options are known.
+func ParseFilePrefixConfig(s string) (*PrefixConfig, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("missing prefix")
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+
+	source, destination := strings.TrimLeft(parts[0], "/"), ""
+	if len(parts) == 2 {
+		destination = parts[1]
+	}
+
+	if strings.Contains(source, "@") {
+		return nil, fmt.Errorf("file source cannot have a datacenter: %q", s)
+	}
+
+	if destination == "" {
+		destination = source
+	}
+
+	return &PrefixConfig{
+		Destination: config.String(destination),
+		Source:      config.String(source),
+		SourceType:  config.String(PrefixTypeFile),
+	}, nil
+}
+
 func DefaultPrefixConfig() *PrefixConfig {
 	return &PrefixConfig{}
 }
@@ -81,14 +193,48 @@ func (c *PrefixConfig) Copy() *PrefixConfig {
 
 	var o PrefixConfig
 
+	o.Command = c.Command
+
+	o.CommandTimeout = c.CommandTimeout
+
+	o.Compression = c.Compression
+
 	o.Dependency = c.Dependency
 
+	o.ShardDepth = c.ShardDepth
+
+	o.ShardRefreshInterval = c.ShardRefreshInterval
+
 	o.Source = c.Source
 
 	o.Datacenter = c.Datacenter
 
 	o.Destination = c.Destination
 
+	o.DestinationFile = c.DestinationFile.Copy()
+
+	o.DestinationType = c.DestinationType
+
+	o.Encrypt = c.Encrypt.Copy()
+
+	o.MaxBytes = c.MaxBytes
+
+	o.MaxDeletes = c.MaxDeletes
+
+	o.MaxKeys = c.MaxKeys
+
+	o.Paged = c.Paged
+
+	o.SourceFile = c.SourceFile.Copy()
+
+	o.SourceType = c.SourceType
+
+	o.Wait = c.Wait.Copy()
+
+	o.WriteConcurrency = c.WriteConcurrency
+
+	o.WriteRateLimit = c.WriteRateLimit.Copy()
+
 	return &o
 }
 
@@ -106,10 +252,30 @@ func (c *PrefixConfig) Merge(o *PrefixConfig) *PrefixConfig {
 
 	r := c.Copy()
 
+	if o.Command != nil {
+		r.Command = o.Command
+	}
+
+	if o.CommandTimeout != nil {
+		r.CommandTimeout = o.CommandTimeout
+	}
+
+	if o.Compression != nil {
+		r.Compression = o.Compression
+	}
+
 	if o.Dependency != nil {
 		r.Dependency = o.Dependency
 	}
 
+	if o.ShardDepth != nil {
+		r.ShardDepth = o.ShardDepth
+	}
+
+	if o.ShardRefreshInterval != nil {
+		r.ShardRefreshInterval = o.ShardRefreshInterval
+	}
+
 	if o.Source != nil {
 		r.Source = o.Source
 	}
@@ -122,10 +288,78 @@ func (c *PrefixConfig) Merge(o *PrefixConfig) *PrefixConfig {
 		r.Destination = o.Destination
 	}
 
+	if o.DestinationFile != nil {
+		r.DestinationFile = r.DestinationFile.Merge(o.DestinationFile)
+	}
+
+	if o.DestinationType != nil {
+		r.DestinationType = o.DestinationType
+	}
+
+	if o.Encrypt != nil {
+		r.Encrypt = r.Encrypt.Merge(o.Encrypt)
+	}
+
+	if o.MaxBytes != nil {
+		r.MaxBytes = o.MaxBytes
+	}
+
+	if o.MaxDeletes != nil {
+		r.MaxDeletes = o.MaxDeletes
+	}
+
+	if o.MaxKeys != nil {
+		r.MaxKeys = o.MaxKeys
+	}
+
+	if o.Paged != nil {
+		r.Paged = o.Paged
+	}
+
+	if o.SourceFile != nil {
+		r.SourceFile = r.SourceFile.Merge(o.SourceFile)
+	}
+
+	if o.SourceType != nil {
+		r.SourceType = o.SourceType
+	}
+
+	if o.Wait != nil {
+		r.Wait = r.Wait.Merge(o.Wait)
+	}
+
+	if o.WriteConcurrency != nil {
+		r.WriteConcurrency = o.WriteConcurrency
+	}
+
+	if o.WriteRateLimit != nil {
+		r.WriteRateLimit = r.WriteRateLimit.Merge(o.WriteRateLimit)
+	}
+
 	return r
 }
 
 func (c *PrefixConfig) Finalize() {
+	if c.Command == nil {
+		c.Command = config.String("")
+	}
+
+	if c.CommandTimeout == nil {
+		c.CommandTimeout = config.TimeDuration(DefaultCommandTimeout)
+	}
+
+	if c.Compression == nil {
+		c.Compression = config.String(CompressionNone)
+	}
+
+	if c.ShardDepth == nil || *c.ShardDepth < 0 {
+		c.ShardDepth = config.Int(0)
+	}
+
+	if c.ShardRefreshInterval == nil {
+		c.ShardRefreshInterval = config.TimeDuration(DefaultShardRefreshInterval)
+	}
+
 	if c.Source == nil {
 		c.Source = config.String("")
 	}
@@ -137,6 +371,66 @@ func (c *PrefixConfig) Finalize() {
 	if c.Destination == nil {
 		c.Destination = config.String("")
 	}
+
+	if c.DestinationType == nil {
+		if c.DestinationFile != nil {
+			c.DestinationType = config.String(PrefixTypeFile)
+		} else {
+			c.DestinationType = config.String(PrefixTypeKV)
+		}
+	}
+
+	if c.DestinationFile == nil {
+		c.DestinationFile = DefaultFileDestinationConfig()
+	}
+	c.DestinationFile.Finalize()
+
+	if c.Encrypt == nil {
+		c.Encrypt = DefaultEncryptConfig()
+	}
+	c.Encrypt.Finalize()
+
+	if c.MaxBytes == nil {
+		c.MaxBytes = config.Int(0)
+	}
+
+	if c.MaxDeletes == nil || *c.MaxDeletes < 0 {
+		c.MaxDeletes = config.Int(0)
+	}
+
+	if c.MaxKeys == nil {
+		c.MaxKeys = config.Int(0)
+	}
+
+	if c.Paged == nil {
+		c.Paged = config.Bool(false)
+	}
+
+	if c.SourceType == nil {
+		if c.SourceFile != nil {
+			c.SourceType = config.String(PrefixTypeFile)
+		} else {
+			c.SourceType = config.String(PrefixTypeKV)
+		}
+	}
+
+	if c.SourceFile == nil {
+		c.SourceFile = DefaultFileSourceConfig()
+	}
+	c.SourceFile.Finalize()
+
+	if c.Wait != nil {
+		c.Wait.Finalize()
+	}
+
+	if c.WriteConcurrency == nil || *c.WriteConcurrency < 1 {
+		c.WriteConcurrency = config.Int(1)
+	}
+
+	if c.WriteRateLimit == nil {
+		c.WriteRateLimit = DefaultRateLimitConfig()
+	}
+	c.WriteRateLimit.Finalize()
 }
 
 func (c *PrefixConfig) GoString() string {
@@ -145,15 +439,49 @@ func (c *PrefixConfig) GoString() string {
 	}
 
 	return fmt.Sprintf("&PrefixConfig{"+
+		"Command:%s, "+
+		"CommandTimeout:%s, "+
+		"Compression:%s, "+
 		"Datacenter:%s, "+
 		"Dependency:%s, "+
 		"Destination:%s, "+
-		"Source:%s"+
+		"DestinationFile:%s, "+
+		"DestinationType:%s, "+
+		"Encrypt:%s, "+
+		"MaxBytes:%s, "+
+		"MaxDeletes:%s, "+
+		"MaxKeys:%s, "+
+		"Paged:%s, "+
+		"ShardDepth:%s, "+
+		"ShardRefreshInterval:%s, "+
+		"Source:%s, "+
+		"SourceFile:%s, "+
+		"SourceType:%s, "+
+		"Wait:%s, "+
+		"WriteConcurrency:%s, "+
+		"WriteRateLimit:%s"+
 		"}",
+		config.StringGoString(c.Command),
+		config.TimeDurationGoString(c.CommandTimeout),
+		config.StringGoString(c.Compression),
 		config.StringGoString(c.Datacenter),
 		c.Dependency,
 		config.StringGoString(c.Destination),
+		c.DestinationFile.GoString(),
+		config.StringGoString(c.DestinationType),
+		c.Encrypt.GoString(),
+		config.IntGoString(c.MaxBytes),
+		config.IntGoString(c.MaxDeletes),
+		config.IntGoString(c.MaxKeys),
+		config.BoolGoString(c.Paged),
+		config.IntGoString(c.ShardDepth),
+		config.TimeDurationGoString(c.ShardRefreshInterval),
 		config.StringGoString(c.Source),
+		c.SourceFile.GoString(),
+		config.StringGoString(c.SourceType),
+		c.Wait.GoString(),
+		config.IntGoString(c.WriteConcurrency),
+		c.WriteRateLimit.GoString(),
 	)
 }
 
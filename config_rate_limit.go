@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// RateLimitConfig is the configuration for limiting the rate of operations,
+// such as writes to a destination.
+type RateLimitConfig struct {
+	// Enabled determines if the rate is limited. It is enabled automatically
+	// if a rate is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Burst is the number of operations allowed at once above the rate. It
+	// defaults to the rate.
+	Burst *int `mapstructure:"burst"`
+
+	// Rate is the sustained number of operations per second.
+	Rate *int `mapstructure:"rate"`
+}
+
+func DefaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{}
+}
+
+func (c *RateLimitConfig) Copy() *RateLimitConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o RateLimitConfig
+
+	o.Enabled = c.Enabled
+
+	o.Burst = c.Burst
+
+	o.Rate = c.Rate
+
+	return &o
+}
+
+func (c *RateLimitConfig) Merge(o *RateLimitConfig) *RateLimitConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Burst != nil {
+		r.Burst = o.Burst
+	}
+
+	if o.Rate != nil {
+		r.Rate = o.Rate
+	}
+
+	return r
+}
+
+func (c *RateLimitConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.IntPresent(c.Rate))
+	}
+
+	if c.Rate == nil {
+		c.Rate = config.Int(0)
+	}
+
+	if c.Burst == nil {
+		c.Burst = config.Int(config.IntVal(c.Rate))
+	}
+}
+
+func (c *RateLimitConfig) GoString() string {
+	if c == nil {
+		return "(*RateLimitConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&RateLimitConfig{"+
+		"Enabled:%s, "+
+		"Burst:%s, "+
+		"Rate:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.IntGoString(c.Burst),
+		config.IntGoString(c.Rate),
+	)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// ConfigSourceConfig is the configuration for reading prefix and exclude
+// blocks from a key in the Consul KV store, so the list of prefixes can be
+// managed centrally.
+type ConfigSourceConfig struct {
+	// Enabled determines if the configuration is read from Consul. It is
+	// enabled automatically if a key is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Datacenter is the datacenter to read the key from. If empty, the
+	// datacenter of the local agent is used.
+	Datacenter *string `mapstructure:"datacenter"`
+
+	// Key is the path of the key in the KV store. Its value is HCL or JSON
+	// containing only prefix and exclude blocks.
+	Key *string `mapstructure:"key"`
+}
+
+func DefaultConfigSourceConfig() *ConfigSourceConfig {
+	return &ConfigSourceConfig{}
+}
+
+func (c *ConfigSourceConfig) Copy() *ConfigSourceConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o ConfigSourceConfig
+
+	o.Enabled = c.Enabled
+
+	o.Datacenter = c.Datacenter
+
+	o.Key = c.Key
+
+	return &o
+}
+
+func (c *ConfigSourceConfig) Merge(o *ConfigSourceConfig) *ConfigSourceConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Datacenter != nil {
+		r.Datacenter = o.Datacenter
+	}
+
+	if o.Key != nil {
+		r.Key = o.Key
+	}
+
+	return r
+}
+
+func (c *ConfigSourceConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.Key))
+	}
+
+	if c.Datacenter == nil {
+		c.Datacenter = config.String("")
+	}
+
+	if c.Key == nil {
+		c.Key = config.String("")
+	}
+}
+
+func (c *ConfigSourceConfig) GoString() string {
+	if c == nil {
+		return "(*ConfigSourceConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ConfigSourceConfig{"+
+		"Enabled:%s, "+
+		"Datacenter:%s, "+
+		"Key:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.Datacenter),
+		config.StringGoString(c.Key),
+	)
+}
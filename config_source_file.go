@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultFileSourcePollInterval is the default interval at which a source
+	// directory is scanned for changes.
+	DefaultFileSourcePollInterval = 5 * time.Second
+)
+
+// FileSourceConfig is the configuration for replicating a prefix from a
+// directory tree on the local disk instead of a Consul datacenter.
+type FileSourceConfig struct {
+	// Path is the root directory on disk. The path of each file relative to
+	// this directory is used as its key.
+	Path *string `mapstructure:"path"`
+
+	// PollInterval is the interval at which the directory is scanned for
+	// changes.
+	PollInterval *time.Duration `mapstructure:"poll_interval"`
+}
+
+func DefaultFileSourceConfig() *FileSourceConfig {
+	return &FileSourceConfig{}
+}
+
+func (c *FileSourceConfig) Copy() *FileSourceConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o FileSourceConfig
+
+	o.Path = c.Path
+
+	o.PollInterval = c.PollInterval
+
+	return &o
+}
+
+func (c *FileSourceConfig) Merge(o *FileSourceConfig) *FileSourceConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.PollInterval != nil {
+		r.PollInterval = o.PollInterval
+	}
+
+	return r
+}
+
+func (c *FileSourceConfig) Finalize() {
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.PollInterval == nil {
+		c.PollInterval = config.TimeDuration(DefaultFileSourcePollInterval)
+	}
+}
+
+func (c *FileSourceConfig) GoString() string {
+	if c == nil {
+		return "(*FileSourceConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&FileSourceConfig{"+
+		"Path:%s, "+
+		"PollInterval:%s"+
+		"}",
+		config.StringGoString(c.Path),
+		config.TimeDurationGoString(c.PollInterval),
+	)
+}
@@ -118,6 +118,44 @@ func TestParse(t *testing.T) {
 		// End Depreations
 		// TODO remove in 0.5.0
 
+		{
+			"anti_entropy_interval",
+			`anti_entropy_interval = "1h"`,
+			&Config{
+				AntiEntropyInterval: config.TimeDuration(1 * time.Hour),
+			},
+			false,
+		},
+		{
+			"audit",
+			`audit {
+				path      = "/var/log/consul-replicate/audit.log"
+				max_bytes = 1024
+				max_files = 3
+			}`,
+			&Config{
+				Audit: &AuditConfig{
+					MaxBytes: config.Int(1024),
+					MaxFiles: config.Int(3),
+					Path:     config.String("/var/log/consul-replicate/audit.log"),
+				},
+			},
+			false,
+		},
+		{
+			"config_source",
+			`config_source {
+				key        = "service/consul-replicate/config"
+				datacenter = "dc1"
+			}`,
+			&Config{
+				ConfigSource: &ConfigSourceConfig{
+					Datacenter: config.String("dc1"),
+					Key:        config.String("service/consul-replicate/config"),
+				},
+			},
+			false,
+		},
 		{
 			"consul_address",
 			`consul {
@@ -382,6 +420,20 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"destination_index",
+			`destination_index {
+				enabled = false
+				refresh = true
+			}`,
+			&Config{
+				DestinationIndex: &DestinationIndexConfig{
+					Enabled: config.Bool(false),
+					Refresh: config.Bool(true),
+				},
+			},
+			false,
+		},
 		{
 			"exclude",
 			`exclude {
@@ -429,6 +481,20 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"history",
+			`history {
+				path     = "/var/lib/consul-replicate"
+				versions = 5
+			}`,
+			&Config{
+				History: &HistoryConfig{
+					Path:     config.String("/var/lib/consul-replicate"),
+					Versions: config.Int(5),
+				},
+			},
+			false,
+		},
 		{
 			"kill_signal",
 			`kill_signal = "SIGUSR1"`,
@@ -437,6 +503,14 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"log_format",
+			`log_format = "json"`,
+			&Config{
+				LogFormat: config.String("json"),
+			},
+			false,
+		},
 		{
 			"log_level",
 			`log_level = "WARN"`,
@@ -453,6 +527,53 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"notify",
+			`notify {
+				url        = "https://hooks.example.com/replicate"
+				events     = ["pass_failed"]
+				body       = "{{ len .Events }} failures"
+				batch_max  = 10
+				batch_wait = "30s"
+				timeout    = "5s"
+
+				headers {
+					Authorization = "Bearer abcd1234"
+				}
+
+				retry {
+					attempts = 3
+					backoff  = "1s"
+				}
+			}
+
+			notify {
+				url = "https://hooks.example.com/audit"
+			}`,
+			&Config{
+				Notifies: &NotifyConfigs{
+					&NotifyConfig{
+						BatchMax:  config.Int(10),
+						BatchWait: config.TimeDuration(30 * time.Second),
+						Body:      config.String("{{ len .Events }} failures"),
+						Events:    &[]string{"pass_failed"},
+						Headers: map[string]string{
+							"Authorization": "Bearer abcd1234",
+						},
+						Retry: &config.RetryConfig{
+							Attempts: config.Int(3),
+							Backoff:  config.TimeDuration(1 * time.Second),
+						},
+						Timeout: config.TimeDuration(5 * time.Second),
+						URL:     config.String("https://hooks.example.com/replicate"),
+					},
+					&NotifyConfig{
+						URL: config.String("https://hooks.example.com/audit"),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"pid_file",
 			`pid_file = "/var/pid"`,
@@ -530,6 +651,26 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"prefix_stanza_command",
+			`prefix {
+				source = "foo/bar@dc"
+				command = "systemctl reload app"
+				command_timeout = "1m"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Command:        config.String("systemctl reload app"),
+						CommandTimeout: config.TimeDuration(1 * time.Minute),
+						Datacenter:     config.String("dc"),
+						Destination:    config.String("foo/bar"),
+						Source:         config.String("foo/bar"),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"prefix_stanza_datacenter",
 			`prefix {
@@ -547,6 +688,298 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"prefix_stanza_destination_file",
+			`prefix {
+				source = "foo/bar@dc"
+				destination = "default"
+				destination_file {
+					path  = "/etc/replicated"
+					perms = "0640"
+					user  = "app"
+					group = "app"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("default"),
+						DestinationFile: &FileDestinationConfig{
+							Path:  config.String("/etc/replicated"),
+							Perms: config.FileMode(0640),
+							User:  config.String("app"),
+							Group: config.String("app"),
+						},
+						Source: config.String("foo/bar"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_destination_type",
+			`prefix {
+				source = "foo/bar@dc"
+				destination_type = "file"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:      config.String("dc"),
+						Destination:     config.String("foo/bar"),
+						DestinationType: config.String("file"),
+						Source:          config.String("foo/bar"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_destination_type_invalid",
+			`prefix {
+				source = "foo/bar@dc"
+				destination_type = "nope"
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_source_file",
+			`prefix {
+				source = "config"
+				destination = "global"
+				source_file {
+					path = "/srv/bootstrap"
+					poll_interval = "10s"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Destination: config.String("global"),
+						Source:      config.String("config"),
+						SourceFile: &FileSourceConfig{
+							Path:         config.String("/srv/bootstrap"),
+							PollInterval: config.TimeDuration(10 * time.Second),
+						},
+						SourceType: config.String("file"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_source_file_missing_path",
+			`prefix {
+				source = "config"
+				source_type = "file"
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_source_file_datacenter",
+			`prefix {
+				source = "config"
+				datacenter = "dc"
+				source_file {
+					path = "/srv/bootstrap"
+				}
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_paged",
+			`prefix {
+				source = "foo/bar@dc"
+				paged = true
+				max_keys = 500000
+				max_bytes = 67108864
+				max_deletes = 100
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("foo/bar"),
+						MaxBytes:    config.Int(67108864),
+						MaxDeletes:  config.Int(100),
+						MaxKeys:     config.Int(500000),
+						Paged:       config.Bool(true),
+						Source:      config.String("foo/bar"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_paged_source_file",
+			`prefix {
+				source = "config"
+				paged = true
+				source_file {
+					path = "/srv/bootstrap"
+				}
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_compression",
+			`prefix {
+				source = "foo/bar@dc"
+				compression = "gzip"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Compression: config.String("gzip"),
+						Datacenter:  config.String("dc"),
+						Destination: config.String("foo/bar"),
+						Source:      config.String("foo/bar"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_compression_invalid",
+			`prefix {
+				source = "foo/bar@dc"
+				compression = "zstd"
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_encrypt",
+			`prefix {
+				source = "secrets@dc"
+				encrypt {
+					key_file = "/etc/consul-replicate/keys"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("secrets"),
+						Encrypt: &EncryptConfig{
+							KeyFile: config.String("/etc/consul-replicate/keys"),
+						},
+						Source: config.String("secrets"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_encrypt_decrypt",
+			`prefix {
+				source = "secrets@dc"
+				encrypt {
+					key_file = "/etc/consul-replicate/keys"
+					mode     = "decrypt"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("secrets"),
+						Encrypt: &EncryptConfig{
+							KeyFile: config.String("/etc/consul-replicate/keys"),
+							Mode:    config.String("decrypt"),
+						},
+						Source: config.String("secrets"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_encrypt_invalid_mode",
+			`prefix {
+				source = "secrets@dc"
+				encrypt {
+					key_file = "/etc/consul-replicate/keys"
+					mode     = "rot13"
+				}
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_sharded",
+			`prefix {
+				source = "apps@dc"
+				shard_depth = 1
+				shard_refresh_interval = "1m"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:           config.String("dc"),
+						Destination:          config.String("apps"),
+						ShardDepth:           config.Int(1),
+						ShardRefreshInterval: config.TimeDuration(1 * time.Minute),
+						Source:               config.String("apps"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_sharded_paged",
+			`prefix {
+				source = "apps@dc"
+				shard_depth = 1
+				paged = true
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_sharded_source_file",
+			`prefix {
+				source = "config"
+				shard_depth = 1
+				source_file {
+					path = "/srv/bootstrap"
+				}
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_shard_depth_negative",
+			`prefix {
+				source = "apps@dc"
+				shard_depth = -1
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_source_type_invalid",
+			`prefix {
+				source = "foo/bar@dc"
+				source_type = "nope"
+			}`,
+			nil,
+			true,
+		},
+		{
+			"prefix_stanza_invalid_key",
+			`prefix {
+				source = "foo/bar@dc"
+				not_a_valid_key = "hello"
+			}`,
+			nil,
+			true,
+		},
 		{
 			"reload_signal",
 			`reload_signal = "SIGUSR1"`,
@@ -595,6 +1028,22 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"tracing",
+			`tracing {
+				endpoint     = "localhost:4318"
+				insecure     = true
+				service_name = "replicate-east"
+			}`,
+			&Config{
+				Tracing: &TracingConfig{
+					Endpoint:    config.String("localhost:4318"),
+					Insecure:    config.Bool(true),
+					ServiceName: config.String("replicate-east"),
+				},
+			},
+			false,
+		},
 		{
 			"wait",
 			`wait {
@@ -622,6 +1071,105 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"watch_config",
+			`watch_config = true`,
+			&Config{
+				WatchConfig: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"write_concurrency",
+			`write_concurrency = 16`,
+			&Config{
+				WriteConcurrency: config.Int(16),
+			},
+			false,
+		},
+		{
+			"write_rate_limit",
+			`write_rate_limit {
+				rate  = 500
+				burst = 50
+			}`,
+			&Config{
+				WriteRateLimit: &RateLimitConfig{
+					Burst: config.Int(50),
+					Rate:  config.Int(500),
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_write_limits",
+			`prefix {
+				source = "foo/bar@dc"
+				write_concurrency = 4
+				write_rate_limit {
+					rate = 100
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:       config.String("dc"),
+						Destination:      config.String("foo/bar"),
+						Source:           config.String("foo/bar"),
+						WriteConcurrency: config.Int(4),
+						WriteRateLimit: &RateLimitConfig{
+							Rate: config.Int(100),
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_wait",
+			`prefix {
+				source = "foo/bar@dc"
+				wait {
+					min = "5s"
+					max = "30s"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("foo/bar"),
+						Source:      config.String("foo/bar"),
+						Wait: &config.WaitConfig{
+							Min: config.TimeDuration(5 * time.Second),
+							Max: config.TimeDuration(30 * time.Second),
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_stanza_wait_as_string",
+			`prefix {
+				source = "foo/bar@dc"
+				wait   = "5s:30s"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Datacenter:  config.String("dc"),
+						Destination: config.String("foo/bar"),
+						Source:      config.String("foo/bar"),
+						Wait: &config.WaitConfig{
+							Min: config.TimeDuration(5 * time.Second),
+							Max: config.TimeDuration(30 * time.Second),
+						},
+					},
+				},
+			},
+			false,
+		},
 
 		// General validation
 		{
@@ -697,6 +1245,56 @@ func TestConfig_Merge(t *testing.T) {
 			&Config{},
 			&Config{},
 		},
+		{
+			"anti_entropy_interval",
+			&Config{
+				AntiEntropyInterval: config.TimeDuration(1 * time.Hour),
+			},
+			&Config{
+				AntiEntropyInterval: config.TimeDuration(2 * time.Hour),
+			},
+			&Config{
+				AntiEntropyInterval: config.TimeDuration(2 * time.Hour),
+			},
+		},
+		{
+			"audit",
+			&Config{
+				Audit: &AuditConfig{
+					Path: config.String("/var/log/a.log"),
+				},
+			},
+			&Config{
+				Audit: &AuditConfig{
+					MaxFiles: config.Int(3),
+				},
+			},
+			&Config{
+				Audit: &AuditConfig{
+					MaxFiles: config.Int(3),
+					Path:     config.String("/var/log/a.log"),
+				},
+			},
+		},
+		{
+			"config_source",
+			&Config{
+				ConfigSource: &ConfigSourceConfig{
+					Key: config.String("foo"),
+				},
+			},
+			&Config{
+				ConfigSource: &ConfigSourceConfig{
+					Datacenter: config.String("dc1"),
+				},
+			},
+			&Config{
+				ConfigSource: &ConfigSourceConfig{
+					Datacenter: config.String("dc1"),
+					Key:        config.String("foo"),
+				},
+			},
+		},
 		{
 			"consul",
 			&Config{
@@ -715,6 +1313,25 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"destination_index",
+			&Config{
+				DestinationIndex: &DestinationIndexConfig{
+					Enabled: config.Bool(false),
+				},
+			},
+			&Config{
+				DestinationIndex: &DestinationIndexConfig{
+					Refresh: config.Bool(true),
+				},
+			},
+			&Config{
+				DestinationIndex: &DestinationIndexConfig{
+					Enabled: config.Bool(false),
+					Refresh: config.Bool(true),
+				},
+			},
+		},
 		{
 			"exclude",
 			&Config{
@@ -742,6 +1359,25 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"history",
+			&Config{
+				History: &HistoryConfig{
+					Versions: config.Int(5),
+				},
+			},
+			&Config{
+				History: &HistoryConfig{
+					Path: config.String("/var/lib/consul-replicate"),
+				},
+			},
+			&Config{
+				History: &HistoryConfig{
+					Path:     config.String("/var/lib/consul-replicate"),
+					Versions: config.Int(5),
+				},
+			},
+		},
 		{
 			"kill_signal",
 			&Config{
@@ -754,6 +1390,18 @@ func TestConfig_Merge(t *testing.T) {
 				KillSignal: config.Signal(syscall.SIGUSR2),
 			},
 		},
+		{
+			"log_format",
+			&Config{
+				LogFormat: config.String("text"),
+			},
+			&Config{
+				LogFormat: config.String("json"),
+			},
+			&Config{
+				LogFormat: config.String("json"),
+			},
+		},
 		{
 			"log_level",
 			&Config{
@@ -778,6 +1426,33 @@ func TestConfig_Merge(t *testing.T) {
 				MaxStale: config.TimeDuration(20 * time.Second),
 			},
 		},
+		{
+			"notify",
+			&Config{
+				Notifies: &NotifyConfigs{
+					&NotifyConfig{
+						URL: config.String("https://a.example.com"),
+					},
+				},
+			},
+			&Config{
+				Notifies: &NotifyConfigs{
+					&NotifyConfig{
+						URL: config.String("https://b.example.com"),
+					},
+				},
+			},
+			&Config{
+				Notifies: &NotifyConfigs{
+					&NotifyConfig{
+						URL: config.String("https://a.example.com"),
+					},
+					&NotifyConfig{
+						URL: config.String("https://b.example.com"),
+					},
+				},
+			},
+		},
 		{
 			"pid_file",
 			&Config{
@@ -859,6 +1534,25 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"tracing",
+			&Config{
+				Tracing: &TracingConfig{
+					Endpoint: config.String("localhost:4318"),
+				},
+			},
+			&Config{
+				Tracing: &TracingConfig{
+					Insecure: config.Bool(true),
+				},
+			},
+			&Config{
+				Tracing: &TracingConfig{
+					Endpoint: config.String("localhost:4318"),
+					Insecure: config.Bool(true),
+				},
+			},
+		},
 		{
 			"wait",
 			&Config{
@@ -880,6 +1574,49 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"watch_config",
+			&Config{
+				WatchConfig: config.Bool(false),
+			},
+			&Config{
+				WatchConfig: config.Bool(true),
+			},
+			&Config{
+				WatchConfig: config.Bool(true),
+			},
+		},
+		{
+			"write_concurrency",
+			&Config{
+				WriteConcurrency: config.Int(4),
+			},
+			&Config{
+				WriteConcurrency: config.Int(16),
+			},
+			&Config{
+				WriteConcurrency: config.Int(16),
+			},
+		},
+		{
+			"write_rate_limit",
+			&Config{
+				WriteRateLimit: &RateLimitConfig{
+					Rate: config.Int(500),
+				},
+			},
+			&Config{
+				WriteRateLimit: &RateLimitConfig{
+					Burst: config.Int(50),
+				},
+			},
+			&Config{
+				WriteRateLimit: &RateLimitConfig{
+					Burst: config.Int(50),
+					Rate:  config.Int(500),
+				},
+			},
+		},
 	}
 
 	for i, tc := range cases {
@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultTracingServiceName is the default service name reported with
+	// traces.
+	DefaultTracingServiceName = "consul-replicate"
+)
+
+// TracingConfig is the configuration for exporting OpenTelemetry traces of
+// replication passes over OTLP.
+type TracingConfig struct {
+	// Enabled determines if traces are exported. It is enabled automatically
+	// if an endpoint is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Endpoint is the OTLP/HTTP endpoint to export traces to, either as
+	// "host:port" or a full URL.
+	Endpoint *string `mapstructure:"endpoint"`
+
+	// Insecure disables TLS when connecting to the endpoint.
+	Insecure *bool `mapstructure:"insecure"`
+
+	// ServiceName is the name of the service reported with traces.
+	ServiceName *string `mapstructure:"service_name"`
+}
+
+func DefaultTracingConfig() *TracingConfig {
+	return &TracingConfig{}
+}
+
+func (c *TracingConfig) Copy() *TracingConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o TracingConfig
+
+	o.Enabled = c.Enabled
+
+	o.Endpoint = c.Endpoint
+
+	o.Insecure = c.Insecure
+
+	o.ServiceName = c.ServiceName
+
+	return &o
+}
+
+func (c *TracingConfig) Merge(o *TracingConfig) *TracingConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Endpoint != nil {
+		r.Endpoint = o.Endpoint
+	}
+
+	if o.Insecure != nil {
+		r.Insecure = o.Insecure
+	}
+
+	if o.ServiceName != nil {
+		r.ServiceName = o.ServiceName
+	}
+
+	return r
+}
+
+func (c *TracingConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.Endpoint))
+	}
+
+	if c.Endpoint == nil {
+		c.Endpoint = config.String("")
+	}
+
+	if c.Insecure == nil {
+		c.Insecure = config.Bool(false)
+	}
+
+	if c.ServiceName == nil {
+		c.ServiceName = config.String(DefaultTracingServiceName)
+	}
+}
+
+func (c *TracingConfig) GoString() string {
+	if c == nil {
+		return "(*TracingConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&TracingConfig{"+
+		"Enabled:%s, "+
+		"Endpoint:%s, "+
+		"Insecure:%s, "+
+		"ServiceName:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.Endpoint),
+		config.BoolGoString(c.Insecure),
+		config.StringGoString(c.ServiceName),
+	)
+}
@@ -0,0 +1,326 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/renderer"
+	"github.com/hashicorp/consul/api"
+)
+
+// destination is a target that replicated keys are written to.
+type destination interface {
+	// Get returns the value at the given key, or nil if it does not exist.
+	Get(key string) ([]byte, error)
+
+	// Put writes the value and flags at the given key.
+	Put(key string, flags uint64, value []byte) error
+
+	// Delete removes the given key.
+	Delete(key string) error
+
+	// Keys lists all keys that begin with the given prefix.
+	Keys(prefix string) ([]string, error)
+
+	// List returns the values of all keys that begin with the given prefix.
+	List(prefix string) (map[string]*destinationPair, error)
+}
+
+// destinationPair is the current value of a key in a destination.
+type destinationPair struct {
+	Value []byte
+
+	// Flags is nil if the destination does not store flags.
+	Flags *uint64
+}
+
+// unchanged returns true if the pair's value, and flags if stored, match the
+// given pair.
+func (p *destinationPair) unchanged(pair *dep.KeyPair) bool {
+	if p == nil || string(p.Value) != pair.Value {
+		return false
+	}
+	return p.Flags == nil || *p.Flags == pair.Flags
+}
+
+// newDestination creates the destination that the given prefix replicates
+// into.
+func newDestination(prefix *PrefixConfig, clients *dep.ClientSet) (destination, error) {
+	switch config.StringVal(prefix.DestinationType) {
+	case PrefixTypeFile:
+		return newFileDestination(prefix.DestinationFile)
+	default:
+		return &kvDestination{kv: clients.Consul().KV()}, nil
+	}
+}
+
+// kvDestination writes replicated keys into the Consul KV store.
+type kvDestination struct {
+	kv *api.KV
+}
+
+func (d *kvDestination) Get(key string) ([]byte, error) {
+	pair, _, err := d.kv.Get(key, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
+
+func (d *kvDestination) Put(key string, flags uint64, value []byte) error {
+	_, err := d.kv.Put(&api.KVPair{
+		Key:   key,
+		Flags: flags,
+		Value: value,
+	}, nil)
+	return err
+}
+
+func (d *kvDestination) Delete(key string) error {
+	_, err := d.kv.Delete(key, nil)
+	return err
+}
+
+func (d *kvDestination) Keys(prefix string) ([]string, error) {
+	keys, _, err := d.kv.Keys(prefix, "", nil)
+	return keys, err
+}
+
+func (d *kvDestination) List(prefix string) (map[string]*destinationPair, error) {
+	pairs, _, err := d.kv.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*destinationPair, len(pairs))
+	for _, pair := range pairs {
+		flags := pair.Flags
+		result[pair.Key] = &destinationPair{Value: pair.Value, Flags: &flags}
+	}
+	return result, nil
+}
+
+// fileDestination writes replicated keys as files in a directory tree on
+// disk. Each key is written atomically to the file at its path relative to
+// the root directory. Keys ending in a slash are created as directories, which
+// are listed as keys while they are empty, and directories left empty by
+// deletes are removed. Flags cannot be represented
+// on disk and are ignored, and a key cannot be both a file and the parent of
+// other keys.
+type fileDestination struct {
+	root        string
+	perms       os.FileMode
+	user, group string
+}
+
+// newFileDestination creates a new file destination from the given config.
+func newFileDestination(c *FileDestinationConfig) (*fileDestination, error) {
+	root := config.StringVal(c.Path)
+	if root == "" {
+		return nil, fmt.Errorf("missing destination_file path")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileDestination{
+		root:  root,
+		perms: config.FileModeVal(c.Perms),
+		user:  config.StringVal(c.User),
+		group: config.StringVal(c.Group),
+	}, nil
+}
+
+func (d *fileDestination) Get(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(key, "/") {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []byte{}, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (d *fileDestination) Put(key string, flags uint64, value []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(key, "/") {
+		err = os.MkdirAll(path, 0755)
+	} else {
+		_, err = renderer.Render(&renderer.RenderInput{
+			Contents:       value,
+			CreateDestDirs: true,
+			Path:           path,
+			Perms:          d.perms,
+			User:           d.user,
+			Group:          d.group,
+		})
+	}
+	if err != nil {
+		if cerr := d.conflict(key, path); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+func (d *fileDestination) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		// A directory key is kept as long as there are keys under it
+		if strings.HasSuffix(key, "/") {
+			if entries, rerr := os.ReadDir(path); rerr == nil && len(entries) > 0 {
+				return nil
+			}
+		}
+		return err
+	}
+
+	// Remove the directories left empty, stopping at the first that is not
+	for dir := filepath.Dir(path); dir != d.root && strings.HasPrefix(dir, d.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// conflict returns an error if the key cannot be written because it is a
+// directory of other keys, or one of its parents is a file.
+func (d *fileDestination) conflict(key, path string) error {
+	if !strings.HasSuffix(key, "/") {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return fmt.Errorf("key %q conflicts with the keys under %q", key, key+"/")
+		}
+		path = filepath.Dir(path)
+	}
+
+	for dir := path; dir != d.root && strings.HasPrefix(dir, d.root); dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			rel, err := filepath.Rel(d.root, dir)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("key %q conflicts with key %q, which is a file",
+				key, filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+func (d *fileDestination) Keys(prefix string) ([]string, error) {
+	// Only walk the deepest directory that contains the prefix
+	start := d.root
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		var err error
+		start, err = d.path(prefix[:i+1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	err := filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		// Directories are only keys of their own when they are empty, such as
+		// those created for keys ending in a slash
+		suffix := ""
+		if info.IsDir() {
+			if path == d.root {
+				return nil
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return nil
+			}
+			suffix = "/"
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel) + suffix
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (d *fileDestination) List(prefix string) (map[string]*destinationPair, error) {
+	keys, err := d.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*destinationPair, len(keys))
+	for _, key := range keys {
+		value, err := d.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = &destinationPair{Value: value}
+	}
+	return result, nil
+}
+
+// path returns the path on disk for the given key, ensuring the result does
+// not escape the root directory.
+func (d *fileDestination) path(key string) (string, error) {
+	path := filepath.Join(d.root, filepath.FromSlash(key))
+	if path != d.root && !strings.HasPrefix(path, d.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q is outside of %q", key, d.root)
+	}
+	return path, nil
+}
@@ -0,0 +1,439 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul/api"
+)
+
+// destinationIndexRetry is the time to wait before retrying a failed refresh
+// of a destination index.
+var destinationIndexRetry = 5 * time.Second
+
+// destinationIndex is the set of keys in a prefix's destination. It is seeded
+// by listing the destination once, and then kept up to date from the runner's
+// own writes and deletes. The keys to delete on each pass are the keys of the
+// last pass's source view that are missing from the current one, along with
+// the listed keys that no source view has had, so a pass never has to look at
+// every key in the destination. Keys written to the destination by anything
+// else are not noticed, unless the index is refreshed.
+type destinationIndex struct {
+	sync.Mutex
+
+	// id identifies the destination the index was seeded from.
+	id string
+
+	// prefix is the destination prefix of the indexed keys.
+	prefix string
+
+	// dirs indicates that keys ending in a slash are indexed. File
+	// destinations create them as directories, which are not listed.
+	dirs bool
+
+	keys   map[string]struct{}
+	seeded bool
+
+	// last are the destination keys of the source view of the last pass that
+	// finished deleting, and unknown are the listed keys that were in none of
+	// the source views since they were listed.
+	last    map[string]struct{}
+	unknown map[string]struct{}
+
+	// active is the number of passes writing to the destination, and passes
+	// counts every pass started, so a refresh can tell the runner's own
+	// writes from anyone else's.
+	active int
+	passes uint64
+	idle   *sync.Cond
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	stopped  bool
+}
+
+// newDestinationIndex returns an empty index of the prefix's destination.
+func newDestinationIndex(prefix *PrefixConfig) *destinationIndex {
+	i := &destinationIndex{
+		id:      destinationIndexID(prefix),
+		prefix:  config.StringVal(prefix.Destination),
+		dirs:    config.StringVal(prefix.DestinationType) != PrefixTypeFile,
+		keys:    make(map[string]struct{}),
+		unknown: make(map[string]struct{}),
+		stopCh:  make(chan struct{}),
+	}
+	i.idle = sync.NewCond(&i.Mutex)
+	return i
+}
+
+// destinationIndexID returns the identity of the prefix's destination, which
+// changes if the prefix is reloaded with a different destination.
+func destinationIndexID(prefix *PrefixConfig) string {
+	return fmt.Sprintf("%s:%s:%s", config.StringVal(prefix.DestinationType),
+		config.StringVal(prefix.Destination), prefix.DestinationFile.GoString())
+}
+
+// seed lists the destination to fill the index, unless it is already seeded.
+func (i *destinationIndex) seed(ctx context.Context, dest destination) error {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.seeded {
+		return nil
+	}
+
+	_, span := startSpan(ctx, "destination.keys")
+	keys, err := dest.Keys(i.prefix)
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to list keys: %s", err)
+	}
+
+	i.keys = make(map[string]struct{}, len(keys))
+	i.unknown = make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		i.keys[key] = struct{}{}
+		i.unknown[key] = struct{}{}
+	}
+	i.seeded = true
+	return nil
+}
+
+// add records that the given keys were written.
+func (i *destinationIndex) add(keys ...string) {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, key := range keys {
+		if !i.dirs && strings.HasSuffix(key, "/") {
+			continue
+		}
+		i.keys[key] = struct{}{}
+	}
+}
+
+// remove records that the given keys were deleted.
+func (i *destinationIndex) remove(keys ...string) {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, key := range keys {
+		delete(i.keys, key)
+		delete(i.last, key)
+		delete(i.unknown, key)
+	}
+}
+
+// replace sets the indexed keys to the given list. Listed keys that were not
+// indexed are unknown until a source view has them.
+func (i *destinationIndex) replace(keys []string) {
+	i.Lock()
+	defer i.Unlock()
+
+	indexed, unknown := i.keys, i.unknown
+	i.keys = make(map[string]struct{}, len(keys))
+	i.unknown = make(map[string]struct{})
+	for _, key := range keys {
+		i.keys[key] = struct{}{}
+		_, ok := indexed[key]
+		_, ok2 := unknown[key]
+		if !ok || ok2 {
+			i.unknown[key] = struct{}{}
+		}
+	}
+	i.seeded = true
+}
+
+// replacePrefix sets the indexed keys that begin with prefix to the given
+// list.
+func (i *destinationIndex) replacePrefix(prefix string, keys []string) {
+	i.Lock()
+	defer i.Unlock()
+
+	indexed := make(map[string]struct{})
+	for key := range i.keys {
+		if strings.HasPrefix(key, prefix) {
+			indexed[key] = struct{}{}
+			delete(i.keys, key)
+		}
+	}
+	listed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		listed[key] = struct{}{}
+		i.keys[key] = struct{}{}
+		if _, ok := indexed[key]; !ok {
+			i.unknown[key] = struct{}{}
+		}
+	}
+	for key := range i.unknown {
+		if _, ok := listed[key]; !ok && strings.HasPrefix(key, prefix) {
+			delete(i.unknown, key)
+		}
+	}
+}
+
+// deletes returns the sorted keys to delete for the given source view, which
+// are the keys of the last view and the unknown keys that are not in
+// usedKeys.
+func (i *destinationIndex) deletes(usedKeys map[string]struct{}) []string {
+	i.Lock()
+	defer i.Unlock()
+
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, set := range []map[string]struct{}{i.last, i.unknown} {
+		for key := range set {
+			if _, ok := usedKeys[key]; ok {
+				continue
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// commit records usedKeys as the source view of the last pass, once its
+// deletes are done. Unknown keys that are still not in the view, such as
+// excluded keys, stay unknown, while the keys under the owned destination
+// prefixes of the shards are left to the shards' own indexes.
+func (i *destinationIndex) commit(usedKeys map[string]struct{}, owned []string) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.last = make(map[string]struct{}, len(usedKeys))
+	for key := range usedKeys {
+		i.last[key] = struct{}{}
+		delete(i.unknown, key)
+	}
+	if len(owned) > 0 {
+		for key := range i.keys {
+			if ownedBy(key, owned) {
+				delete(i.keys, key)
+				delete(i.unknown, key)
+			}
+		}
+	}
+}
+
+// adopt takes over the keys of the index of a removed shard, which are unknown
+// until a source view has them. If the shard was never indexed, its keys are
+// not known, so the index is listed again on its next pass.
+func (i *destinationIndex) adopt(shard *destinationIndex) {
+	var keys []string
+	if shard != nil {
+		shard.Lock()
+		if shard.seeded {
+			keys = make([]string, 0, len(shard.keys))
+			for key := range shard.keys {
+				keys = append(keys, key)
+			}
+		}
+		shard.Unlock()
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	if keys == nil {
+		i.seeded = false
+		return
+	}
+	for _, key := range keys {
+		i.keys[key] = struct{}{}
+		i.unknown[key] = struct{}{}
+	}
+}
+
+// beginPass records that a pass is writing to the destination, until
+// endPass is called.
+func (i *destinationIndex) beginPass() {
+	i.Lock()
+	defer i.Unlock()
+
+	i.active++
+	i.passes++
+}
+
+// endPass records that a pass is done writing to the destination.
+func (i *destinationIndex) endPass() {
+	i.Lock()
+	defer i.Unlock()
+
+	i.active--
+	if i.active == 0 {
+		i.idle.Broadcast()
+	}
+}
+
+// waitIdle waits until no pass is writing to the destination, or the index is
+// stopped, and returns the number of passes started so far. It must be
+// called with the lock held.
+func (i *destinationIndex) waitIdle() uint64 {
+	for i.active > 0 && !i.stopped {
+		i.idle.Wait()
+	}
+	return i.passes
+}
+
+// refresh replaces the indexed keys with the keys in the Consul KV
+// destination each time they change, using a blocking query, until the index
+// is stopped. Changes made while the runner's own passes were writing are
+// taken to be the runner's, so the destination is not listed again for them,
+// and changes made by anything else at the same time are only noticed with
+// the next change.
+func (i *destinationIndex) refresh(kv *api.KV) {
+	var waitIndex uint64
+	first := true
+	for {
+		i.Lock()
+		passes := i.waitIdle()
+		stopped := i.stopped
+		i.Unlock()
+		if stopped {
+			return
+		}
+
+		// Only wait for a change, without listing every key. The first query
+		// returns at once, and the index was just seeded.
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-i.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		_, meta, err := kv.Keys(i.prefix, "/", (&api.QueryOptions{
+			WaitIndex: waitIndex,
+		}).WithContext(ctx))
+		if err == nil && !first && meta.LastIndex != waitIndex {
+			i.Lock()
+			own := i.waitIdle() != passes
+			i.Unlock()
+			if own {
+				// Catch up with the index of the runner's writes
+				_, meta, err = kv.Keys(i.prefix, "/", (&api.QueryOptions{}).WithContext(ctx))
+			} else {
+				var keys []string
+				keys, meta, err = kv.Keys(i.prefix, "", (&api.QueryOptions{}).WithContext(ctx))
+				if err == nil {
+					i.Lock()
+					own = i.waitIdle() != passes
+					i.Unlock()
+					if !own {
+						i.replace(keys)
+					}
+				}
+			}
+		}
+		cancel()
+
+		if err != nil {
+			select {
+			case <-i.stopCh:
+				return
+			default:
+			}
+			log.Printf("[WARN] (runner) failed to refresh index of %q: %s", i.prefix, err)
+			select {
+			case <-i.stopCh:
+				return
+			case <-time.After(destinationIndexRetry):
+			}
+			continue
+		}
+
+		// Reset the index if it went backwards, such as after a snapshot restore
+		first = false
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+	}
+}
+
+// stop stops refreshing the index.
+func (i *destinationIndex) stop() {
+	i.stopOnce.Do(func() { close(i.stopCh) })
+
+	i.Lock()
+	defer i.Unlock()
+	i.stopped = true
+	i.idle.Broadcast()
+}
+
+// destinationIndex returns the seeded index of the prefix's destination, or
+// nil if the index is disabled. The index is kept across passes, and replaced
+// if the prefix's destination changes on reload.
+func (r *Runner) destinationIndex(ctx context.Context, prefix *PrefixConfig, dest destination) (*destinationIndex, error) {
+	c := r.config.DestinationIndex
+	if !config.BoolVal(c.Enabled) {
+		return nil, nil
+	}
+
+	r.indexesLock.Lock()
+	id := prefix.Dependency.String()
+	index, ok := r.indexes[id]
+	if !ok || index.id != destinationIndexID(prefix) {
+		if ok {
+			index.stop()
+		}
+		index = newDestinationIndex(prefix)
+		r.indexes[id] = index
+
+		if kvDest, ok := dest.(*kvDestination); ok && config.BoolVal(c.Refresh) {
+			go index.refresh(kvDest.kv)
+		}
+	}
+	r.indexesLock.Unlock()
+
+	if err := index.seed(ctx, dest); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// removeDestinationIndex stops and forgets the index of the prefix. The keys
+// of a shard's index are handed to the index of its sharded prefix, which
+// deletes them if the shard's subtree is gone from the source.
+func (r *Runner) removeDestinationIndex(prefix *PrefixConfig) {
+	r.indexesLock.Lock()
+	defer r.indexesLock.Unlock()
+
+	id := prefix.Dependency.String()
+	index, ok := r.indexes[id]
+	if ok {
+		index.stop()
+		delete(r.indexes, id)
+	}
+	if prefix.shardOf != nil {
+		if parent, ok := r.indexes[prefix.shardOf.Dependency.String()]; ok {
+			parent.adopt(index)
+		}
+	}
+}
+
+// stopDestinationIndexes stops refreshing every index.
+func (r *Runner) stopDestinationIndexes() {
+	r.indexesLock.Lock()
+	defer r.indexesLock.Unlock()
+
+	for _, index := range r.indexes {
+		index.stop()
+	}
+}
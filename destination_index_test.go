@@ -0,0 +1,266 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDestinationIndex(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/a", "default/b"} {
+		if err := dest.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := &PrefixConfig{
+		Destination:     config.String("default"),
+		DestinationType: config.String(PrefixTypeFile),
+		Source:          config.String("global"),
+	}
+	index := newDestinationIndex(prefix)
+	if err := index.seed(context.Background(), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys listed after seeding are not noticed
+	if err := dest.Put("default/external", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.seed(context.Background(), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	index.add("default/c", "default/dir/")
+	index.remove("default/a")
+
+	// Before the first pass, only the listed keys are deleted
+	exp := []string{"default/b"}
+	if act := index.deletes(map[string]struct{}{}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	// Keys of the last view are deleted once they leave the view
+	index.commit(map[string]struct{}{"default/c": {}}, nil)
+	exp = []string{"default/b", "default/c"}
+	if act := index.deletes(map[string]struct{}{}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	exp = []string{"default/c"}
+	if act := index.deletes(map[string]struct{}{"default/b": {}}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	// Listed keys that were not indexed are unknown, and unknown keys that
+	// are no longer listed are forgotten
+	index.replace([]string{"default/c", "default/x"})
+	exp = []string{"default/x"}
+	if act := index.deletes(map[string]struct{}{"default/c": {}}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+}
+
+func TestDestinationIndex_Shards(t *testing.T) {
+	prefix := &PrefixConfig{
+		Destination:     config.String("default/"),
+		DestinationType: config.String(PrefixTypeKV),
+		Source:          config.String("apps/"),
+	}
+	index := newDestinationIndex(prefix)
+	index.replace([]string{"default/a", "default/app1/x", "default/app2/y"})
+
+	// The keys of the shards are left to the shards' indexes
+	index.commit(map[string]struct{}{"default/a": {}}, []string{"default/app1/", "default/app2/"})
+	if act := index.deletes(map[string]struct{}{"default/a": {}}); len(act) != 0 {
+		t.Errorf("expected no deletes, got %#v", act)
+	}
+
+	// The keys of a removed shard are deleted by the sharded prefix
+	shard := newDestinationIndex(prefix)
+	shard.replace([]string{"default/app2/y", "default/app2/z"})
+	index.adopt(shard)
+	exp := []string{"default/app2/y", "default/app2/z"}
+	if act := index.deletes(map[string]struct{}{"default/a": {}}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	// A shard that was never indexed lists the destination again
+	index.adopt(newDestinationIndex(prefix))
+	if index.seeded {
+		t.Errorf("expected the index to be listed again")
+	}
+}
+
+func TestPruneDestination_Index(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/keep", "default/stale", "default/unindexed"} {
+		if err := dest.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := &PrefixConfig{
+		Destination:     config.String("default"),
+		DestinationType: config.String(PrefixTypeFile),
+		Source:          config.String("global"),
+	}
+	index := newDestinationIndex(prefix)
+	index.replace([]string{"default/keep", "default/stale"})
+
+	usedKeys := map[string]struct{}{"default/keep": {}}
+	deletes, err := pruneDestination(context.Background(), prefix,
+		DefaultExcludeConfigs(), dest, index, usedKeys, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"default/stale"}
+	if !reflect.DeepEqual(exp, deletes) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, deletes)
+	}
+	if act := index.deletes(usedKeys); len(act) != 0 {
+		t.Errorf("expected deleted keys to be removed from the index, got %#v", act)
+	}
+
+	// Only indexed keys are deleted
+	if _, err := os.Stat(filepath.Join(root, "default", "unindexed")); err != nil {
+		t.Errorf("expected unindexed key to be kept: %s", err)
+	}
+
+	// Keys that leave the source view are deleted on the next pass
+	deletes, err = pruneDestination(context.Background(), prefix,
+		DefaultExcludeConfigs(), dest, index, map[string]struct{}{}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = []string{"default/keep"}
+	if !reflect.DeepEqual(exp, deletes) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, deletes)
+	}
+}
+
+func TestDestinationIndex_Refresh(t *testing.T) {
+	// The server blocks each query until the index moves past its wait index,
+	// and counts the full listings. blocked is the last wait index blocked on.
+	var mu sync.Mutex
+	index, lists, blocked := uint64(1), 0, uint64(0)
+	keys := []string{"default/a"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		mu.Lock()
+		defer mu.Unlock()
+		for index <= wait && r.Context().Err() == nil {
+			blocked = wait
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+		}
+		if r.URL.Query().Get("separator") == "" {
+			lists++
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer srv.Close()
+	bump := func(key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, key)
+		index++
+	}
+	waitFor := func(f func() bool) bool {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			ok := f()
+			mu.Unlock()
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := &PrefixConfig{
+		Destination:     config.String("default"),
+		DestinationType: config.String(PrefixTypeKV),
+		Source:          config.String("global"),
+	}
+	idx := newDestinationIndex(prefix)
+	idx.replace([]string{"default/a"})
+	idx.commit(map[string]struct{}{"default/a": {}}, nil)
+	go idx.refresh(client.KV())
+	defer idx.stop()
+
+	// Changes made while a pass is writing are the runner's own
+	if !waitFor(func() bool { return blocked == index }) {
+		t.Fatal("expected the index to wait for changes")
+	}
+	idx.beginPass()
+	bump("default/own")
+	idx.add("default/own")
+	idx.endPass()
+	if !waitFor(func() bool { return blocked == index }) {
+		t.Fatal("expected the index to wait for changes")
+	}
+
+	// Changes made by anything else are listed
+	bump("default/external")
+	if !waitFor(func() bool { return lists > 0 }) {
+		t.Fatal("expected the destination to be listed")
+	}
+	mu.Lock()
+	if lists != 1 {
+		t.Errorf("expected 1 listing, got %d", lists)
+	}
+	mu.Unlock()
+
+	exp := []string{"default/external"}
+	waitFor(func() bool { return len(idx.deletes(map[string]struct{}{"default/a": {}, "default/own": {}})) > 0 })
+	if act := idx.deletes(map[string]struct{}{"default/a": {}, "default/own": {}}); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestFileDestination(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"foo/bar", "foo/zip/zap", "foobar", "other/baz"} {
+		if err := d.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put("foo/empty/", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "foo", "zip", "zap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "foo/zip/zap" {
+		t.Errorf("expected %q to be %q", b, "foo/zip/zap")
+	}
+
+	b, err = d.Get("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "foo/bar" {
+		t.Errorf("expected %q to be %q", b, "foo/bar")
+	}
+
+	if b, err := d.Get("foo/missing"); err != nil || b != nil {
+		t.Errorf("expected missing key to be nil, got %q (%v)", b, err)
+	}
+
+	stat, err := os.Stat(filepath.Join(root, "foo", "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("expected %q to be %q", stat.Mode().Perm(), os.FileMode(0600))
+	}
+
+	if stat, err := os.Stat(filepath.Join(root, "foo", "empty")); err != nil || !stat.IsDir() {
+		t.Errorf("expected %q to be a directory", "foo/empty/")
+	}
+
+	keys, err := d.Keys("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if e := []string{"foo/bar", "foo/empty/", "foo/zip/zap", "foobar"}; !reflect.DeepEqual(e, keys) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, keys)
+	}
+
+	pairs, err := d.List("foo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := map[string]*destinationPair{
+		"foo/bar":     {Value: []byte("foo/bar")},
+		"foo/empty/":  {Value: []byte{}},
+		"foo/zip/zap": {Value: []byte("foo/zip/zap")},
+	}; !reflect.DeepEqual(e, pairs) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, pairs)
+	}
+
+	if err := d.Delete("foo/zip/zap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("foo/missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty directory keys are listed so that they can be deleted
+	if err := d.Delete("foo/empty/"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err = d.Keys("foo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := []string{"foo/bar"}; !reflect.DeepEqual(e, keys) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, keys)
+	}
+
+	keys, err = d.Keys("missing/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no keys, got %#v", keys)
+	}
+
+	if err := d.Put("../escape", 0, nil); err == nil {
+		t.Error("expected error writing outside of root")
+	}
+
+	// A directory key is kept while there are keys under it
+	if err := d.Delete("foo/"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := d.Get("foo/"); err != nil || b == nil {
+		t.Errorf("expected %q to be kept, got %q (%v)", "foo/", b, err)
+	}
+
+	// Directories left empty by deletes are removed
+	if _, err := os.Stat(filepath.Join(root, "foo", "zip")); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed", "foo/zip")
+	}
+	if err := d.Delete("other/baz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "other")); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed", "other")
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("expected the root to be kept: %s", err)
+	}
+
+	// A key cannot be both a file and a directory of other keys
+	for key, exp := range map[string]string{
+		"foo":         `key "foo" conflicts with the keys under "foo/"`,
+		"foo/bar/baz": `key "foo/bar/baz" conflicts with key "foo/bar", which is a file`,
+		"foo/bar/":    `key "foo/bar/" conflicts with key "foo/bar", which is a file`,
+	} {
+		err := d.Put(key, 0, []byte(key))
+		if err == nil || err.Error() != exp {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, err)
+		}
+	}
+}
+
+func TestDestinationPair_Unchanged(t *testing.T) {
+	var noFlags uint64
+
+	cases := []struct {
+		name string
+		dest *destinationPair
+		pair *dep.KeyPair
+		e    bool
+	}{
+		{
+			"missing",
+			nil,
+			&dep.KeyPair{Value: "foo"},
+			false,
+		},
+		{
+			"same",
+			&destinationPair{Value: []byte("foo"), Flags: &noFlags},
+			&dep.KeyPair{Value: "foo"},
+			true,
+		},
+		{
+			"value",
+			&destinationPair{Value: []byte("bar"), Flags: &noFlags},
+			&dep.KeyPair{Value: "foo"},
+			false,
+		},
+		{
+			"flags",
+			&destinationPair{Value: []byte("foo"), Flags: &noFlags},
+			&dep.KeyPair{Value: "foo", Flags: 42},
+			false,
+		},
+		{
+			"flags_not_stored",
+			&destinationPair{Value: []byte("foo")},
+			&dep.KeyPair{Value: "foo", Flags: 42},
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			if a := tc.dest.unchanged(tc.pair); a != tc.e {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.e, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// envelopePrefix begins every encrypted value. It is followed by the ID of the
+// key, a colon, and the base64 encoded nonce and ciphertext.
+const envelopePrefix = "enc:v1:"
+
+// keyIDRegexp matches the valid key IDs of a key file.
+var keyIDRegexp = regexp.MustCompile(`\A[a-zA-Z0-9_.\-]+\z`)
+
+// keyring is the set of keys loaded from a key file, by key ID. The active key
+// encrypts new values, and every key can decrypt, so keys can be rotated by
+// adding a new key to the top of the file.
+type keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// loadKeyring reads the keys in the given key file. Each line is a key ID
+// followed by a base64 encoded AES-128, AES-192, or AES-256 key. Empty lines and
+// lines beginning with a # are ignored.
+func loadKeyring(path string) (*keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key ID and a key", path, n)
+		}
+		id := fields[0]
+		if !keyIDRegexp.MatchString(id) {
+			return nil, fmt.Errorf("%s:%d: invalid key ID %q", path, n, id)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key ID %q", path, n, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+
+		if k.active == "" {
+			k.active = id
+		}
+		k.keys[id] = aead
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.active == "" {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+	return k, nil
+}
+
+// prefixKeyring returns the keys of the prefix's key file, or nil if the
+// prefix is not encrypted. The file is read on each call, so rotated keys are
+// used on the next pass.
+func prefixKeyring(prefix *PrefixConfig) (*keyring, error) {
+	if prefix.Encrypt == nil || !config.BoolVal(prefix.Encrypt.Enabled) {
+		return nil, nil
+	}
+
+	k, err := loadKeyring(config.StringVal(prefix.Encrypt.KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %s", err)
+	}
+	return k, nil
+}
+
+// isEnvelope returns true if the value is encrypted.
+func isEnvelope(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(envelopePrefix))
+}
+
+// seal encrypts the value with the active key, and returns the envelope.
+func (k *keyring) seal(value []byte) ([]byte, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// The key ID is authenticated, so it cannot be swapped for another key
+	sealed := aead.Seal(nonce, nonce, value, []byte(k.active))
+
+	envelope := make([]byte, 0, len(envelopePrefix)+len(k.active)+1+
+		base64.StdEncoding.EncodedLen(len(sealed)))
+	envelope = append(envelope, envelopePrefix...)
+	envelope = append(envelope, k.active...)
+	envelope = append(envelope, ':')
+	envelope = base64.StdEncoding.AppendEncode(envelope, sealed)
+	return envelope, nil
+}
+
+// open decrypts the envelope with the key it names. Values that are not
+// envelopes are returned as-is, with ok set to false.
+func (k *keyring) open(value []byte) ([]byte, bool, error) {
+	if !isEnvelope(value) {
+		return value, false, nil
+	}
+
+	id, encoded, found := strings.Cut(string(value[len(envelopePrefix):]), ":")
+	if !found {
+		return nil, true, fmt.Errorf("invalid envelope")
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, true, fmt.Errorf("unknown key ID %q", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid envelope: %s", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, true, fmt.Errorf("invalid envelope: too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decrypt with key %q: %s", id, err)
+	}
+	return plain, true, nil
+}
+
+// encryptMode returns the encrypt mode of the prefix, or an empty string if
+// its values are not encrypted or decrypted.
+func encryptMode(prefix *PrefixConfig, keys *keyring) string {
+	if keys == nil || prefix.Encrypt == nil {
+		return ""
+	}
+	return config.StringVal(prefix.Encrypt.Mode)
+}
+
+// sealPairs encrypts the values of the pairs if the prefix encrypts them. The
+// pairs are copied rather than modified.
+func sealPairs(prefix *PrefixConfig, keys *keyring, pairs []*dep.KeyPair) ([]*dep.KeyPair, error) {
+	if encryptMode(prefix, keys) != EncryptModeEncrypt {
+		return pairs, nil
+	}
+
+	sealed := make([]*dep.KeyPair, 0, len(pairs))
+	for _, pair := range pairs {
+		value, err := keys.seal([]byte(pair.Value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %q: %s", pair.Path, err)
+		}
+
+		p := *pair
+		p.Value = string(value)
+		sealed = append(sealed, &p)
+	}
+	return sealed, nil
+}
+
+// openExisting returns the existing destination keys with their values
+// decrypted if the prefix encrypts them, so they can be compared with the
+// source. Keys that are not encrypted, or cannot be decrypted, are left out so
+// they are written again.
+func openExisting(prefix *PrefixConfig, keys *keyring, existing map[string]*destinationPair) map[string]*destinationPair {
+	if encryptMode(prefix, keys) != EncryptModeEncrypt {
+		return existing
+	}
+
+	opened := make(map[string]*destinationPair, len(existing))
+	for key, pair := range existing {
+		value, ok, err := keys.open(pair.Value)
+		if !ok || err != nil {
+			continue
+		}
+		opened[key] = &destinationPair{Value: value, Flags: pair.Flags}
+	}
+	return opened
+}
@@ -0,0 +1,310 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// writeKeyFile writes a key file with the given lines, and returns its path.
+func writeKeyFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testKey returns a base64 encoded AES-256 key filled with the given byte.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestLoadKeyring(t *testing.T) {
+	cases := []struct {
+		name   string
+		lines  []string
+		active string
+		err    bool
+	}{
+		{
+			"single",
+			[]string{"k1 " + testKey(1)},
+			"k1",
+			false,
+		},
+		{
+			"first_is_active",
+			[]string{"# rotated 2026-10", "", "k2 " + testKey(2), "k1 " + testKey(1)},
+			"k2",
+			false,
+		},
+		{
+			"aes_128",
+			[]string{"k1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))},
+			"k1",
+			false,
+		},
+		{
+			"empty",
+			[]string{"# no keys"},
+			"",
+			true,
+		},
+		{
+			"missing_key",
+			[]string{"k1"},
+			"",
+			true,
+		},
+		{
+			"invalid_id",
+			[]string{"k:1 " + testKey(1)},
+			"",
+			true,
+		},
+		{
+			"duplicate_id",
+			[]string{"k1 " + testKey(1), "k1 " + testKey(2)},
+			"",
+			true,
+		},
+		{
+			"invalid_base64",
+			[]string{"k1 not-base64!"},
+			"",
+			true,
+		},
+		{
+			"invalid_size",
+			[]string{"k1 " + base64.StdEncoding.EncodeToString([]byte("short"))},
+			"",
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			k, err := loadKeyring(writeKeyFile(t, tc.lines...))
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if k.active != tc.active {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.active, k.active)
+			}
+		})
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old, err := loadKeyring(writeKeyFile(t, "k1 "+testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := loadKeyring(writeKeyFile(t, "k2 "+testKey(2), "k1 "+testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("s3cr3t")
+	sealed, err := old.seal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(sealed), envelopePrefix+"k1:") {
+		t.Fatalf("expected an envelope for k1, got %q", sealed)
+	}
+	if bytes.Contains(sealed, value) {
+		t.Fatalf("expected the value to be encrypted, got %q", sealed)
+	}
+
+	// Values encrypted with a previous key can still be decrypted
+	opened, ok, err := rotated.open(sealed)
+	if err != nil || !ok {
+		t.Fatalf("expected an envelope, got %t: %s", ok, err)
+	}
+	if !bytes.Equal(value, opened) {
+		t.Errorf("\nexp: %q\nact: %q", value, opened)
+	}
+
+	// New values are encrypted with the first key
+	sealed2, err := rotated.seal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(sealed2), envelopePrefix+"k2:") {
+		t.Errorf("expected an envelope for k2, got %q", sealed2)
+	}
+	if _, _, err := old.open(sealed2); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+
+	// The key ID cannot be swapped
+	swapped := bytes.Replace(sealed2, []byte(":k2:"), []byte(":k1:"), 1)
+	if _, _, err := rotated.open(swapped); err == nil {
+		t.Error("expected an error for a swapped key ID")
+	}
+
+	// Other values are returned as-is
+	opened, ok, err = rotated.open(value)
+	if err != nil || ok {
+		t.Fatalf("expected a plain value, got %t: %s", ok, err)
+	}
+	if !bytes.Equal(value, opened) {
+		t.Errorf("\nexp: %q\nact: %q", value, opened)
+	}
+}
+
+func TestEncodeValue_Encrypt(t *testing.T) {
+	keys, err := loadKeyring(writeKeyFile(t, "k1 "+testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := &PrefixConfig{
+		Compression: config.String(CompressionGzip),
+		Encrypt:     &EncryptConfig{Mode: config.String(EncryptModeEncrypt)},
+	}
+	decrypt := &PrefixConfig{
+		Compression: config.String(CompressionGunzip),
+		Encrypt:     &EncryptConfig{Mode: config.String(EncryptModeDecrypt)},
+	}
+
+	// Values are compressed and then encrypted on the way out, and decrypted
+	// and then decompressed on the way back
+	value := []byte("s3cr3t")
+	sealed, err := encodeValue(encrypt, keys, "global/a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnvelope(sealed) {
+		t.Fatalf("expected an envelope, got %q", sealed)
+	}
+	opened, err := encodeValue(decrypt, keys, "global/a", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, opened) {
+		t.Errorf("\nexp: %q\nact: %q", value, opened)
+	}
+
+	// Encrypted values in the destination are compared decrypted
+	existing := openExisting(encrypt, keys, map[string]*destinationPair{
+		"default/sealed": {Value: sealed},
+		"default/plain":  {Value: value},
+	})
+	if _, ok := existing["default/plain"]; ok {
+		t.Error("expected the plain value to be left out")
+	}
+	compressed, err := compressValue(CompressionGzip, value, maxGunzipBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act := existing["default/sealed"]; act == nil || !bytes.Equal(compressed, act.Value) {
+		t.Errorf("\nexp: %q\nact: %#v", compressed, act)
+	}
+}
+
+func TestEncodePairs_UnknownKey(t *testing.T) {
+	old, err := loadKeyring(writeKeyFile(t, "k1 "+testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadKeyring(writeKeyFile(t, "k2 "+testKey(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := old.seal([]byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := []*dep.KeyPair{
+		{Path: "global/a", Value: "a"},
+		{Path: "global/sealed", Value: string(sealed)},
+	}
+
+	// Values encrypted with an unknown key are skipped, rather than failing
+	// the others
+	decrypt := &PrefixConfig{
+		Compression: config.String(CompressionNone),
+		Encrypt:     &EncryptConfig{Mode: config.String(EncryptModeDecrypt)},
+	}
+	encoded, failures := encodePairs(decrypt, keys, pairs)
+	if len(encoded) != 1 || encoded[0].Path != "global/a" {
+		t.Errorf("expected only global/a to be encoded, got %#v", encoded)
+	}
+	if len(failures) != 1 || failures[0].pair != pairs[1] {
+		t.Fatalf("expected global/sealed to fail, got %#v", failures)
+	}
+	if !strings.Contains(failures[0].err.Error(), "unknown key ID") {
+		t.Errorf("expected an unknown key error, got %s", failures[0].err)
+	}
+}
+
+func TestDecryptKey(t *testing.T) {
+	path := writeKeyFile(t, "k1 "+testKey(1))
+	keys, err := loadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := keys.seal([]byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := newTestKVServer(t, map[string]string{
+		"secrets/db":    string(sealed),
+		"secrets/plain": "plain",
+	})
+
+	value, err := decryptKey(clients, path, "secrets/db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "s3cr3t"; string(value) != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, string(value))
+	}
+
+	if _, err := decryptKey(clients, path, "secrets/plain", ""); err == nil {
+		t.Error("expected an error for a plain value")
+	}
+	if _, err := decryptKey(clients, path, "secrets/missing", ""); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	prefix, err := ParsePrefixConfig("global@dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix.Finalize()
+	if err := checkHistory(prefix); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypted prefixes have no history to roll back to
+	prefix.Encrypt = &EncryptConfig{KeyFile: config.String("keys")}
+	prefix.Encrypt.Finalize()
+	if err := checkHistory(prefix); err == nil {
+		t.Fatal("expected error")
+	}
+	r := &Runner{}
+	if err := r.Rollback(prefix, 1); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("expected an encrypted prefix error, got %v", err)
+	}
+}
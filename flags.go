@@ -4,6 +4,7 @@
 package main
 
 import (
+	"flag"
 	"strconv"
 	"time"
 )
@@ -57,3 +58,22 @@ func (f funcIntVar) Set(s string) error {
 }
 func (f funcIntVar) String() string   { return "" }
 func (f funcIntVar) IsBoolFlag() bool { return false }
+
+// parseInterspersed parses the given arguments, permitting positional
+// arguments to appear before or between flags. The positional arguments are
+// returned in order.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// maxHistoryValueBytes is the largest version that is stored in the KV store,
+// which is the largest value that Consul accepts.
+const maxHistoryValueBytes = 512 * 1024
+
+// historyStore returns the destination where previous versions are stored,
+// along with the key prefix for the versions of the given prefix. Each version
+// is stored as a snapshot in a key named after its index.
+func (r *Runner) historyStore(prefix *PrefixConfig) (destination, string, error) {
+	if path := config.StringVal(r.config.History.Path); path != "" {
+		d, err := newFileDestination(&FileDestinationConfig{
+			Path:  config.String(path),
+			Perms: config.FileMode(0600),
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return d, statusID(prefix) + "/", nil
+	}
+
+	d := &kvDestination{kv: r.clients.Consul().KV()}
+	return d, r.statusPath(prefix) + "/history/", nil
+}
+
+// recordHistory stores the given source data as the newest version of the
+// prefix, removing the oldest versions beyond the configured number. It is a
+// no-op if history is disabled.
+func (r *Runner) recordHistory(prefix *PrefixConfig, pairs []*dep.KeyPair, excludes *ExcludeConfigs, lastIndex uint64) error {
+	if !config.BoolVal(r.config.History.Enabled) {
+		return nil
+	}
+
+	store, keyPrefix, err := r.historyStore(prefix)
+	if err != nil {
+		return err
+	}
+
+	enc, err := json.Marshal(&Snapshot{
+		Version: SnapshotVersion,
+		Created: time.Now().UTC(),
+		Prefixes: []*SnapshotPrefix{
+			newSnapshotPrefix(prefix, pairs, excludes, lastIndex),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Consul rejects values over its size limit, so a version of a prefix that
+	// large is skipped instead of failing on every pass
+	if _, ok := store.(*kvDestination); ok && len(enc) > maxHistoryValueBytes {
+		log.Printf("[WARN] (runner) version %d of %q is %d bytes, larger than "+
+			"the %d bytes Consul allows in a value, so it is not recorded; set a "+
+			"history path to store versions on disk",
+			lastIndex, prefix.Dependency, len(enc), maxHistoryValueBytes)
+		return nil
+	}
+
+	if err := store.Put(keyPrefix+historyKey(lastIndex), 0, enc); err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] (runner) recorded version %d of %q", lastIndex, prefix.Dependency)
+
+	indexes, err := r.History(prefix)
+	if err != nil {
+		return err
+	}
+
+	max := config.IntVal(r.config.History.Versions)
+	for len(indexes) > max {
+		if err := store.Delete(keyPrefix + historyKey(indexes[0])); err != nil {
+			return err
+		}
+		log.Printf("[DEBUG] (runner) removed version %d of %q", indexes[0], prefix.Dependency)
+		indexes = indexes[1:]
+	}
+
+	return nil
+}
+
+// checkHistory returns an error if the prefix never records history. Encrypted
+// prefixes have none, since it would store their values in plaintext.
+func checkHistory(prefix *PrefixConfig) error {
+	if e := prefix.Encrypt; e != nil && config.BoolVal(e.Enabled) &&
+		config.StringVal(e.Mode) == EncryptModeEncrypt {
+		return fmt.Errorf("%s is encrypted, so no history is recorded for it",
+			prefix.Dependency)
+	}
+	return nil
+}
+
+// History returns the indexes of the stored versions of the given prefix,
+// oldest first.
+func (r *Runner) History(prefix *PrefixConfig) ([]uint64, error) {
+	if err := checkHistory(prefix); err != nil {
+		return nil, err
+	}
+
+	store, keyPrefix, err := r.historyStore(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := store.Keys(keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		index, err := strconv.ParseUint(strings.TrimPrefix(key, keyPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	return indexes, nil
+}
+
+// Version returns the stored version of the prefix at the given index.
+func (r *Runner) Version(prefix *PrefixConfig, index uint64) (*Snapshot, error) {
+	store, keyPrefix, err := r.historyStore(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := store.Get(keyPrefix + historyKey(index))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("no version %d of %s", index, prefix.Dependency)
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if len(s.Prefixes) != 1 {
+		return nil, fmt.Errorf("invalid version %d of %s", index, prefix.Dependency)
+	}
+	return &s, nil
+}
+
+// Rollback restores the destination of the prefix to the stored version at
+// the given index, writing every key in that version and deleting any others.
+// Replication of the prefix is paused first so the restored data is not
+// overwritten, and the checkpoint is reset so that every key is replicated
+// again once it is resumed.
+func (r *Runner) Rollback(prefix *PrefixConfig, index uint64) error {
+	if err := checkHistory(prefix); err != nil {
+		return err
+	}
+
+	s, err := r.Version(prefix, index)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Pause(prefix); err != nil {
+		return err
+	}
+
+	status, err := r.getStatus(prefix)
+	if err != nil {
+		return fmt.Errorf("failed to read replication status: %s", err)
+	}
+	status.LastReplicated = 0
+	status.Source = config.StringVal(prefix.Source)
+	status.Destination = config.StringVal(prefix.Destination)
+	if err := r.setStatus(prefix, status); err != nil {
+		return fmt.Errorf("failed to reset checkpoint: %s", err)
+	}
+
+	dest, err := newDestination(prefix, r.clients)
+	if err != nil {
+		return err
+	}
+
+	keys, err := prefixKeyring(prefix)
+	if err != nil {
+		return err
+	}
+
+	pairs := s.Prefixes[0].Pairs
+	limits := r.writeLimits(prefix)
+	usedKeys := make(map[string]struct{}, len(pairs))
+	for _, pair := range pairs {
+		if _, ok := excludedBy(pair.Key, r.config.Excludes); ok {
+			continue
+		}
+
+		key := destinationKey(prefix, pair.Key)
+		usedKeys[key] = struct{}{}
+		value, err := encodeValue(prefix, keys, pair.Key, pair.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %q: %s", pair.Key, err)
+		}
+		if err := limits.acquire(context.Background()); err != nil {
+			return err
+		}
+		err = dest.Put(key, pair.Flags, value)
+		limits.release()
+		if aerr := r.audit.Record(AuditOperationPut, config.StringVal(prefix.Datacenter),
+			pair.Key, 0, key, value, err); aerr != nil {
+			return aerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %q: %s", key, err)
+		}
+	}
+
+	deletes, err := pruneDestination(context.Background(), prefix, r.config.Excludes, dest, nil, usedKeys, nil, r.audit, limits)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] (runner) rolled back %q to version %d (%d updates, %d deletes)",
+		prefix.Dependency, index, len(usedKeys), len(deletes))
+	return nil
+}
+
+// historyKey returns the key name of the version at the given index, padded so
+// that versions sort in order.
+func historyKey(index uint64) string {
+	return fmt.Sprintf("%020d", index)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// LogFormatText is the default log format of plain text lines.
+	LogFormatText = "text"
+
+	// LogFormatJSON is the log format of one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+// logTimeFormat is the format of the timestamp of each log line, the same as
+// the one used by the logging package.
+const logTimeFormat = "2006-01-02T15:04:05.000Z0700"
+
+// logFieldsEnabled is set when the JSON log format is in use, in which case
+// log messages carry their context fields.
+var logFieldsEnabled atomic.Bool
+
+// logFields are context fields attached to a log message, such as the prefix
+// it belongs to. They are only included in the JSON log format.
+type logFields map[string]string
+
+// prefixLogFields returns the fields describing the given prefix. The fields
+// are only built when they are logged, so it returns nil for the text format.
+func prefixLogFields(prefix *PrefixConfig) logFields {
+	if !logFieldsEnabled.Load() {
+		return nil
+	}
+	return logFields{
+		"source":      config.StringVal(prefix.Source),
+		"datacenter":  config.StringVal(prefix.Datacenter),
+		"destination": config.StringVal(prefix.Destination),
+	}
+}
+
+// with returns a copy of the fields with the given key set. It returns the
+// fields as they are for the text format, which does not include them.
+func (f logFields) with(key, value string) logFields {
+	if !logFieldsEnabled.Load() {
+		return f
+	}
+	r := make(logFields, len(f)+1)
+	for k, v := range f {
+		r[k] = v
+	}
+	r[key] = value
+	return r
+}
+
+// logf logs the formatted message in the usual "[LEVEL] (component) message"
+// format. When the JSON log format is in use, the fields are appended after a
+// tab as key="value" pairs, which jsonLogWriter turns into JSON fields.
+func logf(fields logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if logFieldsEnabled.Load() && len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, k+"="+strconv.Quote(fields[k]))
+		}
+		msg += "\t" + strings.Join(pairs, " ")
+	}
+	log.Output(2, msg)
+}
+
+// jsonLogWriter converts log lines of the form
+// "<timestamp> [LEVEL] (component) message" into JSON objects, one per line.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	record := make(map[string]string)
+
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		record["timestamp"], line = line[:i], line[i+1:]
+	}
+
+	if strings.HasPrefix(line, "[") {
+		if i := strings.IndexByte(line, ']'); i != -1 {
+			record["level"] = line[1:i]
+			line = strings.TrimLeft(line[i+1:], " ")
+		}
+	}
+
+	if strings.HasPrefix(line, "(") {
+		if i := strings.IndexByte(line, ')'); i != -1 {
+			record["component"] = line[1:i]
+			line = strings.TrimLeft(line[i+1:], " ")
+		}
+	}
+
+	if i := strings.LastIndexByte(line, '\t'); i != -1 {
+		if fields, ok := parseLogFields(line[i+1:]); ok {
+			for k, v := range fields {
+				record[k] = v
+			}
+			line = line[:i]
+		}
+	}
+	record["message"] = line
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// parseLogFields parses the key="value" pairs appended by logf.
+func parseLogFields(s string) (logFields, bool) {
+	fields := make(logFields)
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, false
+		}
+		key := s[:i]
+
+		quoted, err := strconv.QuotedPrefix(s[i+1:])
+		if err != nil {
+			return nil, false
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, false
+		}
+		fields[key] = value
+
+		s = strings.TrimPrefix(s[i+1+len(quoted):], " ")
+	}
+	return fields, true
+}
@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		i    string
+		e    map[string]string
+	}{
+		{
+			"plain",
+			"2017-08-10T17:42:01.000Z [INFO] (runner) running\n",
+			map[string]string{
+				"timestamp": "2017-08-10T17:42:01.000Z",
+				"level":     "INFO",
+				"component": "runner",
+				"message":   "running",
+			},
+		},
+		{
+			"fields",
+			"2017-08-10T17:42:01.000Z [DEBUG] (runner) updated key \"foo/bar\"\t" +
+				`datacenter="dc1" key="foo/bar" operation="put" source="foo"` + "\n",
+			map[string]string{
+				"timestamp":  "2017-08-10T17:42:01.000Z",
+				"level":      "DEBUG",
+				"component":  "runner",
+				"message":    `updated key "foo/bar"`,
+				"datacenter": "dc1",
+				"key":        "foo/bar",
+				"operation":  "put",
+				"source":     "foo",
+			},
+		},
+		{
+			"no_component",
+			"2017-08-10T17:42:01.000Z [INFO] creating pid file\n",
+			map[string]string{
+				"timestamp": "2017-08-10T17:42:01.000Z",
+				"level":     "INFO",
+				"message":   "creating pid file",
+			},
+		},
+		{
+			"tab_without_fields",
+			"2017-08-10T17:42:01.000Z [INFO] (cli) a\tb\n",
+			map[string]string{
+				"timestamp": "2017-08-10T17:42:01.000Z",
+				"level":     "INFO",
+				"component": "cli",
+				"message":   "a\tb",
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := &jsonLogWriter{out: &buf}
+			if _, err := w.Write([]byte(tc.i)); err != nil {
+				t.Fatal(err)
+			}
+
+			var act map[string]string
+			if err := json.Unmarshal(buf.Bytes(), &act); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.e, act) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.e, act)
+			}
+		})
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	prefix := &PrefixConfig{Source: config.String("global/")}
+
+	// Fields are only built for the JSON log format
+	if f := prefixLogFields(prefix).with("key", "foo"); f != nil {
+		t.Errorf("expected no fields, got %#v", f)
+	}
+
+	logFieldsEnabled.Store(true)
+	defer logFieldsEnabled.Store(false)
+
+	f := prefixLogFields(prefix)
+	e := logFields{"datacenter": "", "destination": "", "key": "foo", "source": "global/"}
+	if act := f.with("key", "foo"); !reflect.DeepEqual(e, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, act)
+	}
+	if _, ok := f["key"]; ok {
+		t.Error("expected the fields to be copied")
+	}
+}
+
+func TestCLI_printf(t *testing.T) {
+	var buf bytes.Buffer
+	cli := NewCLI(&buf, &buf)
+
+	cli.printf("Reloading configuration...\n")
+	if exp := "Reloading configuration...\n"; buf.String() != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, buf.String())
+	}
+
+	logFieldsEnabled.Store(true)
+	defer logFieldsEnabled.Store(false)
+
+	// Messages are JSON along with the logs
+	buf.Reset()
+	cli.printf("Reloading configuration...\n")
+	var act map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &act); err != nil {
+		t.Fatal(err)
+	}
+	delete(act, "timestamp")
+	e := map[string]string{
+		"level":     "INFO",
+		"component": "cli",
+		"message":   "Reloading configuration...",
+	}
+	if !reflect.DeepEqual(e, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, act)
+	}
+}
@@ -4,8 +4,10 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
 
+	"github.com/hashicorp/consul-template/config"
 	"github.com/mitchellh/mapstructure"
 )
 
@@ -51,13 +53,30 @@ func MapToPrefixConfigFunc() mapstructure.DecodeHookFunc {
 			return data, nil
 		}
 
+		// HCL decodes nested stanzas as a list of maps
+		flattenKeys(d, []string{
+			"destination_file",
+			"encrypt",
+			"source_file",
+			"wait",
+			"write_rate_limit",
+		})
+
 		source, ok := d["source"].(string)
 		if !ok {
 			return data, nil
 		}
 
+		// File sources are paths on disk, so they have no datacenter
+		_, hasSourceFile := d["source_file"]
+		sourceType, _ := d["source_type"].(string)
+		isFile := sourceType == PrefixTypeFile || (sourceType == "" && hasSourceFile)
+
 		for _, v := range []string{"dc", "datacenter"} {
 			if dc, ok := d[v].(string); ok {
+				if isFile {
+					return data, fmt.Errorf("file source cannot have a datacenter")
+				}
 				source = source + "@" + dc
 				break
 			}
@@ -69,14 +88,136 @@ func MapToPrefixConfigFunc() mapstructure.DecodeHookFunc {
 		}
 
 		// Convert it by parsing
-		p, err := ParsePrefixConfig(source)
+		var p *PrefixConfig
+		var err error
+		if isFile {
+			p, err = ParseFilePrefixConfig(source)
+		} else {
+			p, err = ParsePrefixConfig(source)
+		}
 		if err != nil {
 			return data, err
 		}
+
+		// Decode the remaining options onto the parsed prefix
+		opts := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			switch k {
+			case "source", "dc", "datacenter", "destination":
+			default:
+				opts[k] = v
+			}
+		}
+		if err := decodePrefixOptions(opts, p); err != nil {
+			return data, err
+		}
+
+		if isFile && config.BoolVal(p.Paged) {
+			return data, fmt.Errorf("file source cannot be paged")
+		}
+
+		if depth := config.IntVal(p.ShardDepth); depth < 0 {
+			return data, fmt.Errorf("shard_depth cannot be negative")
+		} else if depth > 0 {
+			if isFile {
+				return data, fmt.Errorf("file source cannot be sharded")
+			}
+			if config.BoolVal(p.Paged) {
+				return data, fmt.Errorf("paged prefix cannot be sharded")
+			}
+		}
+
+		// Paged prefixes only watch the pages of the prefix
+		if config.BoolVal(p.Paged) {
+			p.Dependency = NewKVPagesQuery(config.StringVal(p.Source),
+				config.StringVal(p.Datacenter))
+		}
+
+		// Sharded prefixes only watch the shards of the prefix, and each shard
+		// is watched on its own
+		if depth := config.IntVal(p.ShardDepth); depth > 0 {
+			interval := DefaultShardRefreshInterval
+			if p.ShardRefreshInterval != nil {
+				interval = *p.ShardRefreshInterval
+			}
+			p.Dependency = NewKVShardsQuery(config.StringVal(p.Source),
+				config.StringVal(p.Datacenter), depth, interval)
+		}
+
+		if isFile {
+			sf := p.SourceFile.Copy()
+			if sf == nil {
+				sf = DefaultFileSourceConfig()
+			}
+			sf.Finalize()
+
+			d, err := NewFileListQuery(config.StringVal(sf.Path),
+				config.StringVal(p.Source), config.TimeDurationVal(sf.PollInterval))
+			if err != nil {
+				return data, err
+			}
+			p.Dependency = d
+		}
+
 		return p, nil
 	}
 }
 
+// decodePrefixOptions decodes the options of a prefix stanza, other than the
+// source, datacenter, and destination which are handled by ParsePrefixConfig,
+// into the given PrefixConfig.
+func decodePrefixOptions(opts map[string]interface{}, p *PrefixConfig) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			config.StringToFileModeFunc(),
+			config.StringToWaitDurationHookFunc(),
+			mapstructure.StringToTimeDurationHookFunc(),
+		),
+		ErrorUnused: true,
+		Result:      p,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(opts); err != nil {
+		return err
+	}
+
+	if p.Compression != nil {
+		switch *p.Compression {
+		case CompressionNone, CompressionGzip, CompressionGunzip:
+		default:
+			return fmt.Errorf("invalid compression: %q", *p.Compression)
+		}
+	}
+
+	if p.Encrypt != nil && p.Encrypt.Mode != nil {
+		switch *p.Encrypt.Mode {
+		case EncryptModeEncrypt, EncryptModeDecrypt:
+		default:
+			return fmt.Errorf("invalid encrypt mode: %q", *p.Encrypt.Mode)
+		}
+	}
+
+	if p.DestinationType != nil {
+		switch *p.DestinationType {
+		case PrefixTypeKV, PrefixTypeFile:
+		default:
+			return fmt.Errorf("invalid destination_type: %q", *p.DestinationType)
+		}
+	}
+
+	if p.SourceType != nil {
+		switch *p.SourceType {
+		case PrefixTypeKV, PrefixTypeFile:
+		default:
+			return fmt.Errorf("invalid source_type: %q", *p.SourceType)
+		}
+	}
+
+	return nil
+}
+
 // StringToExcludeConfigFunc returns a function that converts strings to
 // *ExcludeConfig value. This is designed to be used with mapstructure.
 func StringToExcludeConfigFunc() mapstructure.DecodeHookFunc {
@@ -0,0 +1,315 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// NotifyEventPassCompleted is sent when a replication pass of a prefix
+	// wrote or deleted at least one key.
+	NotifyEventPassCompleted = "pass_completed"
+
+	// NotifyEventPassFailed is sent when a replication pass of a prefix failed.
+	NotifyEventPassFailed = "pass_failed"
+
+	// NotifyEventDeleteGuard is sent when a replication pass of a prefix would
+	// delete more keys than its max_deletes, so none were deleted.
+	NotifyEventDeleteGuard = "delete_guard"
+
+	// NotifyEventConflict is sent when the status of a prefix was modified by
+	// another process during a pass, so it was not checkpointed.
+	NotifyEventConflict = "conflict"
+)
+
+// notifyEvents is the list of valid event names.
+var notifyEvents = []string{
+	NotifyEventPassCompleted,
+	NotifyEventPassFailed,
+	NotifyEventDeleteGuard,
+	NotifyEventConflict,
+}
+
+// notifyEvent is a single replication event sent to notify endpoints.
+type notifyEvent struct {
+	Event       string    `json:"event"`
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	Datacenter  string    `json:"datacenter"`
+	Destination string    `json:"destination"`
+	Updates     int       `json:"updates"`
+	Deletes     int       `json:"deletes"`
+	Unchanged   int       `json:"unchanged"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// newNotifyEvent returns an event of the given type for the prefix.
+func newNotifyEvent(event string, prefix *PrefixConfig) *notifyEvent {
+	return &notifyEvent{
+		Event:       event,
+		Timestamp:   time.Now().UTC(),
+		Source:      config.StringVal(prefix.Source),
+		Datacenter:  config.StringVal(prefix.Datacenter),
+		Destination: config.StringVal(prefix.Destination),
+	}
+}
+
+// notifyPayload is the data given to body templates. It is also the default
+// body, encoded as JSON.
+type notifyPayload struct {
+	Events []*notifyEvent `json:"events"`
+}
+
+// notifiers sends events to each configured endpoint.
+type notifiers []*notifier
+
+// newNotifiers creates and starts a notifier for each notify block.
+func newNotifiers(c *NotifyConfigs) (notifiers, error) {
+	var ns notifiers
+	for _, nc := range *c {
+		n, err := newNotifier(nc)
+		if err != nil {
+			ns.Stop()
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// Notify queues the event for each endpoint that is subscribed to it.
+func (ns notifiers) Notify(e *notifyEvent) {
+	for _, n := range ns {
+		n.Notify(e)
+	}
+}
+
+// Stop sends any queued events and stops each notifier.
+func (ns notifiers) Stop() {
+	for _, n := range ns {
+		n.Stop()
+	}
+}
+
+// notifier batches events and POSTs them to a single endpoint.
+type notifier struct {
+	url      string
+	events   map[string]struct{}
+	headers  map[string]string
+	body     *template.Template
+	batchMax int
+	wait     time.Duration
+	retry    config.RetryFunc
+	client   *http.Client
+
+	eventCh chan *notifyEvent
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// newNotifier validates the given notify block and starts sending its events
+// in the background.
+func newNotifier(c *NotifyConfig) (*notifier, error) {
+	url := config.StringVal(c.URL)
+	if url == "" {
+		return nil, fmt.Errorf("notify: missing url")
+	}
+
+	n := &notifier{
+		url:      url,
+		headers:  c.Headers,
+		batchMax: config.IntVal(c.BatchMax),
+		wait:     config.TimeDurationVal(c.BatchWait),
+		retry:    c.Retry.RetryFunc(),
+		client:   &http.Client{Timeout: config.TimeDurationVal(c.Timeout)},
+		eventCh:  make(chan *notifyEvent, 64),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+
+	if events := *c.Events; len(events) > 0 {
+		n.events = make(map[string]struct{}, len(events))
+		for _, e := range events {
+			if !validNotifyEvent(e) {
+				return nil, fmt.Errorf("notify %s: invalid event %q", url, e)
+			}
+			n.events[e] = struct{}{}
+		}
+	}
+
+	if body := config.StringVal(c.Body); body != "" {
+		tmpl, err := template.New("body").Funcs(template.FuncMap{
+			"toJSON": toJSON,
+		}).Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("notify %s: %s", url, err)
+		}
+		n.body = tmpl
+	}
+
+	go n.run()
+	return n, nil
+}
+
+// Notify queues the event if the endpoint is subscribed to it. Events are
+// dropped if the queue is full, so a slow endpoint never blocks replication.
+func (n *notifier) Notify(e *notifyEvent) {
+	if n.events != nil {
+		if _, ok := n.events[e.Event]; !ok {
+			return
+		}
+	}
+
+	select {
+	case n.eventCh <- e:
+	default:
+		log.Printf("[WARN] (notify) queue for %s is full, dropping %s event",
+			n.url, e.Event)
+	}
+}
+
+// Stop sends any queued events with a single attempt and waits for the
+// notifier to exit.
+func (n *notifier) Stop() {
+	close(n.stopCh)
+	<-n.doneCh
+}
+
+// run collects events into batches of up to batchMax events, sending each
+// batch once wait has passed since its first event.
+func (n *notifier) run() {
+	defer close(n.doneCh)
+
+	var batch []*notifyEvent
+	var timer <-chan time.Time
+	for {
+		select {
+		case e := <-n.eventCh:
+			batch = append(batch, e)
+			if len(batch) >= n.batchMax {
+				n.send(batch, true)
+				batch, timer = nil, nil
+				continue
+			}
+			if timer == nil {
+				timer = time.After(n.wait)
+			}
+		case <-timer:
+			n.send(batch, true)
+			batch, timer = nil, nil
+		case <-n.stopCh:
+		DRAIN:
+			for {
+				select {
+				case e := <-n.eventCh:
+					batch = append(batch, e)
+				default:
+					break DRAIN
+				}
+			}
+			if len(batch) > 0 {
+				n.send(batch, false)
+			}
+			return
+		}
+	}
+}
+
+// send POSTs the batch, retrying failures according to the retry config if
+// retry is true. Failures are logged, since there is nowhere to report them.
+func (n *notifier) send(batch []*notifyEvent, retry bool) {
+	body, err := n.render(batch)
+	if err != nil {
+		log.Printf("[ERR] (notify) failed to render body for %s: %s", n.url, err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := n.post(body)
+		if err == nil {
+			log.Printf("[DEBUG] (notify) sent %d event(s) to %s", len(batch), n.url)
+			return
+		}
+
+		ok, sleep := n.retry(attempt)
+		if !retry || !ok {
+			log.Printf("[ERR] (notify) failed to send %d event(s) to %s: %s",
+				len(batch), n.url, err)
+			return
+		}
+		log.Printf("[WARN] (notify) failed to send to %s, retrying in %s: %s",
+			n.url, sleep, err)
+
+		select {
+		case <-time.After(sleep):
+		case <-n.stopCh:
+			retry = false
+		}
+	}
+}
+
+// render returns the request body for the batch.
+func (n *notifier) render(batch []*notifyEvent) ([]byte, error) {
+	payload := &notifyPayload{Events: batch}
+	if n.body == nil {
+		return json.Marshal(payload)
+	}
+
+	var buf bytes.Buffer
+	if err := n.body.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// post sends a single request. Any status other than 2xx is an error.
+func (n *notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// validNotifyEvent returns true if the event name is known.
+func validNotifyEvent(e string) bool {
+	for _, v := range notifyEvents {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// toJSON is a template function that encodes the value as JSON.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
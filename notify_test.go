@@ -0,0 +1,247 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestNotifier(t *testing.T) {
+	prefix := &PrefixConfig{
+		Datacenter:  config.String("dc1"),
+		Destination: config.String("global"),
+		Source:      config.String("global"),
+	}
+
+	cases := []struct {
+		name   string
+		config *NotifyConfig
+		fail   int
+		events []string
+		exp    []string
+	}{
+		{
+			"default_body",
+			&NotifyConfig{},
+			0,
+			[]string{NotifyEventPassCompleted, NotifyEventPassFailed},
+			[]string{`{"events":[` +
+				`{"event":"pass_completed","timestamp":"0001-01-01T00:00:00Z","source":"global","datacenter":"dc1","destination":"global","updates":0,"deletes":0,"unchanged":0},` +
+				`{"event":"pass_failed","timestamp":"0001-01-01T00:00:00Z","source":"global","datacenter":"dc1","destination":"global","updates":0,"deletes":0,"unchanged":0}]}`},
+		},
+		{
+			"events",
+			&NotifyConfig{
+				Body:   config.String(`{{ range .Events }}{{ .Event }} {{ end }}`),
+				Events: &[]string{NotifyEventPassFailed},
+			},
+			0,
+			[]string{NotifyEventPassCompleted, NotifyEventPassFailed},
+			[]string{"pass_failed "},
+		},
+		{
+			"body",
+			&NotifyConfig{
+				Body: config.String(`{"text": {{ printf "%d events from %s" (len .Events) (index .Events 0).Datacenter | toJSON }}}`),
+			},
+			0,
+			[]string{NotifyEventPassFailed},
+			[]string{`{"text": "1 events from dc1"}`},
+		},
+		{
+			"batch_max",
+			&NotifyConfig{
+				Body:     config.String(`{{ len .Events }}`),
+				BatchMax: config.Int(2),
+			},
+			0,
+			[]string{NotifyEventPassFailed, NotifyEventPassFailed, NotifyEventPassFailed},
+			[]string{"2", "1"},
+		},
+		{
+			"retry",
+			&NotifyConfig{
+				Body: config.String(`{{ len .Events }}`),
+				Retry: &config.RetryConfig{
+					Backoff: config.TimeDuration(1 * time.Millisecond),
+				},
+			},
+			2,
+			[]string{NotifyEventPassFailed},
+			[]string{"1"},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies []string
+			var failures int
+			received := make(chan struct{}, 10)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if r.Header.Get("X-Token") != "abcd" {
+					t.Errorf("missing header: %#v", r.Header)
+				}
+				if failures < tc.fail {
+					failures++
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				bodies = append(bodies, stripTimestamps(t, string(b)))
+				received <- struct{}{}
+			}))
+			defer ts.Close()
+
+			c := tc.config.Copy()
+			c.URL = config.String(ts.URL)
+			c.Headers = map[string]string{"X-Token": "abcd"}
+			c.BatchWait = config.TimeDuration(50 * time.Millisecond)
+			c.Finalize()
+
+			n, err := newNotifier(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tc.events {
+				n.Notify(newNotifyEvent(e, prefix))
+			}
+
+			for range tc.exp {
+				select {
+				case <-received:
+				case <-time.After(2 * time.Second):
+					t.Fatal("timed out waiting for request")
+				}
+			}
+			n.Stop()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(tc.exp, bodies) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, bodies)
+			}
+		})
+	}
+}
+
+func TestNotifier_Stop(t *testing.T) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+	}))
+	defer ts.Close()
+
+	c := &NotifyConfig{
+		Body:      config.String(`{{ len .Events }}`),
+		BatchWait: config.TimeDuration(1 * time.Hour),
+		URL:       config.String(ts.URL),
+	}
+	c.Finalize()
+
+	n, err := newNotifier(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(newNotifyEvent(NotifyEventPassFailed, &PrefixConfig{}))
+	n.Stop()
+
+	select {
+	case body := <-received:
+		if body != "1" {
+			t.Errorf("\nexp: %#v\nact: %#v", "1", body)
+		}
+	default:
+		t.Fatal("expected queued events to be sent on stop")
+	}
+}
+
+func TestNewNotifier_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *NotifyConfig
+	}{
+		{
+			"missing_url",
+			&NotifyConfig{},
+		},
+		{
+			"invalid_event",
+			&NotifyConfig{
+				Events: &[]string{"nope"},
+				URL:    config.String("http://127.0.0.1"),
+			},
+		},
+		{
+			"invalid_body",
+			&NotifyConfig{
+				Body: config.String("{{ .Events"),
+				URL:  config.String("http://127.0.0.1"),
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			tc.config.Finalize()
+			if _, err := newNotifier(tc.config); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestNotifyConfig_JSON(t *testing.T) {
+	c := &NotifyConfig{
+		Headers: map[string]string{"Authorization": "Bearer abcd1234"},
+		URL:     config.String("http://127.0.0.1"),
+	}
+	c.Finalize()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "abcd1234") {
+		t.Errorf("expected headers to be suppressed: %s", b)
+	}
+}
+
+// stripTimestamps zeroes the timestamps of JSON encoded events so bodies can
+// be compared. Other bodies are returned as-is.
+func stripTimestamps(t *testing.T, body string) string {
+	var payload notifyPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.Events == nil {
+		return body
+	}
+	for _, e := range payload.Events {
+		e.Timestamp = time.Time{}
+	}
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/watch"
+	"github.com/hashicorp/consul/api"
+)
+
+// pauseDir returns the path in the KV store under which the pause flag of
+// each prefix is stored.
+func (r *Runner) pauseDir() string {
+	return strings.TrimRight(config.StringVal(r.config.StatusDir), "/") + "/paused/"
+}
+
+// pausePath returns the path of the pause flag for the given prefix. The shards
+// of a sharded prefix share its flag.
+func (r *Runner) pausePath(prefix *PrefixConfig) string {
+	if prefix.shardOf != nil {
+		prefix = prefix.shardOf
+	}
+	return r.pauseDir() + statusID(prefix)
+}
+
+// Paused returns true if replication of the given prefix is paused.
+func (r *Runner) Paused(prefix *PrefixConfig) (bool, error) {
+	kv := r.clients.Consul().KV()
+	pair, _, err := kv.Get(r.pausePath(prefix), nil)
+	if err != nil {
+		return false, err
+	}
+	return pair != nil, nil
+}
+
+// paused returns true if replication of the given prefix is paused. The
+// watched pause flags are used once they have been received, and the flag is
+// only read from the KV store before then, or if the flags are not watched.
+func (r *Runner) paused(prefix *PrefixConfig) (bool, error) {
+	var view *watch.View
+	if r.pauses != nil {
+		r.RLock()
+		view = r.data[r.pauses.String()]
+		r.RUnlock()
+	}
+	if view == nil {
+		return r.Paused(prefix)
+	}
+
+	pairs, ok := view.Data().([]*dep.KeyPair)
+	if !ok {
+		return false, fmt.Errorf("could not convert pause flags")
+	}
+	path := r.pausePath(prefix)
+	for _, pair := range pairs {
+		if pair.Path == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Pause pauses replication of the given prefix. The prefix is still watched,
+// but no keys are written until it is resumed. The flag is stored in the KV
+// store, so it applies to every running daemon and survives restarts.
+func (r *Runner) Pause(prefix *PrefixConfig) error {
+	kv := r.clients.Consul().KV()
+	if _, err := kv.Put(&api.KVPair{
+		Key:   r.pausePath(prefix),
+		Value: []byte(time.Now().UTC().Format(time.RFC3339)),
+	}, nil); err != nil {
+		return err
+	}
+	log.Printf("[INFO] (runner) paused replication of %q", prefix.Dependency)
+	return nil
+}
+
+// Resume resumes replication of the given prefix. Running daemons watch the
+// pause flags, so this triggers a catch-up pass that replicates any changes
+// made while the prefix was paused.
+func (r *Runner) Resume(prefix *PrefixConfig) error {
+	kv := r.clients.Consul().KV()
+	if _, err := kv.Delete(r.pausePath(prefix), nil); err != nil {
+		return err
+	}
+	log.Printf("[INFO] (runner) resumed replication of %q", prefix.Dependency)
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// quiescence is the min/max quiescence timers of a single prefix. Once the
+// timers fire, the String() of the prefix's dependency is sent on ch, unless
+// doneCh is closed or the timers are stopped first.
+type quiescence struct {
+	id       string
+	min      time.Duration
+	max      time.Duration
+	ch       chan string
+	doneCh   <-chan struct{}
+	stopCh   chan struct{}
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// newQuiescence creates a new quiescence timer for the prefix with the given
+// dependency, which is abandoned once doneCh is closed.
+func newQuiescence(ch chan string, doneCh <-chan struct{}, min, max time.Duration, id string) *quiescence {
+	return &quiescence{
+		id:     id,
+		min:    min,
+		max:    max,
+		ch:     ch,
+		doneCh: doneCh,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// tick updates the minimum quiescence timer.
+func (q *quiescence) tick() {
+	now := time.Now()
+
+	// If this is the first tick, set up the timer and calculate the max
+	// deadline.
+	if q.timer == nil {
+		q.timer = time.NewTimer(q.min)
+		go func() {
+			select {
+			case <-q.timer.C:
+			case <-q.stopCh:
+				return
+			case <-q.doneCh:
+				return
+			}
+			select {
+			case q.ch <- q.id:
+			case <-q.stopCh:
+			case <-q.doneCh:
+			}
+		}()
+
+		q.deadline = now.Add(q.max)
+		return
+	}
+
+	// Snooze the timer for the min time, or snooze less if we are coming up
+	// against the max time. If the timer has already fired and the reset does
+	// not work that is ok, because the id is still sent and the prefix is
+	// replicated.
+	dur := q.deadline.Sub(now)
+	if dur > q.min {
+		dur = q.min
+	}
+	q.timer.Reset(dur)
+}
+
+// stop stops the timers, so the prefix's dependency is never sent.
+func (q *quiescence) stop() {
+	close(q.stopCh)
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+}
+
+// prefixWait returns the quiescence timers of the prefix, which are the
+// global timers unless the prefix sets its own.
+func prefixWait(prefix *PrefixConfig, global *config.WaitConfig) *config.WaitConfig {
+	if prefix.Wait != nil {
+		return prefix.Wait
+	}
+	return global
+}
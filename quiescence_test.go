@@ -0,0 +1,137 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestQuiescence(t *testing.T) {
+	t.Run("min", func(t *testing.T) {
+		ch := make(chan string, 1)
+		q := newQuiescence(ch, nil, 50*time.Millisecond, 10*time.Second, "foo")
+		q.tick()
+
+		select {
+		case id := <-ch:
+			if id != "foo" {
+				t.Errorf("\nexp: %#v\nact: %#v", "foo", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the timer to fire")
+		}
+	})
+
+	t.Run("max", func(t *testing.T) {
+		ch := make(chan string, 1)
+		q := newQuiescence(ch, nil, 50*time.Millisecond, 150*time.Millisecond, "foo")
+		start := time.Now()
+		q.tick()
+
+		// Keep snoozing the min timer, so only the max deadline fires it
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ch:
+				if d := time.Since(start); d < 150*time.Millisecond {
+					t.Errorf("expected the timer to fire after the max, fired after %s", d)
+				}
+				return
+			case <-ticker.C:
+				q.tick()
+			case <-time.After(time.Second):
+				t.Fatal("expected the timer to fire")
+			}
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		ch := make(chan string, 1)
+		q := newQuiescence(ch, nil, 10*time.Millisecond, time.Second, "foo")
+		q.tick()
+		q.stop()
+
+		select {
+		case id := <-ch:
+			t.Errorf("expected the timer not to fire, got %q", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("done", func(t *testing.T) {
+		ch := make(chan string)
+		doneCh := make(chan struct{})
+		q := newQuiescence(ch, doneCh, 10*time.Millisecond, time.Second, "foo")
+		close(doneCh)
+		q.tick()
+
+		select {
+		case id := <-ch:
+			t.Errorf("expected the timer not to fire, got %q", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestRunner_quiesce(t *testing.T) {
+	newPrefix := func(s string, wait *config.WaitConfig) *PrefixConfig {
+		p, err := ParsePrefixConfig(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Wait = wait
+		p.Finalize()
+		return p
+	}
+	fast := newPrefix("fast@dc1", nil)
+	slow := newPrefix("slow@dc1", &config.WaitConfig{
+		Min: config.TimeDuration(time.Hour),
+	})
+	slow.Wait.Finalize()
+
+	c := DefaultConfig()
+	c.Prefixes = &PrefixConfigs{fast, slow}
+	c.Finalize()
+
+	r := &Runner{
+		config:        c,
+		quiescenceMap: make(map[string]*quiescence),
+		quiescenceCh:  make(chan string),
+	}
+
+	// Only received prefixes that do not wait are replicated right away
+	ids := r.quiesce(map[string]struct{}{slow.Dependency.String(): {}})
+	if len(ids) != 0 {
+		t.Errorf("expected no prefixes, got %#v", ids)
+	}
+	if _, ok := r.quiescenceMap[slow.Dependency.String()]; !ok {
+		t.Errorf("expected timers for %s", slow.Dependency)
+	}
+
+	ids = r.quiesce(map[string]struct{}{fast.Dependency.String(): {}})
+	exp := map[string]struct{}{fast.Dependency.String(): {}}
+	if !reflect.DeepEqual(exp, ids) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, ids)
+	}
+
+	// Data for other dependencies applies to every prefix
+	delete(r.quiescenceMap, slow.Dependency.String())
+	pauses, err := dep.NewKVListQuery("service/consul-replicate/pauses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = r.quiesce(map[string]struct{}{pauses.String(): {}})
+	if !reflect.DeepEqual(exp, ids) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, ids)
+	}
+	if _, ok := r.quiescenceMap[slow.Dependency.String()]; !ok {
+		t.Errorf("expected timers for %s", slow.Dependency)
+	}
+}
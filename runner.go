@@ -4,14 +4,18 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
 	"sync"
 	"time"
 
@@ -22,11 +26,21 @@ import (
 	"github.com/hashicorp/consul-template/watch"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Regexp for invalid characters in keys
 var InvalidRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
+// errStatusChanged is returned when the status was modified by another
+// process since it was read.
+var errStatusChanged = errors.New("status was modified concurrently")
+
+// errRestartRequired is returned by Reload when the new configuration changes
+// options that cannot be applied to a running Runner.
+var errRestartRequired = errors.New("configuration change requires a restart")
+
 // Status is an internal struct that is responsible for marshaling and
 // unmarshaling JSON responses into keys.
 type Status struct {
@@ -35,6 +49,10 @@ type Status struct {
 
 	// Source and Destination are the given and final destination.
 	Source, Destination string
+
+	// modifyIndex is the index of the status when it was read, used to detect
+	// concurrent changes.
+	modifyIndex uint64
 }
 
 type Runner struct {
@@ -62,8 +80,11 @@ type Runner struct {
 	// once indicates the runner should get data exactly one time and then stop.
 	once bool
 
-	// minTimer and maxTimer are used for quiescence.
-	minTimer, maxTimer <-chan time.Time
+	// quiescenceMap is the map of the quiescence timers of each prefix by the
+	// String() of its dependency, guarded by the lock, and quiescenceCh
+	// receives the dependency of a prefix when its timers fire.
+	quiescenceMap map[string]*quiescence
+	quiescenceCh  chan string
 
 	// outStream and errStream are the io.Writer streams where the runner will
 	// write information.
@@ -71,6 +92,47 @@ type Runner struct {
 
 	// watcher is the watcher this runner is using.
 	watcher *watch.Watcher
+
+	// pauses is the watch of the pause flags, or nil if they are not watched.
+	pauses *dep.KVListQuery
+
+	// localDatacenter is the datacenter of the local Consul agent, resolved at
+	// startup and on reload.
+	localDatacenter string
+
+	// pidStored is true once the runner has written the pid file, so that a
+	// runner that was never started leaves the pid file of another alone.
+	pidStored bool
+
+	// reloadCh triggers a pass after the configuration is reloaded.
+	reloadCh chan struct{}
+
+	// audit is the audit log of writes and deletes, or nil if disabled.
+	audit *auditLog
+
+	// notify sends replication events to the configured endpoints.
+	notify notifiers
+
+	// shutdownTracing flushes and stops the trace exporter.
+	shutdownTracing func(context.Context) error
+
+	// writeLimit is the limit of writes in flight shared by all prefixes,
+	// writeRateLimit is the rate limit of prefixes without their own, and
+	// prefixWriteLimits are the rate limits of each prefix by the String() of
+	// its dependency, or of its sharded prefix for a shard.
+	writeLimit        *writeLimit
+	writeRateLimit    *writeLimit
+	writeLimitsLock   sync.Mutex
+	prefixWriteLimits map[string]*prefixWriteLimit
+
+	// indexes are the indexes of the keys in each prefix's destination by the
+	// String() of its dependency.
+	indexesLock sync.Mutex
+	indexes     map[string]*destinationIndex
+
+	// shards are the shards of each sharded prefix by the String() of its
+	// dependency.
+	shards map[string][]*PrefixConfig
 }
 
 // NewRunner accepts a config, command, and boolean value for once mode.
@@ -103,14 +165,36 @@ func (r *Runner) Start() {
 	// Add the dependencies to the watcher
 	for _, prefix := range *r.config.Prefixes {
 		if _, err := r.watcher.Add(prefix.Dependency); err != nil {
-			log.Printf("ERR (runner) failed to add watch: %v", err)
+			log.Printf("[ERR] (runner) failed to add watch: %v", err)
+		}
+	}
+
+	// Watch the pause flags so that pausing takes effect on the next pass and
+	// resuming triggers a catch-up pass.
+	if !r.once {
+		pauses, err := dep.NewKVListQuery(r.pauseDir())
+		if err != nil {
+			r.ErrCh <- err
+			return
+		}
+		if _, err := r.watcher.Add(pauses); err != nil {
+			log.Printf("[ERR] (runner) failed to add watch: %v", err)
 		}
+		r.pauses = pauses
+	}
+
+	// Periodically replicate every prefix, in case a change was missed
+	var antiEntropyCh <-chan time.Time
+	if interval := config.TimeDurationVal(r.config.AntiEntropyInterval); interval > 0 && !r.once {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		antiEntropyCh = ticker.C
 	}
 
 	// If once mode is on, wait until we get data back from all the views before proceeding
 	onceCh := make(chan struct{}, 1)
 	if r.once {
-		for i := 0; i < len(*r.config.Prefixes); i++ {
+		for !r.received() {
 			select {
 			case view := <-r.watcher.DataCh():
 				r.Receive(view)
@@ -123,9 +207,14 @@ func (r *Runner) Start() {
 	}
 
 	for {
+		// ids are the dependencies of the prefixes to replicate, or nil for all
+		// prefixes
+		var ids map[string]struct{}
+
 		select {
 		case view := <-r.watcher.DataCh():
 			r.Receive(view)
+			received := map[string]struct{}{view.Dependency().String(): {}}
 
 			// Drain all views that have data
 		OUTER:
@@ -133,38 +222,45 @@ func (r *Runner) Start() {
 				select {
 				case view = <-r.watcher.DataCh():
 					r.Receive(view)
+					received[view.Dependency().String()] = struct{}{}
 				default:
 					break OUTER
 				}
 			}
 
-			// If we are waiting for quiescence, setup the timers
-			if *r.config.Wait.Min != 0 && *r.config.Wait.Max != 0 {
-				log.Printf("[INFO] (runner) quiescence timers starting")
-				r.minTimer = time.After(*r.config.Wait.Min)
-				if r.maxTimer == nil {
-					r.maxTimer = time.After(*r.config.Wait.Max)
-				}
+			// In once mode, all prefixes are replicated once they have data
+			if r.once {
+				continue
+			}
+
+			// Start the quiescence timers of prefixes that wait, and replicate
+			// the others right away
+			ids = r.quiesce(received)
+			if len(ids) == 0 {
 				continue
 			}
-		case <-r.minTimer:
-			log.Printf("[INFO] (runner) quiescence minTimer fired")
-			r.minTimer, r.maxTimer = nil, nil
-		case <-r.maxTimer:
-			log.Printf("[INFO] (runner) quiescence maxTimer fired")
-			r.minTimer, r.maxTimer = nil, nil
+		case id := <-r.quiescenceCh:
+			log.Printf("[INFO] (runner) quiescence timers fired for %s", id)
+			r.Lock()
+			delete(r.quiescenceMap, id)
+			r.Unlock()
+			ids = map[string]struct{}{id: {}}
+		case <-antiEntropyCh:
+			log.Printf("[INFO] (runner) anti-entropy sweep of all prefixes")
 		case err := <-r.watcher.ErrCh():
 			log.Printf("[ERR] (runner) watcher reported error: %s", err)
 			r.ErrCh <- err
 		case <-r.DoneCh:
 			log.Printf("[INFO] (runner) received finish")
 			return
+		case <-r.reloadCh:
+			log.Printf("[INFO] (runner) configuration reloaded")
 		case <-onceCh:
 		}
 
 		// If we got this far, that means we got new data or one of the timers
 		// fired, so attempt to run.
-		if err := r.Run(); err != nil {
+		if err := r.run(ids); err != nil {
 			r.ErrCh <- err
 			return
 		}
@@ -185,27 +281,259 @@ func (r *Runner) Stop() {
 		log.Printf("[WARN] (runner) could not remove pid at %q: %s",
 			*r.config.PidFile, err)
 	}
+	r.notify.Stop()
+	r.stopDestinationIndexes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.shutdownTracing(ctx); err != nil {
+		log.Printf("[WARN] (runner) could not flush traces: %s", err)
+	}
+	if err := r.audit.Close(); err != nil {
+		log.Printf("[WARN] (runner) could not close audit log: %s", err)
+	}
 	close(r.DoneCh)
 }
 
-// Receive accepts data from Consul and maps that data to the prefix.
+// Reload applies the prefixes and excludes of the given configuration to the
+// running Runner. Watches of unchanged prefixes are kept along with their data
+// and checkpoints, so only added prefixes are listed from their source. If any
+// other option changed, errRestartRequired is returned and the Runner must be
+// replaced instead.
+func (r *Runner) Reload(c *Config) error {
+	c = DefaultConfig().Merge(c)
+	c.Finalize()
+
+	if err := validatePrefixes(c.Prefixes); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	// Keep the last known datacenter if the agent cannot be reached
+	localDatacenter, err := agentDatacenter(r.clients, nil)
+	if err != nil {
+		log.Printf("[WARN] (runner) %s, using datacenter %q", err, r.localDatacenter)
+		localDatacenter = r.localDatacenter
+	}
+	if err := checkRunnable(c, localDatacenter); err != nil {
+		return fmt.Errorf("runner: invalid configuration: %s", err)
+	}
+	r.localDatacenter = localDatacenter
+
+	if !reloadable(r.config, c) {
+		return errRestartRequired
+	}
+
+	current := make(map[string]*PrefixConfig, len(*r.config.Prefixes))
+	for _, prefix := range *r.config.Prefixes {
+		current[prefix.Dependency.String()] = prefix
+	}
+
+	var added int
+	for _, prefix := range *c.Prefixes {
+		id := prefix.Dependency.String()
+		if existing, ok := current[id]; ok {
+			// Keep the dependency that is already being watched, and the
+			// watches of its shards
+			prefix.Dependency = existing.Dependency
+			delete(current, id)
+
+			if shards, ok := r.shards[id]; ok {
+				subtrees := make([]string, 0, len(shards))
+				for _, shard := range shards {
+					subtrees = append(subtrees, config.StringVal(shard.Source))
+				}
+				if err := r.updateShards(prefix, subtrees); err != nil {
+					return fmt.Errorf("runner: %s", err)
+				}
+			}
+			continue
+		}
+
+		if _, err := r.watcher.Add(prefix.Dependency); err != nil {
+			return fmt.Errorf("runner: failed to add watch: %s", err)
+		}
+		added++
+	}
+
+	for _, prefix := range current {
+		r.removeShards(prefix)
+		r.removePrefix(prefix)
+	}
+
+	r.config.Prefixes = c.Prefixes
+	r.config.Excludes = c.Excludes
+	log.Printf("[INFO] (runner) reloaded configuration (%d prefixes added, %d removed)",
+		added, len(current))
+
+	// Run a pass in case only the excludes or destinations changed
+	select {
+	case r.reloadCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// removePrefix stops watching the prefix and forgets its data and quiescence
+// timers. The caller must hold the lock.
+func (r *Runner) removePrefix(prefix *PrefixConfig) {
+	id := prefix.Dependency.String()
+	r.watcher.Remove(prefix.Dependency)
+	delete(r.data, id)
+
+	if q, ok := r.quiescenceMap[id]; ok {
+		q.stop()
+		delete(r.quiescenceMap, id)
+	}
+
+	r.writeLimitsLock.Lock()
+	delete(r.prefixWriteLimits, id)
+	r.writeLimitsLock.Unlock()
+
+	r.removeDestinationIndex(prefix)
+}
+
+// reloadable returns true if the given configurations differ only in options
+// that Reload can apply.
+func reloadable(a, b *Config) bool {
+	a, b = a.Copy(), b.Copy()
+	a.Prefixes, b.Prefixes = nil, nil
+	a.Excludes, b.Excludes = nil, nil
+	a.WatchConfig, b.WatchConfig = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// quiesce starts or snoozes the quiescence timers of the prefixes that wait and
+// whose dependencies are in received, and returns the dependencies of the
+// received prefixes that do not wait and are replicated right away. Data for
+// any other dependency, such as the pause flags, applies to every prefix.
+func (r *Runner) quiesce(received map[string]struct{}) map[string]struct{} {
+	r.Lock()
+	defer r.Unlock()
+
+	all := r.allPrefixes()
+	prefixes := make(map[string]struct{}, len(all))
+	for _, prefix := range all {
+		prefixes[prefix.Dependency.String()] = struct{}{}
+	}
+	other := false
+	for id := range received {
+		if _, ok := prefixes[id]; !ok {
+			other = true
+			break
+		}
+	}
+
+	ids := make(map[string]struct{})
+	for _, prefix := range all {
+		id := prefix.Dependency.String()
+		if _, ok := received[id]; !ok && !other {
+			continue
+		}
+
+		wait := prefixWait(prefix, r.config.Wait)
+		if !config.BoolVal(wait.Enabled) {
+			ids[id] = struct{}{}
+			continue
+		}
+
+		q, ok := r.quiescenceMap[id]
+		if !ok {
+			log.Printf("[INFO] (runner) quiescence timers starting for %s", id)
+			q = newQuiescence(r.quiescenceCh, r.DoneCh, config.TimeDurationVal(wait.Min),
+				config.TimeDurationVal(wait.Max), id)
+			r.quiescenceMap[id] = q
+		}
+		q.tick()
+	}
+	return ids
+}
+
+// Receive accepts data from Consul and maps that data to the prefix. The shards
+// of a sharded prefix are watched as soon as they are listed.
 func (r *Runner) Receive(view *watch.View) {
 	r.Lock()
 	defer r.Unlock()
-	r.data[view.Dependency().String()] = view
+	id := view.Dependency().String()
+	r.data[id] = view
+
+	data, ok := view.Data().(*kvShards)
+	if !ok {
+		return
+	}
+	for _, prefix := range *r.config.Prefixes {
+		if prefix.Dependency.String() != id {
+			continue
+		}
+		if err := r.updateShards(prefix, data.Shards); err != nil {
+			log.Printf("[ERR] (runner) failed to update shards of %s: %s", id, err)
+		}
+	}
+}
+
+// received returns true once every prefix, including the shards of sharded
+// prefixes, has data.
+func (r *Runner) received() bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, prefix := range r.allPrefixes() {
+		if _, ok := r.data[prefix.Dependency.String()]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 // Run invokes a single pass of the runner.
 func (r *Runner) Run() error {
-	log.Printf("[INFO] (runner) running")
+	return r.run(nil)
+}
+
+// run replicates the prefixes whose dependencies are in ids, or every prefix
+// if ids is nil.
+func (r *Runner) run(ids map[string]struct{}) error {
+	r.RLock()
+	all := r.allPrefixes()
+	excludes, total := r.config.Excludes, len(all)
+	prefixes := make([]*PrefixConfig, 0, total)
+	for _, prefix := range all {
+		if _, ok := ids[prefix.Dependency.String()]; ids == nil || ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	r.RUnlock()
+
+	log.Printf("[INFO] (runner) running (%d of %d prefixes)", len(prefixes), total)
+
+	ctx, span := startSpan(context.Background(), "Run",
+		attribute.Int("prefixes", len(prefixes)))
 
-	prefixes := *r.config.Prefixes
 	doneCh := make(chan struct{}, len(prefixes))
 	errCh := make(chan error, len(prefixes))
 
 	// Replicate each prefix in a goroutine
 	for _, prefix := range prefixes {
-		go r.replicate(prefix, r.config.Excludes, doneCh, errCh)
+		go func(prefix *PrefixConfig) {
+			ctx, span := startSpan(ctx, "replicate", prefixSpanAttributes(prefix)...)
+			prefixDoneCh := make(chan struct{}, 1)
+			prefixErrCh := make(chan error, 1)
+			r.replicate(ctx, prefix, excludes, prefixDoneCh, prefixErrCh)
+
+			select {
+			case <-prefixDoneCh:
+				endSpan(span, nil)
+				doneCh <- struct{}{}
+			case err := <-prefixErrCh:
+				endSpan(span, err)
+				e := newNotifyEvent(NotifyEventPassFailed, prefix)
+				e.Error = err.Error()
+				r.notify.Notify(e)
+				errCh <- err
+			}
+		}(prefix)
 	}
 
 	var errs *multierror.Error
@@ -218,6 +546,7 @@ func (r *Runner) Run() error {
 		}
 	}
 
+	endSpan(span, errs.ErrorOrNil())
 	return errs.ErrorOrNil()
 }
 
@@ -236,6 +565,10 @@ func (r *Runner) init() error {
 	log.Printf("[DEBUG] (runner) final config (tokens suppressed):\n\n%s\n\n",
 		result)
 
+	if err := validatePrefixes(r.config.Prefixes); err != nil {
+		return err
+	}
+
 	// Create the client
 	clients, err := newClientSet(r.config)
 	if err != nil {
@@ -243,17 +576,88 @@ func (r *Runner) init() error {
 	}
 	r.clients = clients
 
+	// Resolve the local datacenter once, for the self-replication check
+	localDatacenter, err := agentDatacenter(clients, r.config.Consul.Retry.RetryFunc())
+	if err != nil {
+		return fmt.Errorf("runner: %s", err)
+	}
+	r.localDatacenter = localDatacenter
+
+	// Refuse to start with prefixes that would delete each other's keys, or
+	// that replicate from the local datacenter into itself
+	if err := checkRunnable(r.config, localDatacenter); err != nil {
+		return fmt.Errorf("runner: invalid configuration: %s", err)
+	}
+
+	// Open the audit log
+	audit, err := newAuditLog(r.config.Audit)
+	if err != nil {
+		return fmt.Errorf("runner: %s", err)
+	}
+	r.audit = audit
+
+	// Start exporting traces, if enabled
+	shutdownTracing, err := setupTracing(r.config.Tracing)
+	if err != nil {
+		r.audit.Close()
+		return fmt.Errorf("runner: %s", err)
+	}
+	r.shutdownTracing = shutdownTracing
+
+	// Start the notifiers
+	notify, err := newNotifiers(r.config.Notifies)
+	if err != nil {
+		r.audit.Close()
+		r.shutdownTracing(context.Background())
+		return fmt.Errorf("runner: %s", err)
+	}
+	r.notify = notify
+
 	// Create the watcher
 	r.watcher = newWatcher(r.config, clients, r.once)
 
 	r.data = make(map[string]*watch.View)
 
+	r.writeLimit = newWriteLimit(config.IntVal(r.config.WriteConcurrency), nil)
+	r.writeRateLimit = newWriteLimit(0, r.config.WriteRateLimit)
+	r.prefixWriteLimits = make(map[string]*prefixWriteLimit)
+	r.indexes = make(map[string]*destinationIndex)
+	r.shards = make(map[string][]*PrefixConfig)
+
 	r.outStream = os.Stdout
 	r.errStream = os.Stderr
 
 	r.ErrCh = make(chan error)
 	r.DoneCh = make(chan struct{})
+	r.reloadCh = make(chan struct{}, 1)
+
+	r.quiescenceMap = make(map[string]*quiescence)
+	r.quiescenceCh = make(chan string)
+
+	return nil
+}
+
+// validatePrefixes ensures each prefix has a valid destination, and that the
+// key file of each encrypted prefix can be loaded.
+func validatePrefixes(prefixes *PrefixConfigs) error {
+	for _, prefix := range *prefixes {
+		if err := validateDestination(prefix); err != nil {
+			return fmt.Errorf("runner: %s: %s", prefix.Dependency, err)
+		}
+		if _, err := prefixKeyring(prefix); err != nil {
+			return fmt.Errorf("runner: %s: %s", prefix.Dependency, err)
+		}
+	}
+	return nil
+}
 
+// validateDestination ensures the destination of the prefix is valid.
+func validateDestination(prefix *PrefixConfig) error {
+	if config.StringVal(prefix.DestinationType) == PrefixTypeFile {
+		if _, err := newFileDestination(prefix.DestinationFile); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -268,152 +672,560 @@ func (r *Runner) get(prefix *PrefixConfig) (*watch.View, bool) {
 // replicate performs replication into the current datacenter from the given
 // prefix. This function is designed to be called via a goroutine since it is
 // expensive and needs to be parallelized.
-func (r *Runner) replicate(prefix *PrefixConfig, excludes *ExcludeConfigs, doneCh chan struct{}, errCh chan error) {
-	// Ensure we are not self-replicating
-	info, err := r.clients.Consul().Agent().Self()
-	if err != nil {
-		errCh <- fmt.Errorf("failed to query agent: %s", err)
-		return
-	}
-	localDatacenter := info["Config"]["Datacenter"].(string)
-	if localDatacenter == config.StringVal(prefix.Datacenter) {
-		errCh <- fmt.Errorf("local datacenter cannot be the source datacenter")
-		return
-	}
+func (r *Runner) replicate(ctx context.Context, prefix *PrefixConfig, excludes *ExcludeConfigs, doneCh chan struct{}, errCh chan error) {
+	fields := prefixLogFields(prefix)
 
 	// Get the last status
+	_, span := startSpan(ctx, "consul.status.get")
 	status, err := r.getStatus(prefix)
+	endSpan(span, err)
 	if err != nil {
 		errCh <- fmt.Errorf("failed to read replication status: %s", err)
 		return
 	}
 
+	// Skip writes while paused; the prefix is still watched and the checkpoint
+	// is left as-is, so the first pass after resuming catches up.
+	_, span = startSpan(ctx, "consul.pause.get")
+	paused, err := r.paused(prefix)
+	endSpan(span, err)
+	if err != nil {
+		errCh <- fmt.Errorf("failed to read pause flag: %s", err)
+		return
+	}
+	if paused {
+		logf(fields, "[INFO] (runner) replication of %q is paused", prefix.Dependency)
+		doneCh <- struct{}{}
+		return
+	}
+
 	// Get the prefix data
 	view, ok := r.get(prefix)
 	if !ok {
-		log.Printf("[INFO] (runner) no data for %q", prefix.Dependency)
+		logf(fields, "[INFO] (runner) no data for %q", prefix.Dependency)
 		doneCh <- struct{}{}
 		return
 	}
 
-	// Get the data from the view
+	dest, err := newDestination(prefix, r.clients)
+	if err != nil {
+		errCh <- fmt.Errorf("failed to create destination: %s", err)
+		return
+	}
+
+	index, err := r.destinationIndex(ctx, prefix, dest)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	if index != nil {
+		index.beginPass()
+		defer index.endPass()
+	}
+
+	keys, err := prefixKeyring(prefix)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	p := &pass{
+		prefix:   prefix,
+		excludes: excludes,
+		status:   status,
+		dest:     dest,
+		index:    index,
+		limits:   r.writeLimits(prefix),
+		keys:     keys,
+		usedKeys: make(map[string]struct{}),
+	}
+
+	// Get the data from the view, which is either the whole prefix, the pages
+	// of a paged prefix, or the shards of a sharded prefix
 	data, lastIndex := view.DataAndLastIndex()
-	pairs, ok := data.([]*dep.KeyPair)
-	if !ok {
+	var pairs []*dep.KeyPair
+	var shardDests []string
+	switch d := data.(type) {
+	case []*dep.KeyPair:
+		pairs = d
+		if err := checkPrefixLimits(prefix, pairs, len(pairs)); err != nil {
+			errCh <- err
+			return
+		}
+		err = r.replicatePairs(ctx, p, pairs, config.StringVal(prefix.Destination), true)
+	case []string:
+		query, ok := prefix.Dependency.(*KVPagesQuery)
+		if !ok {
+			errCh <- fmt.Errorf("could not convert watch data")
+			return
+		}
+		err = r.replicatePages(ctx, p, query, d)
+	case *kvShards:
+		// Only the keys above the shards are replicated, and the destinations
+		// of the shards are left to them
+		shardDests = r.shardDestinations(prefix)
+		if err := checkPrefixLimits(prefix, d.Pairs, len(d.Pairs)); err != nil {
+			errCh <- err
+			return
+		}
+		err = r.replicatePairs(ctx, p, d.Pairs, config.StringVal(prefix.Destination), true)
+	default:
 		errCh <- fmt.Errorf("could not convert watch data")
 		return
 	}
+	sort.Strings(p.updates)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("source.index", int64(lastIndex)),
+		attribute.Int("source.keys", len(p.usedKeys)),
+	)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	updates, unchanged := p.updates, p.unchanged
 
-	kv := r.clients.Consul().KV()
+	// Handle deletes
+	deletes, err := pruneDestination(ctx, prefix, excludes, dest, index, p.usedKeys, shardDests, r.audit, p.limits)
+	if err != nil {
+		var guard *deleteGuardError
+		if errors.As(err, &guard) {
+			logf(fields.with("error", err.Error()),
+				"[ERR] (runner) not deleting from %q: %s", prefix.Dependency, err)
+
+			e := newNotifyEvent(NotifyEventDeleteGuard, prefix)
+			e.Updates, e.Deletes, e.Unchanged = len(updates), guard.deletes, unchanged
+			e.Error = err.Error()
+			r.notify.Notify(e)
+		}
+		errCh <- err
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("updates", len(updates)),
+		attribute.Int("deletes", len(deletes)),
+		attribute.Int("unchanged", unchanged),
+	)
 
-	// Update keys to the most recent versions
-	updates := 0
-	usedKeys := make(map[string]struct{}, len(pairs))
-	for _, pair := range pairs {
-		key := config.StringVal(prefix.Destination) +
-			strings.TrimPrefix(pair.Path, config.StringVal(prefix.Source))
-		usedKeys[key] = struct{}{}
+	// Update our status
+	status.LastReplicated = lastIndex
+	status.Source = config.StringVal(prefix.Source)
+	status.Destination = config.StringVal(prefix.Destination)
+	_, span = startSpan(ctx, "consul.status.set")
+	err = r.setStatus(prefix, status)
+	endSpan(span, err)
+	if err != nil {
+		if err != errStatusChanged {
+			errCh <- fmt.Errorf("failed to checkpoint status: %s", err)
+			return
+		}
+		logf(fields.with("error", err.Error()),
+			"[WARN] (runner) not checkpointing %q: %s", prefix.Dependency, err)
 
-		// Ignore if the key falls under an excluded prefix
-		if len(*excludes) > 0 {
-			excluded := false
-			for _, exclude := range *excludes {
-				if strings.HasPrefix(pair.Path, config.StringVal(exclude.Source)) {
-					log.Printf("[DEBUG] (runner) key %q has prefix %q, excluding",
-						pair.Path, config.StringVal(exclude.Source))
-					excluded = true
-				}
-			}
+		e := newNotifyEvent(NotifyEventConflict, prefix)
+		e.Updates, e.Deletes, e.Unchanged = len(updates), len(deletes), unchanged
+		e.Error = err.Error()
+		r.notify.Notify(e)
+	}
 
-			if excluded {
-				continue
+	if len(updates) == 0 && len(deletes) == 0 && unchanged > 0 {
+		logf(fields, "[INFO] (runner) skipped %d unchanged keys", unchanged)
+	}
+
+	if len(updates) > 0 || len(deletes) > 0 {
+		logf(fields, "[INFO] (runner) replicated %d updates, %d deletes, %d unchanged",
+			len(updates), len(deletes), unchanged)
+
+		e := newNotifyEvent(NotifyEventPassCompleted, prefix)
+		e.Updates, e.Deletes, e.Unchanged = len(updates), len(deletes), unchanged
+		r.notify.Notify(e)
+
+		// Paged and sharded prefixes are never held in memory as a whole, so
+		// they have no history. Encrypted prefixes have none either, since it
+		// would store their values in plaintext.
+		if pairs != nil && prefix.shardOf == nil && encryptMode(prefix, keys) != EncryptModeEncrypt {
+			_, span = startSpan(ctx, "history.record")
+			err := r.recordHistory(prefix, pairs, excludes, lastIndex)
+			endSpan(span, err)
+			if err != nil {
+				logf(fields.with("error", err.Error()),
+					"[WARN] (runner) failed to record history for %q: %s", prefix.Dependency, err)
 			}
 		}
 
+		// Run the command last, so it sees the checkpointed destination
+		_, span = startSpan(ctx, "command")
+		err = r.runCommand(prefix, updates, deletes)
+		endSpan(span, err)
+		if err != nil {
+			logf(fields.with("error", err.Error()),
+				"[ERR] (runner) command for %q failed: %s", prefix.Dependency, err)
+			errCh <- err
+			return
+		}
+	}
+
+	// We are done!
+	doneCh <- struct{}{}
+}
+
+// pass is the state of a single replication pass of a prefix.
+type pass struct {
+	prefix   *PrefixConfig
+	excludes *ExcludeConfigs
+	status   *Status
+	dest     destination
+	index    *destinationIndex
+	limits   writeLimits
+
+	// keys are the keys that encrypt or decrypt the values, or nil.
+	keys *keyring
+
+	// usedKeys are the destination keys of every source key read so far.
+	usedKeys map[string]struct{}
+
+	// updates are the keys written and unchanged is the number of writes
+	// skipped because the destination already matched.
+	updates   []string
+	unchanged int
+}
+
+// replicatePairs writes the pairs of a single listing of the source, either the
+// whole prefix or one page of a paged prefix, whose destination keys begin
+// with destPrefix. If list is false, as for a batch of keys that do not share a
+// prefix, the pairs are never compared with a listing of the destination.
+func (r *Runner) replicatePairs(ctx context.Context, p *pass, pairs []*dep.KeyPair, destPrefix string, list bool) error {
+	prefix := p.prefix
+	fields := prefixLogFields(prefix)
+
+	// Find the keys to update to the most recent versions
+	var writes []*dep.KeyPair
+	for _, pair := range pairs {
+		key := destinationKey(prefix, pair.Path)
+		p.usedKeys[key] = struct{}{}
+		keyFields := fields.with("key", key)
+
+		// Ignore if the key falls under an excluded prefix
+		if exclude, ok := excludedBy(pair.Path, p.excludes); ok {
+			logf(keyFields.with("operation", "exclude"),
+				"[DEBUG] (runner) key %q has prefix %q, excluding", pair.Path, exclude)
+			continue
+		}
+
 		// Ignore if the modify index is old
-		if pair.ModifyIndex <= status.LastReplicated {
-			log.Printf("[DEBUG] (runner) skipping because %q is already "+
-				"replicated", key)
+		if pair.ModifyIndex <= p.status.LastReplicated {
+			logf(keyFields.with("operation", "skip"),
+				"[DEBUG] (runner) skipping because %q is already replicated", key)
 			continue
 		}
 
 		// Check if lock
 		if pair.Flags == api.SemaphoreFlagValue {
-			log.Printf("[WARN] (runner) lock in use at %q, but sessions cannot be "+
+			logf(keyFields, "[WARN] (runner) lock in use at %q, but sessions cannot be "+
 				"replicated across datacenters", key)
 		}
 
 		// Check if semaphore
 		if pair.Flags == api.LockFlagValue {
-			log.Printf("[WARN] (runner) semaphore in use at %q, but sessions cannot "+
+			logf(keyFields, "[WARN] (runner) semaphore in use at %q, but sessions cannot "+
 				"be replicated across datacenters", key)
 		}
 
 		// Check if session attached
 		if pair.Session != "" {
-			log.Printf("[WARN] (runner) %q has attached session, but sessions "+
+			logf(keyFields, "[WARN] (runner) %q has attached session, but sessions "+
 				"cannot be replicated across datacenters", key)
 		}
 
-		if _, err := kv.Put(&api.KVPair{
-			Key:   key,
-			Flags: pair.Flags,
-			Value: []byte(pair.Value),
-		}, nil); err != nil {
-			errCh <- fmt.Errorf("failed to write %q: %s", key, err)
-			return
+		writes = append(writes, pair)
+	}
+
+	// Decrypt, compress, or decompress the values as they are written. Keys
+	// that cannot be decoded are skipped until their value changes, and are
+	// left as they are in the destination.
+	writes, failures := encodePairs(prefix, p.keys, writes)
+	for _, f := range failures {
+		key := destinationKey(prefix, f.pair.Path)
+		logf(fields.with("key", key).with("error", f.err.Error()),
+			"[ERR] (runner) skipping %q: failed to decode: %s", key, f.err)
+		if aerr := r.audit.Record(AuditOperationPut, config.StringVal(prefix.Datacenter),
+			f.pair.Path, f.pair.ModifyIndex, key, []byte(f.pair.Value),
+			fmt.Errorf("failed to decode: %s", f.err)); aerr != nil {
+			return aerr
 		}
-		log.Printf("[DEBUG] (runner) updated key %q", key)
-		updates++
 	}
 
-	// Handle deletes
-	deletes := 0
-	localKeys, _, err := kv.Keys(config.StringVal(prefix.Destination), "", nil)
+	// Skip writes whose value and flags already match the destination after
+	// the checkpoint is reset, so the destination's modify indexes are not
+	// bumped. Listing reads every value under the destination, so it is only
+	// worth it when most keys are written again.
+	if list && bulkCompare(p.status, len(writes)) {
+		_, span := startSpan(ctx, "destination.list")
+		existing, err := p.dest.List(destPrefix)
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to list destination: %s", err)
+		}
+		var unchanged int
+		writes, unchanged = changedPairs(prefix, writes, openExisting(prefix, p.keys, existing))
+		p.unchanged += unchanged
+
+		// The list is fresher than the index, so use it to catch up
+		if p.index != nil {
+			keys := make([]string, 0, len(existing))
+			for key := range existing {
+				keys = append(keys, key)
+			}
+			p.index.replacePrefix(destPrefix, keys)
+		}
+	}
+
+	// Encrypt the values last, since each encryption gives a different value
+	writes, err := sealPairs(prefix, p.keys, writes)
 	if err != nil {
-		errCh <- fmt.Errorf("failed to list keys: %s", err)
-		return
+		return err
 	}
-	for _, key := range localKeys {
-		excluded := false
 
-		// Ignore if the key falls under an excluded prefix
-		if len(*excludes) > 0 {
-			sourceKey := strings.Replace(key, config.StringVal(prefix.Destination), config.StringVal(prefix.Source), -1)
-			for _, exclude := range *excludes {
-				if strings.HasPrefix(sourceKey, config.StringVal(exclude.Source)) {
-					log.Printf("[DEBUG] (runner) key %q has prefix %q, excluding from deletes",
-						sourceKey, *exclude.Source)
-					excluded = true
+	// Update keys, within the write limits
+	updates, err := r.putKeys(ctx, prefix, p.dest, writes, p.limits)
+	if p.index != nil {
+		p.index.add(updates...)
+	}
+	p.updates = append(p.updates, updates...)
+	return err
+}
+
+// bulkCompareMinWrites is the number of writes in a single listing above which
+// the destination is listed to skip unchanged writes, even if the checkpoint
+// was not reset.
+const bulkCompareMinWrites = 1000
+
+// bulkCompare returns true if the destination should be listed to skip the
+// given number of writes that are unchanged, because the checkpoint was reset
+// or there are many writes.
+func bulkCompare(status *Status, writes int) bool {
+	if writes == 0 {
+		return false
+	}
+	return status.LastReplicated == 0 || writes > bulkCompareMinWrites
+}
+
+// changedPairs returns the pairs whose value or flags differ from the existing
+// keys in the prefix's destination, and the number of pairs that are unchanged.
+func changedPairs(prefix *PrefixConfig, pairs []*dep.KeyPair, existing map[string]*destinationPair) ([]*dep.KeyPair, int) {
+	fields := prefixLogFields(prefix)
+	changed := make([]*dep.KeyPair, 0, len(pairs))
+	for _, pair := range pairs {
+		key := destinationKey(prefix, pair.Path)
+		if existing[key].unchanged(pair) {
+			logf(fields.with("key", key).with("operation", "unchanged"),
+				"[DEBUG] (runner) skipping because %q is unchanged", key)
+			continue
+		}
+		changed = append(changed, pair)
+	}
+	return changed, len(pairs) - len(changed)
+}
+
+// putKeys writes the pairs to the prefix's destination using up to the
+// prefix's write concurrency, within the given limits. Each write is recorded
+// in the audit log. It returns the keys written, and stops at the first error.
+func (r *Runner) putKeys(ctx context.Context, prefix *PrefixConfig, dest destination, pairs []*dep.KeyPair, limits writeLimits) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := config.IntVal(prefix.WriteConcurrency)
+	if workers > len(pairs) {
+		workers = len(pairs)
+	}
+
+	var lock sync.Mutex
+	var updates []string
+	var firstErr error
+
+	var wg sync.WaitGroup
+	pairCh := make(chan *dep.KeyPair)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range pairCh {
+				key, err := r.putKey(ctx, prefix, dest, pair, limits)
+
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				} else if err == nil {
+					updates = append(updates, key)
 				}
+				lock.Unlock()
 			}
+		}()
+	}
+
+FEED:
+	for _, pair := range pairs {
+		select {
+		case pairCh <- pair:
+		case <-ctx.Done():
+			break FEED
+		}
+	}
+	close(pairCh)
+	wg.Wait()
+
+	sort.Strings(updates)
+	return updates, firstErr
+}
+
+// putKey writes a single pair to the prefix's destination once the limits
+// allow it, and returns the destination key.
+func (r *Runner) putKey(ctx context.Context, prefix *PrefixConfig, dest destination, pair *dep.KeyPair, limits writeLimits) (string, error) {
+	key := destinationKey(prefix, pair.Path)
+	keyFields := prefixLogFields(prefix).with("key", key)
+
+	if err := limits.acquire(ctx); err != nil {
+		return key, err
+	}
+	_, span := startSpan(ctx, "destination.put", attribute.String("key", key))
+	err := dest.Put(key, pair.Flags, []byte(pair.Value))
+	endSpan(span, err)
+	limits.release()
+
+	if aerr := r.audit.Record(AuditOperationPut, config.StringVal(prefix.Datacenter),
+		pair.Path, pair.ModifyIndex, key, []byte(pair.Value), err); aerr != nil {
+		return key, aerr
+	}
+	if err != nil {
+		logf(keyFields.with("operation", "put").with("error", err.Error()),
+			"[ERR] (runner) failed to write %q: %s", key, err)
+		return key, fmt.Errorf("failed to write %q: %s", key, err)
+	}
+	logf(keyFields.with("operation", "put"), "[DEBUG] (runner) updated key %q", key)
+	return key, nil
+}
+
+// deleteGuardError is returned when a pass would delete more keys than the
+// max_deletes of the prefix, in which case none of them are deleted.
+type deleteGuardError struct {
+	deletes, max int
+}
+
+func (e *deleteGuardError) Error() string {
+	return fmt.Sprintf("refusing to delete %d keys, more than max_deletes of %d",
+		e.deletes, e.max)
+}
+
+// pruneDestination deletes the keys under the prefix's destination that are not
+// in usedKeys and do not fall under an excluded prefix or one of the owned
+// destination prefixes, within the given limits, recording each delete in the
+// audit log. The keys are taken from the index, if given, which then records
+// usedKeys as the last source view, and listed from the destination otherwise. If there are more keys to delete than the prefix's
+// max_deletes, none are deleted and a *deleteGuardError is returned. It returns
+// the keys deleted.
+func pruneDestination(ctx context.Context, prefix *PrefixConfig, excludes *ExcludeConfigs, dest destination, index *destinationIndex, usedKeys map[string]struct{}, owned []string, audit *auditLog, limits writeLimits) ([]string, error) {
+	fields := prefixLogFields(prefix)
+	var deletes []string
+	var localKeys []string
+	if index != nil {
+		localKeys = index.deletes(usedKeys)
+	} else {
+		_, span := startSpan(ctx, "destination.keys")
+		keys, err := dest.Keys(config.StringVal(prefix.Destination))
+		endSpan(span, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list keys: %s", err)
+		}
+		localKeys = keys
+	}
+
+	// Find every key to delete first, so the guard applies to the whole pass
+	var candidates []string
+	for _, key := range localKeys {
+		// Ignore if the key is replicated by another prefix, such as a shard
+		if ownedBy(key, owned) {
+			continue
+		}
+
+		// Ignore if the key falls under an excluded prefix
+		sourceKey := strings.Replace(key, config.StringVal(prefix.Destination), config.StringVal(prefix.Source), -1)
+		exclude, excluded := excludedBy(sourceKey, excludes)
+		if excluded {
+			logf(fields.with("key", key).with("operation", "exclude"),
+				"[DEBUG] (runner) key %q has prefix %q, excluding from deletes",
+				sourceKey, exclude)
 		}
 
 		if _, ok := usedKeys[key]; !ok && !excluded {
-			if _, err := kv.Delete(key, nil); err != nil {
-				errCh <- fmt.Errorf("failed to delete %q: %s", key, err)
-				return
-			}
-			log.Printf("[DEBUG] (runner) deleted %q", key)
-			deletes++
+			candidates = append(candidates, key)
 		}
 	}
 
-	// Update our status
-	status.LastReplicated = lastIndex
-	status.Source = config.StringVal(prefix.Source)
-	status.Destination = config.StringVal(prefix.Destination)
-	if err := r.setStatus(prefix, status); err != nil {
-		errCh <- fmt.Errorf("failed to checkpoint status: %s", err)
-		return
+	if max := config.IntVal(prefix.MaxDeletes); max > 0 && len(candidates) > max {
+		return nil, &deleteGuardError{deletes: len(candidates), max: max}
+	}
+
+	for _, key := range candidates {
+		sourceKey := strings.Replace(key, config.StringVal(prefix.Destination), config.StringVal(prefix.Source), -1)
+		if err := limits.acquire(ctx); err != nil {
+			return deletes, err
+		}
+		_, span := startSpan(ctx, "destination.delete", attribute.String("key", key))
+		err := dest.Delete(key)
+		endSpan(span, err)
+		limits.release()
+		if aerr := audit.Record(AuditOperationDelete, config.StringVal(prefix.Datacenter),
+			sourceKey, 0, key, nil, err); aerr != nil {
+			return deletes, aerr
+		}
+		if err != nil {
+			logf(fields.with("key", key).with("operation", "delete").with("error", err.Error()),
+				"[ERR] (runner) failed to delete %q: %s", key, err)
+			return deletes, fmt.Errorf("failed to delete %q: %s", key, err)
+		}
+		logf(fields.with("key", key).with("operation", "delete"),
+			"[DEBUG] (runner) deleted %q", key)
+		if index != nil {
+			index.remove(key)
+		}
+		deletes = append(deletes, key)
 	}
+	if index != nil {
+		index.commit(usedKeys, owned)
+	}
+	return deletes, nil
+}
 
-	if updates > 0 || deletes > 0 {
-		log.Printf("[INFO] (runner) replicated %d updates, %d deletes", updates, deletes)
+// ownedBy returns true if the given destination key falls under one of the
+// owned prefixes.
+func ownedBy(key string, owned []string) bool {
+	for _, prefix := range owned {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	// We are done!
-	doneCh <- struct{}{}
+// destinationKey returns the key that the given source path is replicated to
+// for the prefix.
+func destinationKey(prefix *PrefixConfig, path string) string {
+	return config.StringVal(prefix.Destination) +
+		strings.TrimPrefix(path, config.StringVal(prefix.Source))
+}
+
+// excludedBy returns the first excluded prefix that the given source path
+// falls under, if any.
+func excludedBy(path string, excludes *ExcludeConfigs) (string, bool) {
+	if excludes == nil {
+		return "", false
+	}
+	for _, exclude := range *excludes {
+		if strings.HasPrefix(path, config.StringVal(exclude.Source)) {
+			return config.StringVal(exclude.Source), true
+		}
+	}
+	return "", false
 }
 
 // getStatus is used to read the last replication status.
@@ -429,11 +1241,13 @@ func (r *Runner) getStatus(prefix *PrefixConfig) (*Status, error) {
 		if err := json.Unmarshal(pair.Value, &status); err != nil {
 			return nil, err
 		}
+		status.modifyIndex = pair.ModifyIndex
 	}
 	return status, nil
 }
 
-// setStatus is used to update the last replication status.
+// setStatus is used to update the last replication status. If the status was
+// modified since it was read, errStatusChanged is returned.
 func (r *Runner) setStatus(prefix *PrefixConfig, status *Status) error {
 	// Encode the JSON as pretty so operators can easily view it in the Consul UI.
 	enc, err := json.MarshalIndent(status, "", "  ")
@@ -441,20 +1255,39 @@ func (r *Runner) setStatus(prefix *PrefixConfig, status *Status) error {
 		return err
 	}
 
-	// Put the key to Consul.
+	// Put the key to Consul, only if it has not changed since it was read.
 	kv := r.clients.Consul().KV()
-	_, err = kv.Put(&api.KVPair{
-		Key:   r.statusPath(prefix),
-		Value: enc,
+	ok, _, err := kv.CAS(&api.KVPair{
+		Key:         r.statusPath(prefix),
+		Value:       enc,
+		ModifyIndex: status.modifyIndex,
 	}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errStatusChanged
+	}
+	return nil
+}
+
+// deleteStatus deletes the last replication status of the prefix.
+func (r *Runner) deleteStatus(prefix *PrefixConfig) error {
+	kv := r.clients.Consul().KV()
+	_, err := kv.Delete(r.statusPath(prefix), nil)
 	return err
 }
 
 func (r *Runner) statusPath(prefix *PrefixConfig) string {
+	return strings.TrimRight(config.StringVal(r.config.StatusDir), "/") + "/" + statusID(prefix)
+}
+
+// statusID returns the unique identifier used to store information about the
+// given prefix.
+func statusID(prefix *PrefixConfig) string {
 	plain := fmt.Sprintf("%s-%s", config.StringVal(prefix.Source), config.StringVal(prefix.Destination))
 	hash := md5.Sum([]byte(plain))
-	enc := hex.EncodeToString(hash[:])
-	return strings.TrimRight(config.StringVal(r.config.StatusDir), "/") + "/" + enc
+	return hex.EncodeToString(hash[:])
 }
 
 // storePid is used to write out a PID file to disk.
@@ -477,13 +1310,14 @@ func (r *Runner) storePid() error {
 	if err != nil {
 		return fmt.Errorf("runner: could not write to pid file: %s", err)
 	}
+	r.pidStored = true
 	return nil
 }
 
 // deletePid is used to remove the PID on exit.
 func (r *Runner) deletePid() error {
 	path := config.StringVal(r.config.PidFile)
-	if path == "" {
+	if path == "" || !r.pidStored {
 		return nil
 	}
 
@@ -504,6 +1338,28 @@ func (r *Runner) deletePid() error {
 	return nil
 }
 
+// agentDatacenter returns the datacenter of the local Consul agent. Failed
+// queries are retried according to retry, which may be nil to not retry.
+func agentDatacenter(clients *dep.ClientSet, retry config.RetryFunc) (string, error) {
+	for attempt := 0; ; attempt++ {
+		info, err := clients.Consul().Agent().Self()
+		if err == nil {
+			dc, _ := info["Config"]["Datacenter"].(string)
+			return dc, nil
+		}
+
+		if retry == nil {
+			return "", fmt.Errorf("failed to query agent: %s", err)
+		}
+		ok, wait := retry(attempt)
+		if !ok {
+			return "", fmt.Errorf("failed to query agent: %s", err)
+		}
+		log.Printf("[WARN] (runner) failed to query agent, retrying in %s: %s", wait, err)
+		time.Sleep(wait)
+	}
+}
+
 // newClientSet creates a new client set from the given config.
 func newClientSet(c *Config) (*dep.ClientSet, error) {
 	clients := dep.NewClientSet()
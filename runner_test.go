@@ -0,0 +1,358 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/watch"
+)
+
+func TestReloadable(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		f    func(*Config)
+		e    bool
+	}{
+		{
+			"unchanged",
+			func(c *Config) {},
+			true,
+		},
+		{
+			"prefixes",
+			func(c *Config) {
+				p, err := ParsePrefixConfig("other@dc2")
+				if err != nil {
+					t.Fatal(err)
+				}
+				*c.Prefixes = append(*c.Prefixes, p)
+			},
+			true,
+		},
+		{
+			"excludes",
+			func(c *Config) {
+				*c.Excludes = append(*c.Excludes, &ExcludeConfig{Source: config.String("foo/bar")})
+			},
+			true,
+		},
+		{
+			"status_dir",
+			func(c *Config) {
+				c.StatusDir = config.String("other/status")
+			},
+			false,
+		},
+		{
+			"wait",
+			func(c *Config) {
+				c.Wait.Min = config.TimeDuration(10 * time.Second)
+			},
+			false,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			a := DefaultConfig()
+			p, err := ParsePrefixConfig("global@dc1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			*a.Prefixes = append(*a.Prefixes, p)
+			a.Finalize()
+
+			b := a.Copy()
+			tc.f(b)
+			b.Finalize()
+
+			if r := reloadable(a, b); r != tc.e {
+				t.Errorf("expected %t to be %t", r, tc.e)
+			}
+		})
+	}
+}
+
+func TestAgentDatacenter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/self" {
+			http.NotFound(w, r)
+			return
+		}
+		// Fail the first query, so it must be retried
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"Config": {"Datacenter": "dc2"}}`)
+	}))
+	defer srv.Close()
+
+	c := DefaultConfig()
+	c.Consul.Address = config.String(strings.TrimPrefix(srv.URL, "http://"))
+	c.Finalize()
+	clients, err := newClientSet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := agentDatacenter(clients, nil); err == nil {
+		t.Fatal("expected error")
+	}
+
+	retry := func(int) (bool, time.Duration) { return true, 0 }
+	dc, err := agentDatacenter(clients, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc != "dc2" {
+		t.Errorf("\nexp: %#v\nact: %#v", "dc2", dc)
+	}
+}
+
+func TestBulkCompare(t *testing.T) {
+	cases := []struct {
+		name           string
+		lastReplicated uint64
+		writes         int
+		exp            bool
+	}{
+		{
+			"no_writes",
+			0,
+			0,
+			false,
+		},
+		{
+			"reset",
+			0,
+			1,
+			true,
+		},
+		{
+			"few_writes",
+			10,
+			1,
+			false,
+		},
+		{
+			"many_writes",
+			10,
+			bulkCompareMinWrites + 1,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			act := bulkCompare(&Status{LastReplicated: tc.lastReplicated}, tc.writes)
+			if act != tc.exp {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestChangedPairs(t *testing.T) {
+	prefix := &PrefixConfig{
+		Destination: config.String("default"),
+		Source:      config.String("global"),
+	}
+
+	var flags uint64
+	existing := map[string]*destinationPair{
+		"default/same":  {Value: []byte("same"), Flags: &flags},
+		"default/value": {Value: []byte("old"), Flags: &flags},
+	}
+	pairs := []*dep.KeyPair{
+		{Path: "global/same", Value: "same"},
+		{Path: "global/value", Value: "new"},
+		{Path: "global/missing", Value: "missing"},
+	}
+
+	changed, unchanged := changedPairs(prefix, pairs, existing)
+	if exp := pairs[1:]; !reflect.DeepEqual(exp, changed) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, changed)
+	}
+	if unchanged != 1 {
+		t.Errorf("\nexp: %#v\nact: %#v", 1, unchanged)
+	}
+}
+
+func TestRunner_paused(t *testing.T) {
+	c := DefaultConfig()
+	c.Finalize()
+
+	prefix, err := ParsePrefixConfig("global@dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix.Finalize()
+	other, err := ParsePrefixConfig("other@dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Finalize()
+
+	r := &Runner{config: c, data: make(map[string]*watch.View)}
+	data := map[string]string{r.pausePath(prefix): "2026-10-18T00:00:00Z"}
+	r.clients = newTestKVServer(t, data)
+
+	pauses, err := dep.NewKVListQuery(r.pauseDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.pauses = pauses
+
+	w := newWatcher(c, r.clients, true)
+	defer w.Stop()
+	if _, err := w.Add(pauses); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case view := <-w.DataCh():
+		r.Receive(view)
+	case err := <-w.ErrCh():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the pause flags")
+	}
+
+	// The watched flags are used rather than reading the flag again
+	delete(data, r.pausePath(prefix))
+	for p, exp := range map[*PrefixConfig]bool{prefix: true, other: false} {
+		act, err := r.paused(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act != exp {
+			t.Errorf("%s: expected %t to be %t", p.Dependency, act, exp)
+		}
+	}
+}
+
+func TestRunner_recordHistory_TooLarge(t *testing.T) {
+	clients := newTestKVServer(t, map[string]string{})
+
+	c := DefaultConfig().Merge(&Config{
+		History: &HistoryConfig{Enabled: config.Bool(true)},
+	})
+	c.Finalize()
+	prefix, err := ParsePrefixConfig("global@dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix.Finalize()
+	r := &Runner{config: c, clients: clients}
+
+	// The test server accepts no writes, so storing the version would fail
+	pairs := []*dep.KeyPair{{
+		Path:  "global/large",
+		Key:   "large",
+		Value: strings.Repeat("x", maxHistoryValueBytes),
+	}}
+	if err := r.recordHistory(prefix, pairs, DefaultExcludeConfigs(), 10); err != nil {
+		t.Errorf("expected the version to be skipped, got %s", err)
+	}
+}
+
+func TestRunner_deletePid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pid")
+	if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := DefaultConfig().Merge(&Config{PidFile: config.String(path)})
+	c.Finalize()
+	r := &Runner{config: c}
+
+	// A runner that was never started, such as for the pause command, leaves
+	// the pid file of the running daemon alone
+	if err := r.deletePid(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the pid file to be kept: %s", err)
+	}
+
+	if err := r.storePid(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.deletePid(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected the pid file to be removed")
+	}
+}
+
+func TestPruneDestination_MaxDeletes(t *testing.T) {
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(t.TempDir()),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/a", "default/b", "default/c"} {
+		if err := dest.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := &PrefixConfig{
+		Destination:     config.String("default/"),
+		DestinationType: config.String(PrefixTypeFile),
+		MaxDeletes:      config.Int(1),
+		Source:          config.String("global/"),
+	}
+	usedKeys := map[string]struct{}{"default/a": {}}
+
+	// A pass that would delete more than max_deletes deletes nothing
+	deletes, err := pruneDestination(context.Background(), prefix,
+		DefaultExcludeConfigs(), dest, nil, usedKeys, nil, nil, nil)
+	var guard *deleteGuardError
+	if !errors.As(err, &guard) || guard.deletes != 2 {
+		t.Fatalf("expected a delete guard error, got %v", err)
+	}
+	if len(deletes) != 0 {
+		t.Errorf("expected no deletes, got %#v", deletes)
+	}
+	keys, err := dest.Keys("default/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected every key to be kept, got %#v", keys)
+	}
+
+	prefix.MaxDeletes = config.Int(2)
+	deletes, err = pruneDestination(context.Background(), prefix,
+		DefaultExcludeConfigs(), dest, nil, usedKeys, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deletes)
+	if exp := []string{"default/b", "default/c"}; !reflect.DeepEqual(exp, deletes) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, deletes)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// SnapshotVersion is the version of the snapshot format written by export.
+// Snapshots with a newer version cannot be imported.
+const SnapshotVersion = 1
+
+// Snapshot is a portable, point-in-time copy of one or more prefixes that can
+// be used to seed a datacenter offline.
+type Snapshot struct {
+	// Version is the version of the snapshot format.
+	Version int
+
+	// Created is the time the snapshot was exported.
+	Created time.Time
+
+	// Prefixes are the exported prefixes.
+	Prefixes []*SnapshotPrefix
+}
+
+// SnapshotPrefix is the data for a single prefix in a snapshot.
+type SnapshotPrefix struct {
+	// Source, Datacenter and Destination are the prefix the data was exported
+	// from and where it is imported to by default.
+	Source, Datacenter, Destination string
+
+	// LastIndex is the index of the source data at the time of export.
+	LastIndex uint64
+
+	// Pairs are the non-excluded keys under the source prefix.
+	Pairs []*SnapshotPair
+}
+
+// SnapshotPair is a single key in a snapshot. The value is base64 encoded
+// when marshaled to JSON.
+type SnapshotPair struct {
+	// Key is the full path of the key in the source.
+	Key   string
+	Flags uint64
+	Value []byte
+}
+
+// exportSnapshot fetches the current data for each prefix from its source,
+// skipping any excluded keys, and returns the result as a snapshot.
+func exportSnapshot(prefixes *PrefixConfigs, excludes *ExcludeConfigs, clients *dep.ClientSet, allowStale bool) (*Snapshot, error) {
+	s := &Snapshot{
+		Version:  SnapshotVersion,
+		Created:  time.Now().UTC(),
+		Prefixes: make([]*SnapshotPrefix, 0, len(*prefixes)),
+	}
+
+	for _, prefix := range *prefixes {
+		data, rm, err := prefix.Dependency.Fetch(clients, &dep.QueryOptions{
+			AllowStale: allowStale,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", prefix.Dependency, err)
+		}
+
+		var pairs []*dep.KeyPair
+		switch d := data.(type) {
+		case []*dep.KeyPair:
+			pairs = d
+		case []string:
+			query, ok := prefix.Dependency.(*KVPagesQuery)
+			if !ok {
+				return nil, fmt.Errorf("could not convert data for %s", prefix.Dependency)
+			}
+			pairs, err = query.FetchAll(clients, &dep.QueryOptions{
+				AllowStale: allowStale,
+			}, d)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %s", prefix.Dependency, err)
+			}
+		case *kvShards:
+			pairs = d.Pairs
+			for _, subtree := range d.Shards {
+				shard, err := newShardPrefix(prefix, subtree)
+				if err != nil {
+					return nil, err
+				}
+				data, _, err := shard.Dependency.Fetch(clients, &dep.QueryOptions{
+					AllowStale: allowStale,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s: %s", shard.Dependency, err)
+				}
+				shardPairs, ok := data.([]*dep.KeyPair)
+				if !ok {
+					return nil, fmt.Errorf("could not convert data for %s", shard.Dependency)
+				}
+				pairs = append(pairs, shardPairs...)
+			}
+		default:
+			return nil, fmt.Errorf("could not convert data for %s", prefix.Dependency)
+		}
+
+		sp := newSnapshotPrefix(prefix, pairs, excludes, rm.LastIndex)
+		log.Printf("[INFO] (snapshot) exported %d keys from %s",
+			len(sp.Pairs), prefix.Dependency)
+		s.Prefixes = append(s.Prefixes, sp)
+	}
+
+	return s, nil
+}
+
+// newSnapshotPrefix creates the snapshot of a prefix from the given source
+// data, skipping any excluded keys.
+func newSnapshotPrefix(prefix *PrefixConfig, pairs []*dep.KeyPair, excludes *ExcludeConfigs, lastIndex uint64) *SnapshotPrefix {
+	sp := &SnapshotPrefix{
+		Source:      config.StringVal(prefix.Source),
+		Datacenter:  config.StringVal(prefix.Datacenter),
+		Destination: config.StringVal(prefix.Destination),
+		LastIndex:   lastIndex,
+		Pairs:       make([]*SnapshotPair, 0, len(pairs)),
+	}
+
+	for _, pair := range pairs {
+		if exclude, ok := excludedBy(pair.Path, excludes); ok {
+			log.Printf("[DEBUG] (snapshot) key %q has prefix %q, excluding",
+				pair.Path, exclude)
+			continue
+		}
+
+		sp.Pairs = append(sp.Pairs, &SnapshotPair{
+			Key:   pair.Path,
+			Flags: pair.Flags,
+			Value: []byte(pair.Value),
+		})
+	}
+
+	return sp
+}
+
+// importSnapshot writes the keys of each prefix in the snapshot to the local
+// Consul KV store, rewriting them to the prefix's destination in the same way
+// as replication. If destination is not empty, it overrides the destination
+// stored in the snapshot. Values are compressed and encrypted in the same way
+// as the matching configured prefix, if any. Excluded keys are skipped. Keys
+// that exist in the destination but not in the snapshot are left untouched.
+func importSnapshot(s *Snapshot, destination string, prefixes *PrefixConfigs, excludes *ExcludeConfigs, clients *dep.ClientSet) error {
+	if s.Version < 1 || s.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	if destination != "" && len(s.Prefixes) > 1 {
+		return fmt.Errorf("cannot override the destination of a snapshot " +
+			"with multiple prefixes")
+	}
+
+	for _, sp := range s.Prefixes {
+		prefix := importPrefix(sp, destination, prefixes)
+
+		dest, err := newDestination(prefix, clients)
+		if err != nil {
+			return err
+		}
+
+		keys, err := prefixKeyring(prefix)
+		if err != nil {
+			return err
+		}
+
+		imported := 0
+		for _, pair := range sp.Pairs {
+			if exclude, ok := excludedBy(pair.Key, excludes); ok {
+				log.Printf("[DEBUG] (snapshot) key %q has prefix %q, excluding",
+					pair.Key, exclude)
+				continue
+			}
+
+			key := destinationKey(prefix, pair.Key)
+			value, err := encodeValue(prefix, keys, pair.Key, pair.Value)
+			if err != nil {
+				return fmt.Errorf("failed to encode %q: %s", pair.Key, err)
+			}
+			if err := dest.Put(key, pair.Flags, value); err != nil {
+				return fmt.Errorf("failed to write %q: %s", key, err)
+			}
+			log.Printf("[DEBUG] (snapshot) imported key %q", key)
+			imported++
+		}
+
+		log.Printf("[INFO] (snapshot) imported %d keys into %q",
+			imported, config.StringVal(prefix.Destination))
+	}
+
+	return nil
+}
+
+// importPrefix returns the prefix that the keys of the snapshot prefix are
+// imported with: the configured prefix with the same source, or else with the
+// same destination, so that its destination type, compression and encryption
+// apply. Without one, keys are written to Consul KV as they are.
+func importPrefix(sp *SnapshotPrefix, destination string, prefixes *PrefixConfigs) *PrefixConfig {
+	if destination == "" {
+		destination = sp.Destination
+	}
+
+	var match *PrefixConfig
+	if prefixes != nil {
+		for _, p := range *prefixes {
+			if config.StringVal(p.Source) == sp.Source &&
+				config.StringVal(p.Datacenter) == sp.Datacenter {
+				match = p
+				break
+			}
+		}
+		if match == nil {
+			for _, p := range *prefixes {
+				if config.StringVal(p.Destination) == destination {
+					match = p
+					break
+				}
+			}
+		}
+	}
+
+	if match != nil {
+		prefix := match.Copy()
+		prefix.Destination = config.String(destination)
+		return prefix
+	}
+
+	prefix := &PrefixConfig{
+		Datacenter:  config.String(sp.Datacenter),
+		Destination: config.String(destination),
+		Source:      config.String(sp.Source),
+	}
+	prefix.Finalize()
+	return prefix
+}
@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestExportSnapshot(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{"global/foo", "global/private/bar"} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("value"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := NewFileListQuery(root, "global/", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	prefixes := &PrefixConfigs{
+		&PrefixConfig{
+			Dependency:  d,
+			Destination: config.String("default/"),
+			Source:      config.String("global/"),
+		},
+	}
+	excludes := &ExcludeConfigs{
+		&ExcludeConfig{
+			Source: config.String("global/private"),
+		},
+	}
+
+	s, err := exportSnapshot(prefixes, excludes, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Version != SnapshotVersion {
+		t.Errorf("expected version %d to be %d", s.Version, SnapshotVersion)
+	}
+
+	if len(s.Prefixes) != 1 {
+		t.Fatalf("expected 1 prefix, got %d", len(s.Prefixes))
+	}
+
+	sp := s.Prefixes[0]
+	if sp.Source != "global/" || sp.Destination != "default/" {
+		t.Errorf("expected %q:%q to be %q:%q", sp.Source, sp.Destination,
+			"global/", "default/")
+	}
+
+	e := []*SnapshotPair{
+		&SnapshotPair{
+			Key:   "global/foo",
+			Value: []byte("value"),
+		},
+	}
+	if !reflect.DeepEqual(e, sp.Pairs) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, sp.Pairs)
+	}
+}
+
+func TestImportSnapshot_Version(t *testing.T) {
+	for _, v := range []int{0, SnapshotVersion + 1} {
+		if err := importSnapshot(&Snapshot{Version: v}, "", nil, nil, nil); err == nil {
+			t.Errorf("expected error importing version %d", v)
+		}
+	}
+}
+
+func TestImportSnapshot_Encoded(t *testing.T) {
+	root := t.TempDir()
+	prefix := &PrefixConfig{
+		Compression: config.String(CompressionGzip),
+		Datacenter:  config.String("dc1"),
+		Destination: config.String("default/"),
+		DestinationFile: &FileDestinationConfig{
+			Path: config.String(root),
+		},
+		Encrypt: &EncryptConfig{
+			KeyFile: config.String(writeKeyFile(t, "k1 "+testKey(1))),
+		},
+		Source: config.String("global/"),
+	}
+	prefix.Finalize()
+
+	s := &Snapshot{
+		Version: SnapshotVersion,
+		Prefixes: []*SnapshotPrefix{{
+			Source:      "global/",
+			Datacenter:  "dc1",
+			Destination: "default/",
+			Pairs: []*SnapshotPair{{
+				Key:   "global/foo",
+				Value: []byte("value"),
+			}},
+		}},
+	}
+	if err := importSnapshot(s, "", &PrefixConfigs{prefix}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value is compressed and encrypted as it is by replication
+	b, err := os.ReadFile(filepath.Join(root, "default", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnvelope(b) {
+		t.Fatalf("expected an encrypted value, got %q", b)
+	}
+	keys, err := prefixKeyring(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := keys.open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGzip(value) {
+		t.Errorf("expected a compressed value, got %q", value)
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/pkg/errors"
+)
+
+// Ensure implements
+var _ dep.Dependency = (*FileListQuery)(nil)
+
+// FileListQuery lists the files in a directory tree on disk as key pairs, so a
+// directory can be replicated in the same way as a KV prefix. The path of
+// each file relative to the root directory is its key. Files and directories
+// beginning with a dot (such as ".git") are ignored.
+//
+// The modify index of a file is the later of its modification time and the
+// time its metadata last changed, so unchanged files keep the same index
+// across restarts, and files copied with old modification times are still
+// replicated where the change time is available. A file that is new or changed
+// since the previous listing always moves forward from its index. On Linux,
+// directories are watched with inotify so changes are found without waiting
+// for the next poll.
+type FileListQuery struct {
+	stopCh chan struct{}
+
+	root         string
+	prefix       string
+	pollInterval time.Duration
+
+	// files is the state of each file in the most recent listing.
+	files map[string]fileState
+
+	// notifier wakes the query when a watched directory changes. It is
+	// created on the first fetch and closed when the query is stopped.
+	mu       sync.Mutex
+	notifier *fileNotifier
+	stopped  bool
+
+	// lastIndex and lastSum are the index and checksum of the most recent
+	// listing, used to detect changes such as deletes that do not change the
+	// modify index of any remaining file.
+	lastIndex uint64
+	lastSum   [md5.Size]byte
+}
+
+// fileState is what a file is compared with to decide if it changed since the
+// previous listing.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	sum     [md5.Size]byte
+	index   uint64
+}
+
+// NewFileListQuery creates a new dependency that lists the files under the
+// given prefix in the root directory, scanning for changes at the given
+// interval.
+func NewFileListQuery(root, prefix string, pollInterval time.Duration) (*FileListQuery, error) {
+	if strings.TrimSpace(root) == "" {
+		return nil, fmt.Errorf("missing source_file path")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileListQuery{
+		stopCh:       make(chan struct{}, 1),
+		root:         root,
+		prefix:       strings.TrimLeft(prefix, "/"),
+		pollInterval: pollInterval,
+		files:        make(map[string]fileState),
+	}, nil
+}
+
+// Fetch lists the files under the prefix. If the caller has already seen the
+// current index, this blocks for the poll interval before listing again,
+// emulating a blocking query.
+func (d *FileListQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	notifier := d.startNotifier()
+	if opts.WaitIndex != 0 && opts.WaitIndex == d.lastIndex {
+		select {
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		case <-notifier.C():
+		case <-time.After(d.pollInterval):
+		}
+	}
+
+	log.Printf("[TRACE] %s: READ %s", d, d.root)
+
+	pairs, err := d.list(notifier)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	log.Printf("[TRACE] %s: returned %d pairs", d, len(pairs))
+
+	// The index is the most recent modify index, but it must also move forward
+	// when files are removed or renamed.
+	var index uint64
+	h := md5.New()
+	for _, pair := range pairs {
+		if pair.ModifyIndex > index {
+			index = pair.ModifyIndex
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", pair.Path, pair.ModifyIndex)
+	}
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+
+	switch {
+	case d.lastIndex == 0:
+	case sum == d.lastSum:
+		index = d.lastIndex
+	case index <= d.lastIndex:
+		index = d.lastIndex + 1
+	}
+	d.lastIndex, d.lastSum = index, sum
+
+	return pairs, &dep.ResponseMetadata{
+		LastIndex: index,
+	}, nil
+}
+
+// startNotifier returns the notifier of the query, creating it on the first
+// call. It returns nil if the query is stopped or notifications are not
+// available, in which case changes are only found by polling.
+func (d *FileListQuery) startNotifier() *fileNotifier {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.notifier == nil && !d.stopped {
+		n, err := newFileNotifier()
+		if err != nil {
+			log.Printf("[WARN] %s: cannot watch for changes, falling back to polling: %s",
+				d, err)
+		}
+		d.notifier = n
+	}
+	return d.notifier
+}
+
+// list walks the root directory and returns the files under the prefix,
+// watching each directory it walks with the notifier.
+func (d *FileListQuery) list(notifier *fileNotifier) ([]*dep.KeyPair, error) {
+	// Only walk the deepest directory that contains the prefix
+	start := d.root
+	if i := strings.LastIndex(d.prefix, "/"); i != -1 {
+		start = filepath.Join(d.root, filepath.FromSlash(d.prefix[:i+1]))
+	}
+
+	var pairs []*dep.KeyPair
+	files := make(map[string]fileState, len(d.files))
+	err := filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if path != start && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			notifier.watch(path)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, d.prefix) {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		state := fileState{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			sum:     md5.Sum(b),
+			index:   fileIndex(info),
+		}
+		last, ok := d.files[key]
+		switch {
+		case ok && last.size == state.size && last.modTime.Equal(state.modTime) && last.sum == state.sum:
+			state.index = last.index
+		case d.lastIndex != 0 && state.index <= d.lastIndex:
+			// The file is new or changed, but its times are older than the
+			// previous listing, such as a file copied with its times
+			state.index = d.lastIndex + 1
+		}
+		files[key] = state
+
+		pairs = append(pairs, &dep.KeyPair{
+			Path:        key,
+			Key:         strings.TrimLeft(strings.TrimPrefix(key, d.prefix), "/"),
+			Value:       string(b),
+			CreateIndex: state.index,
+			ModifyIndex: state.index,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.files = files
+
+	return pairs, nil
+}
+
+// fileIndex returns the modify index of a file from the later of its
+// modification and change times.
+func fileIndex(info os.FileInfo) uint64 {
+	t := info.ModTime()
+	if ct := changeTime(info); ct.After(t) {
+		t = ct
+	}
+	if t.UnixNano() <= 0 {
+		return 1
+	}
+	return uint64(t.UnixNano())
+}
+
+// CanShare returns a boolean if this dependency is shareable.
+func (d *FileListQuery) CanShare() bool {
+	return false
+}
+
+// String returns the human-friendly version of this dependency. It includes
+// the poll interval, so a prefix reloaded with a different one is watched
+// again.
+func (d *FileListQuery) String() string {
+	return fmt.Sprintf("file.list(%s/%s,interval=%s)", filepath.ToSlash(d.root),
+		d.prefix, d.pollInterval)
+}
+
+// Stop halts the dependency's fetch function.
+func (d *FileListQuery) Stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.notifier.close()
+	d.mu.Unlock()
+
+	close(d.stopCh)
+}
+
+// Type returns the type of this dependency.
+func (d *FileListQuery) Type() dep.Type {
+	return dep.TypeLocal
+}
@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileNotifyMask is the inotify events that wake a file source: files that
+// are written, renamed, removed, or whose metadata changes.
+const fileNotifyMask = unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+	unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// changeTime returns the time the file's contents or metadata last changed.
+// Unlike the modification time, it cannot be set back by copying a file.
+func changeTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+	}
+	return info.ModTime()
+}
+
+// fileNotifier wakes a file source when inotify reports a change in one of the
+// watched directories, so changes are found before the next poll.
+type fileNotifier struct {
+	file *os.File
+	ch   chan struct{}
+
+	once sync.Once
+}
+
+// newFileNotifier creates a new inotify instance with no watched directories.
+func newFileNotifier() (*fileNotifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	// The descriptor is non-blocking, so reads go through the runtime poller
+	// and are interrupted when it is closed.
+	n := &fileNotifier{
+		file: os.NewFile(uintptr(fd), "inotify"),
+		ch:   make(chan struct{}, 1),
+	}
+	go n.read()
+	return n, nil
+}
+
+// read wakes the source for each batch of events until the notifier is closed.
+// The events themselves are not needed, since the source lists every file.
+func (n *fileNotifier) read() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		if _, err := n.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case n.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch adds the directory to the watched directories. Adding a directory that
+// is already watched is a no-op. If the inotify watch limit is reached, the
+// directory is only found by polling.
+func (n *fileNotifier) watch(dir string) {
+	if n == nil {
+		return
+	}
+
+	fd := int(n.file.Fd())
+	if _, err := unix.InotifyAddWatch(fd, dir, fileNotifyMask); err != nil {
+		n.once.Do(func() {
+			log.Printf("[WARN] (file) cannot watch %q, falling back to polling: %s",
+				dir, err)
+		})
+	}
+}
+
+// C returns the channel that receives when a watched directory changes.
+func (n *fileNotifier) C() <-chan struct{} {
+	if n == nil {
+		return nil
+	}
+	return n.ch
+}
+
+// close stops watching every directory.
+func (n *fileNotifier) close() {
+	if n == nil {
+		return
+	}
+	n.file.Close()
+}
@@ -0,0 +1,34 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime returns the modification time of the file, since the time its
+// metadata last changed is not available on every platform.
+func changeTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// fileNotifier is not supported on this platform, so file sources only find
+// changes by polling.
+type fileNotifier struct{}
+
+// newFileNotifier returns a nil notifier, which never wakes the source.
+func newFileNotifier() (*fileNotifier, error) {
+	return nil, nil
+}
+
+func (n *fileNotifier) watch(dir string) {}
+
+func (n *fileNotifier) C() <-chan struct{} {
+	return nil
+}
+
+func (n *fileNotifier) close() {}
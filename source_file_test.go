@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestFileListQuery_Fetch(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for path, contents := range map[string]string{
+		"config/foo":          "foo",
+		"config/zip/zap":      "zap",
+		"config/.git/HEAD":    "ref",
+		"configuration/other": "other",
+		"unrelated":           "unrelated",
+	} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := NewFileListQuery(root, "config/", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	data, rm, err := d.Fetch(nil, &dep.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := data.([]*dep.KeyPair)
+	paths := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		paths[pair.Path] = pair.Key + "=" + pair.Value
+	}
+	e := map[string]string{
+		"config/foo":     "foo=foo",
+		"config/zip/zap": "zip/zap=zap",
+	}
+	if !reflect.DeepEqual(e, paths) {
+		t.Errorf("\nexp: %#v\nact: %#v", e, paths)
+	}
+
+	// An unchanged directory keeps the same index
+	_, rm2, err := d.Fetch(nil, &dep.QueryOptions{WaitIndex: rm.LastIndex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm2.LastIndex != rm.LastIndex {
+		t.Errorf("expected index %d to be %d", rm2.LastIndex, rm.LastIndex)
+	}
+
+	// Removing a file moves the index forward
+	if err := os.Remove(filepath.Join(root, "config", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	data, rm3, err := d.Fetch(nil, &dep.QueryOptions{WaitIndex: rm2.LastIndex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm3.LastIndex <= rm2.LastIndex {
+		t.Errorf("expected index %d to be greater than %d", rm3.LastIndex, rm2.LastIndex)
+	}
+	if n := len(data.([]*dep.KeyPair)); n != 1 {
+		t.Errorf("expected 1 pair, got %d", n)
+	}
+
+	// Files written with an old modification time are still newer than the
+	// last index
+	old := time.Now().Add(-24 * time.Hour)
+	write := func(path, contents string) {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexes := func() map[string]uint64 {
+		data, _, err := d.Fetch(nil, &dep.QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]uint64)
+		for _, pair := range data.([]*dep.KeyPair) {
+			m[pair.Path] = pair.ModifyIndex
+		}
+		return m
+	}
+
+	write("config/copied", "copied")
+	write("config/zip/zap", "zop")
+	before := indexes()
+	for path, index := range before {
+		if index <= rm3.LastIndex {
+			t.Errorf("expected index of %q to be greater than %d, got %d",
+				path, rm3.LastIndex, index)
+		}
+	}
+
+	// A change of contents alone also moves the index forward
+	write("config/zip/zap", "zip")
+	after := indexes()
+	if after["config/zip/zap"] <= before["config/zip/zap"] {
+		t.Errorf("expected index %d to be greater than %d",
+			after["config/zip/zap"], before["config/zip/zap"])
+	}
+	if after["config/copied"] != before["config/copied"] {
+		t.Errorf("expected index %d to be %d",
+			after["config/copied"], before["config/copied"])
+	}
+}
+
+func TestFileListQuery_Restart(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func() (uint64, uint64) {
+		d, err := NewFileListQuery(root, "", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Stop()
+
+		data, rm, err := d.Fetch(nil, &dep.QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data.([]*dep.KeyPair)[0].ModifyIndex, rm.LastIndex
+	}
+
+	// Unchanged files keep the same index, so they are not replicated again
+	index, lastIndex := fetch()
+	index2, lastIndex2 := fetch()
+	if index2 != index {
+		t.Errorf("\nexp: %#v\nact: %#v", index, index2)
+	}
+	if lastIndex2 != lastIndex {
+		t.Errorf("\nexp: %#v\nact: %#v", lastIndex, lastIndex2)
+	}
+}
+
+func TestFileListQuery_Notify(t *testing.T) {
+	root := t.TempDir()
+	d, err := NewFileListQuery(root, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	_, rm, err := d.Fetch(nil, &dep.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.startNotifier() == nil {
+		t.Skip("file notifications are not supported on this platform")
+	}
+
+	type result struct {
+		pairs []*dep.KeyPair
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, _, err := d.Fetch(nil, &dep.QueryOptions{WaitIndex: rm.LastIndex})
+		pairs, _ := data.([]*dep.KeyPair)
+		ch <- result{pairs, err}
+	}()
+
+	if err := os.WriteFile(filepath.Join(root, "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change is found long before the next poll
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if len(r.pairs) != 1 {
+			t.Errorf("expected 1 pair, got %d", len(r.pairs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the change to be found")
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Ensure implements
+var _ dep.Dependency = (*KVPagesQuery)(nil)
+
+// KVPagesQuery watches a KV prefix in the same way as a kv.list query, but
+// only returns the pages of the prefix: the keys directly under it, with
+// subtrees ending in a slash. Each page is then read on its own with
+// FetchPage, so that the whole prefix is never held in memory at once.
+type KVPagesQuery struct {
+	stopCh chan struct{}
+
+	dc     string
+	prefix string
+}
+
+// NewKVPagesQuery creates a new dependency that lists the pages of the given
+// prefix in the given datacenter.
+func NewKVPagesQuery(prefix, dc string) *KVPagesQuery {
+	return &KVPagesQuery{
+		stopCh: make(chan struct{}, 1),
+		dc:     dc,
+		prefix: prefix,
+	}
+}
+
+// Fetch lists the pages of the prefix. Consul blocks the query until any key
+// under the prefix changes, not just the listed keys.
+func (d *KVPagesQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	opts = opts.Merge(&dep.QueryOptions{
+		Datacenter: d.dc,
+	})
+
+	log.Printf("[TRACE] %s: KEYS %s", d, d.prefix)
+
+	kv := clients.Consul().KV()
+	keys, qm, err := kv.Keys(d.prefix, "/", opts.ToConsulOpts())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	// A prefix without a trailing slash lists itself as a single subtree, so
+	// list the subtree instead to split it into pages.
+	pages := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != d.prefix+"/" {
+			pages = append(pages, key)
+			continue
+		}
+
+		children, _, err := kv.Keys(key, "/", (&dep.QueryOptions{
+			AllowStale: opts.AllowStale,
+			Datacenter: d.dc,
+		}).ToConsulOpts())
+		if err != nil {
+			return nil, nil, errors.Wrap(err, d.String())
+		}
+		pages = append(pages, children...)
+	}
+
+	log.Printf("[TRACE] %s: returned %d pages", d, len(pages))
+
+	return pages, &dep.ResponseMetadata{
+		LastIndex:   qm.LastIndex,
+		LastContact: qm.LastContact,
+	}, nil
+}
+
+// FetchPage reads the keys of a single page returned by Fetch.
+func (d *KVPagesQuery) FetchPage(clients *dep.ClientSet, opts *dep.QueryOptions, page string) ([]*dep.KeyPair, error) {
+	opts = opts.Merge(&dep.QueryOptions{
+		Datacenter: d.dc,
+	})
+
+	kv := clients.Consul().KV()
+	var list api.KVPairs
+	if strings.HasSuffix(page, "/") {
+		var err error
+		list, _, err = kv.List(page, opts.ToConsulOpts())
+		if err != nil {
+			return nil, errors.Wrap(err, d.String())
+		}
+	} else {
+		pair, _, err := kv.Get(page, opts.ToConsulOpts())
+		if err != nil {
+			return nil, errors.Wrap(err, d.String())
+		}
+		if pair != nil {
+			list = api.KVPairs{pair}
+		}
+	}
+
+	return newKeyPairs(d.prefix, list), nil
+}
+
+// kvTxnMaxOps is the maximum number of operations in a single Consul
+// transaction, and so the number of keys read in a batch.
+const kvTxnMaxOps = 64
+
+// FetchKeys reads the given keys in batched transactions. Keys that no longer
+// exist are skipped.
+func (d *KVPagesQuery) FetchKeys(clients *dep.ClientSet, opts *dep.QueryOptions, keys []string) ([]*dep.KeyPair, error) {
+	opts = opts.Merge(&dep.QueryOptions{
+		Datacenter: d.dc,
+	})
+
+	txn := clients.Consul().Txn()
+	var list api.KVPairs
+	for start := 0; start < len(keys); start += kvTxnMaxOps {
+		end := start + kvTxnMaxOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		ops := make(api.TxnOps, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, &api.TxnOp{
+				KV: &api.KVTxnOp{Verb: api.KVGetOrEmpty, Key: key},
+			})
+		}
+
+		ok, resp, _, err := txn.Txn(ops, opts.ToConsulOpts())
+		if err != nil {
+			return nil, errors.Wrap(err, d.String())
+		}
+		if !ok {
+			var what []string
+			for _, e := range resp.Errors {
+				what = append(what, e.What)
+			}
+			return nil, fmt.Errorf("%s: transaction rolled back: %s", d,
+				strings.Join(what, ", "))
+		}
+
+		for _, result := range resp.Results {
+			// Missing keys are returned without a modify index
+			if result.KV != nil && result.KV.ModifyIndex != 0 {
+				list = append(list, result.KV)
+			}
+		}
+	}
+
+	return newKeyPairs(d.prefix, list), nil
+}
+
+// ReadPages reads the pages returned by Fetch, calling fn with the pairs of
+// each read and the page they were read from. Keys directly under the prefix
+// are read in batches, for which the page is empty. Subtrees are listed whole,
+// unless split is true, in which case they are read one level at a time with
+// their keys in batches, so that a large subtree is never held in memory.
+func (d *KVPagesQuery) ReadPages(ctx context.Context, clients *dep.ClientSet, opts *dep.QueryOptions, pages []string, split bool, fn func(page string, pairs []*dep.KeyPair) error) error {
+	var batch []string
+	flush := func() error {
+		err := d.readBatches(ctx, clients, opts, batch, fn)
+		batch = batch[:0]
+		return err
+	}
+
+	for _, page := range pages {
+		if !strings.HasSuffix(page, "/") {
+			if batch = append(batch, page); len(batch) == kvTxnMaxOps {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if split {
+			if err := d.walkPage(ctx, clients, opts, page, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, span := startSpan(ctx, "source.page", attribute.String("page", page))
+		pairs, err := d.FetchPage(clients, opts, page)
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to read page %q: %s", page, err)
+		}
+		if err := fn(page, pairs); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// walkPage reads a subtree one level at a time, reading the keys at each level
+// in batches and recursing into the subtrees below it.
+func (d *KVPagesQuery) walkPage(ctx context.Context, clients *dep.ClientSet, opts *dep.QueryOptions, page string, fn func(page string, pairs []*dep.KeyPair) error) error {
+	_, span := startSpan(ctx, "source.keys", attribute.String("page", page))
+	keys, _, err := clients.Consul().KV().Keys(page, "/", opts.Merge(&dep.QueryOptions{
+		Datacenter: d.dc,
+	}).ToConsulOpts())
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to read page %q: %s", page, errors.Wrap(err, d.String()))
+	}
+
+	// A key named after the subtree itself, such as a folder, is read with
+	// the keys of the level
+	var leaves, subtrees []string
+	for _, key := range keys {
+		if key != page && strings.HasSuffix(key, "/") {
+			subtrees = append(subtrees, key)
+		} else {
+			leaves = append(leaves, key)
+		}
+	}
+
+	if err := d.readBatches(ctx, clients, opts, leaves, fn); err != nil {
+		return err
+	}
+	for _, subtree := range subtrees {
+		if err := d.walkPage(ctx, clients, opts, subtree, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBatches reads the given keys in batches, calling fn with the pairs of
+// each batch and an empty page.
+func (d *KVPagesQuery) readBatches(ctx context.Context, clients *dep.ClientSet, opts *dep.QueryOptions, keys []string, fn func(page string, pairs []*dep.KeyPair) error) error {
+	for start := 0; start < len(keys); start += kvTxnMaxOps {
+		end := start + kvTxnMaxOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		_, span := startSpan(ctx, "source.batch", attribute.Int("keys", end-start))
+		pairs, err := d.FetchKeys(clients, opts, keys[start:end])
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to read keys: %s", err)
+		}
+		if err := fn("", pairs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newKeyPairs converts the listed pairs to the pairs of a kv.list query of the
+// given prefix.
+func newKeyPairs(prefix string, list api.KVPairs) []*dep.KeyPair {
+	pairs := make([]*dep.KeyPair, 0, len(list))
+	for _, pair := range list {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		key = strings.TrimLeft(key, "/")
+
+		pairs = append(pairs, &dep.KeyPair{
+			Path:        pair.Key,
+			Key:         key,
+			Value:       string(pair.Value),
+			CreateIndex: pair.CreateIndex,
+			ModifyIndex: pair.ModifyIndex,
+			LockIndex:   pair.LockIndex,
+			Flags:       pair.Flags,
+			Session:     pair.Session,
+		})
+	}
+	return pairs
+}
+
+// FetchAll reads the keys of every page returned by Fetch.
+func (d *KVPagesQuery) FetchAll(clients *dep.ClientSet, opts *dep.QueryOptions, pages []string) ([]*dep.KeyPair, error) {
+	var pairs []*dep.KeyPair
+	err := d.ReadPages(context.Background(), clients, opts, pages, false,
+		func(_ string, p []*dep.KeyPair) error {
+			pairs = append(pairs, p...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// CanShare returns a boolean if this dependency is shareable.
+func (d *KVPagesQuery) CanShare() bool {
+	return false
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *KVPagesQuery) String() string {
+	return fmt.Sprintf("kv.pages(%s@%s)", d.prefix, d.dc)
+}
+
+// Stop halts the dependency's fetch function.
+func (d *KVPagesQuery) Stop() {
+	close(d.stopCh)
+}
+
+// Type returns the type of this dependency.
+func (d *KVPagesQuery) Type() dep.Type {
+	return dep.TypeConsul
+}
+
+// replicatePages reads and replicates the pages of a paged prefix one at a
+// time, so that only one page is held in memory at once. If the prefix has a
+// max_bytes, subtrees are split into batches of keys rather than listed, so
+// that the limit is checked before a large subtree is read into memory.
+func (r *Runner) replicatePages(ctx context.Context, p *pass, query *KVPagesQuery, pages []string) error {
+	opts := &dep.QueryOptions{
+		AllowStale: config.TimeDurationVal(r.config.MaxStale) > 0,
+	}
+
+	split := config.IntVal(p.prefix.MaxBytes) > 0
+	return query.ReadPages(ctx, r.clients, opts, pages, split, func(page string, pairs []*dep.KeyPair) error {
+		if err := checkPrefixLimits(p.prefix, pairs, len(p.usedKeys)+len(pairs)); err != nil {
+			return err
+		}
+
+		// Batches of keys are not under a single destination prefix
+		if page == "" {
+			return r.replicatePairs(ctx, p, pairs, "", false)
+		}
+		return r.replicatePairs(ctx, p, pairs, destinationKey(p.prefix, page), true)
+	})
+}
+
+// checkPrefixLimits returns an error if the pairs of a listing are larger than
+// the prefix's max_bytes, or if keys, the number of keys read by the pass so
+// far, is more than its max_keys. Except for the batches of a paged prefix,
+// the pairs have already been read, so this only stops a pass that is too
+// large from being replicated.
+func checkPrefixLimits(prefix *PrefixConfig, pairs []*dep.KeyPair, keys int) error {
+	if max := config.IntVal(prefix.MaxKeys); max > 0 && keys > max {
+		return fmt.Errorf("%s has more than %d keys, the max_keys of the prefix",
+			prefix.Dependency, max)
+	}
+
+	if max := config.IntVal(prefix.MaxBytes); max > 0 {
+		var size int
+		for _, pair := range pairs {
+			size += len(pair.Path) + len(pair.Value)
+			if size > max {
+				return fmt.Errorf("%s has more than %d bytes in a single listing, "+
+					"the max_bytes of the prefix", prefix.Dependency, max)
+			}
+		}
+	}
+
+	return nil
+}
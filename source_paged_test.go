@@ -0,0 +1,360 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+)
+
+// newTestKVServer serves the given keys from a fake Consul KV HTTP API, which
+// also deletes them, and returns a client set for it.
+func newTestKVServer(t *testing.T, data map[string]string) *dep.ClientSet {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/txn" {
+			var ops api.TxnOps
+			if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp := api.TxnResponse{}
+			for _, op := range ops {
+				pair := &api.KVPair{Key: op.KV.Key}
+				if value, ok := data[op.KV.Key]; ok {
+					pair.Value, pair.ModifyIndex = []byte(value), 5
+				}
+				resp.Results = append(resp.Results, &api.TxnResult{KV: pair})
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		q := r.URL.Query()
+		if r.Method == http.MethodDelete {
+			delete(data, prefix)
+			json.NewEncoder(w).Encode(true)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+
+		var keys []string
+		for key := range data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		switch {
+		case q.Has("keys"):
+			seen := make(map[string]struct{})
+			result := []string{}
+			for _, key := range keys {
+				if sep := q.Get("separator"); sep != "" {
+					if i := strings.Index(key[len(prefix):], sep); i != -1 {
+						key = key[:len(prefix)+i+len(sep)]
+					}
+				}
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					result = append(result, key)
+				}
+			}
+			json.NewEncoder(w).Encode(result)
+		case q.Has("recurse"):
+			pairs := api.KVPairs{}
+			for _, key := range keys {
+				pairs = append(pairs, &api.KVPair{Key: key, Value: []byte(data[key]), ModifyIndex: 5})
+			}
+			json.NewEncoder(w).Encode(pairs)
+		default:
+			value, ok := data[prefix]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(api.KVPairs{{Key: prefix, Value: []byte(value), ModifyIndex: 5}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c := DefaultConfig()
+	c.Consul.Address = config.String(strings.TrimPrefix(srv.URL, "http://"))
+	c.Finalize()
+	clients, err := newClientSet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clients
+}
+
+func TestKVPagesQuery(t *testing.T) {
+	clients := newTestKVServer(t, map[string]string{
+		"global":           "root",
+		"global/a":         "a",
+		"global/app1/x":    "x",
+		"global/app1/y/z":  "z",
+		"global/app2/x":    "x",
+		"globalother/skip": "other",
+	})
+
+	d := NewKVPagesQuery("global", "dc1")
+	data, rm, err := d.Fetch(clients, &dep.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm.LastIndex != 10 {
+		t.Errorf("\nexp: %#v\nact: %#v", 10, rm.LastIndex)
+	}
+
+	exp := []string{"global", "global/a", "global/app1/", "global/app2/", "globalother/"}
+	if !reflect.DeepEqual(exp, data) {
+		t.Fatalf("\nexp: %#v\nact: %#v", exp, data)
+	}
+
+	pairs, err := d.FetchPage(clients, &dep.QueryOptions{}, "global/app1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, pair := range pairs {
+		paths = append(paths, pair.Path)
+	}
+	if exp := []string{"global/app1/x", "global/app1/y/z"}; !reflect.DeepEqual(exp, paths) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, paths)
+	}
+
+	pairs, err = d.FetchPage(clients, &dep.QueryOptions{}, "global/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 0 {
+		t.Errorf("expected no pairs, got %#v", pairs)
+	}
+
+	all, err := d.FetchAll(clients, &dep.QueryOptions{}, data.([]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 {
+		t.Errorf("expected 6 pairs, got %d", len(all))
+	}
+}
+
+func TestKVPagesQuery_ReadPages(t *testing.T) {
+	clients := newTestKVServer(t, map[string]string{
+		"global/a":        "a",
+		"global/b":        "b",
+		"global/app1/":    "folder",
+		"global/app1/x":   "x",
+		"global/app1/y/z": "z",
+	})
+
+	d := NewKVPagesQuery("global/", "dc1")
+	pages := []string{"global/a", "global/app1/", "global/b", "global/missing"}
+
+	cases := []struct {
+		name  string
+		split bool
+		exp   []string
+	}{
+		{
+			"listed",
+			false,
+			[]string{
+				":global/a",
+				"global/app1/:global/app1/,global/app1/x,global/app1/y/z",
+				":global/b",
+			},
+		},
+		{
+			"split",
+			true,
+			[]string{
+				":global/a",
+				":global/app1/,global/app1/x",
+				":global/app1/y/z",
+				":global/b",
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var reads []string
+			err := d.ReadPages(context.Background(), clients, &dep.QueryOptions{}, pages, tc.split,
+				func(page string, pairs []*dep.KeyPair) error {
+					paths := make([]string, 0, len(pairs))
+					for _, pair := range pairs {
+						paths = append(paths, pair.Path)
+					}
+					reads = append(reads, page+":"+strings.Join(paths, ","))
+					return nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.exp, reads) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, reads)
+			}
+		})
+	}
+}
+
+func TestCheckPrefixLimits(t *testing.T) {
+	pairs := []*dep.KeyPair{
+		{Path: "global/a", Value: "12345"},
+		{Path: "global/b", Value: "12345"},
+	}
+
+	cases := []struct {
+		name     string
+		maxKeys  int
+		maxBytes int
+		keys     int
+		err      bool
+	}{
+		{
+			"unlimited",
+			0,
+			0,
+			1000,
+			false,
+		},
+		{
+			"keys_under",
+			2,
+			0,
+			2,
+			false,
+		},
+		{
+			"keys_over",
+			2,
+			0,
+			3,
+			true,
+		},
+		{
+			"bytes_under",
+			0,
+			26,
+			2,
+			false,
+		},
+		{
+			"bytes_over",
+			0,
+			25,
+			2,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			prefix, err := ParsePrefixConfig("global@dc1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix.MaxKeys = config.Int(tc.maxKeys)
+			prefix.MaxBytes = config.Int(tc.maxBytes)
+
+			err = checkPrefixLimits(prefix, pairs, tc.keys)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error: %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestParse_PagedDependency(t *testing.T) {
+	c, err := Parse(`prefix {
+		source = "global@dc1"
+		paged  = true
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := (*c.Prefixes)[0].Dependency
+	if _, ok := d.(*KVPagesQuery); !ok {
+		t.Fatalf("expected a paged query, got %T", d)
+	}
+	if exp := "kv.pages(global@dc1)"; d.String() != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, d.String())
+	}
+}
+
+func TestRunner_replicatePages(t *testing.T) {
+	clients := newTestKVServer(t, map[string]string{
+		"global/app1/x": "x",
+		"global/app2/y": "y",
+	})
+
+	root := t.TempDir()
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix, err := ParsePrefixConfig("global/@dc1:default/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix.MaxKeys = config.Int(1)
+	prefix.Finalize()
+
+	c := DefaultConfig()
+	c.Finalize()
+	r := &Runner{config: c, clients: clients}
+
+	query := NewKVPagesQuery("global/", "dc1")
+	newPass := func() *pass {
+		return &pass{
+			prefix:   prefix,
+			excludes: DefaultExcludeConfigs(),
+			status:   &Status{},
+			dest:     dest,
+			usedKeys: make(map[string]struct{}),
+		}
+	}
+	pages := []string{"global/app1/", "global/app2/"}
+
+	// The second page goes over the max_keys
+	p := newPass()
+	if err := r.replicatePages(context.Background(), p, query, pages); err == nil {
+		t.Fatal("expected error")
+	}
+	if exp := []string{"default/app1/x"}; !reflect.DeepEqual(exp, p.updates) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, p.updates)
+	}
+
+	prefix.MaxKeys = config.Int(0)
+	p = newPass()
+	if err := r.replicatePages(context.Background(), p, query, pages); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"default/app2/y"}; !reflect.DeepEqual(exp, p.updates) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, p.updates)
+	}
+	if p.unchanged != 1 {
+		t.Errorf("\nexp: %#v\nact: %#v", 1, p.unchanged)
+	}
+}
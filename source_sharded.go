@@ -0,0 +1,318 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// Ensure implements
+var _ dep.Dependency = (*KVShardsQuery)(nil)
+
+// kvShards is the data of a KVShardsQuery.
+type kvShards struct {
+	// Shards are the subtrees at the shard depth of the prefix, each ending in
+	// a slash.
+	Shards []string
+
+	// Pairs are the keys of the prefix that are above the shard depth.
+	Pairs []*dep.KeyPair
+}
+
+// KVShardsQuery lists the subtrees of a KV prefix at a given depth, which are
+// each watched on their own, along with the keys above that depth. Consul
+// cannot block on the keys at a depth without blocking on every key under the
+// prefix, so the subtrees are listed again on an interval instead.
+type KVShardsQuery struct {
+	stopCh chan struct{}
+
+	dc       string
+	prefix   string
+	depth    int
+	interval time.Duration
+
+	lastIndex uint64
+	lastSum   [md5.Size]byte
+}
+
+// NewKVShardsQuery creates a new dependency that lists the subtrees of the
+// given prefix in the given datacenter at the given depth, every interval.
+func NewKVShardsQuery(prefix, dc string, depth int, interval time.Duration) *KVShardsQuery {
+	return &KVShardsQuery{
+		stopCh:   make(chan struct{}, 1),
+		dc:       dc,
+		prefix:   prefix,
+		depth:    depth,
+		interval: interval,
+	}
+}
+
+// Fetch lists the shards of the prefix. Like a blocking query, it does not
+// return until the shards or the keys above them change.
+func (d *KVShardsQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	if opts.WaitIndex != 0 && opts.WaitIndex == d.lastIndex {
+		select {
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		case <-time.After(d.interval):
+		}
+	}
+
+	log.Printf("[TRACE] %s: KEYS %s", d, d.prefix)
+
+	data, err := d.list(clients.Consul().KV(), (&dep.QueryOptions{
+		AllowStale: opts.AllowStale,
+		Datacenter: d.dc,
+	}).ToConsulOpts())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	// The index is the most recent modification of the keys, but it must
+	// also move forward when shards are added or removed.
+	var index uint64
+	h := md5.New()
+	for _, shard := range data.Shards {
+		fmt.Fprintf(h, "%s\x00", shard)
+	}
+	for _, pair := range data.Pairs {
+		if pair.ModifyIndex > index {
+			index = pair.ModifyIndex
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", pair.Path, pair.ModifyIndex)
+	}
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+
+	switch {
+	case d.lastIndex == 0:
+	case sum == d.lastSum:
+		index = d.lastIndex
+	case index <= d.lastIndex:
+		index = d.lastIndex + 1
+	}
+	if index == 0 {
+		index = 1
+	}
+	d.lastIndex, d.lastSum = index, sum
+
+	log.Printf("[TRACE] %s: returned %d shards and %d pairs", d,
+		len(data.Shards), len(data.Pairs))
+
+	return data, &dep.ResponseMetadata{
+		LastIndex: index,
+	}, nil
+}
+
+// list walks the prefix down to the shard depth.
+func (d *KVShardsQuery) list(kv *api.KV, opts *api.QueryOptions) (*kvShards, error) {
+	level := []string{d.prefix}
+	var leaves []string
+	for depth := 0; depth < d.depth; depth++ {
+		var next []string
+		for _, sub := range level {
+			subtrees, keys, err := kvChildren(kv, sub, opts)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, subtrees...)
+			leaves = append(leaves, keys...)
+		}
+		level = next
+	}
+	sort.Strings(level)
+	sort.Strings(leaves)
+
+	pairs := make([]*dep.KeyPair, 0, len(leaves))
+	for _, key := range leaves {
+		pair, _, err := kv.Get(key, opts)
+		if err != nil {
+			return nil, err
+		}
+		if pair != nil {
+			pairs = append(pairs, newKeyPairs(d.prefix, api.KVPairs{pair})...)
+		}
+	}
+
+	return &kvShards{Shards: level, Pairs: pairs}, nil
+}
+
+// kvChildren lists the keys directly under sub, and returns the subtrees,
+// which end in a slash, separately from the other keys.
+func kvChildren(kv *api.KV, sub string, opts *api.QueryOptions) ([]string, []string, error) {
+	keys, _, err := kv.Keys(sub, "/", opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var subtrees, leaves []string
+	for _, key := range keys {
+		switch {
+		case key == sub || !strings.HasSuffix(key, "/"):
+			leaves = append(leaves, key)
+		case key == sub+"/":
+			// A prefix without a trailing slash lists itself as a single
+			// subtree, so list the subtree instead
+			s, l, err := kvChildren(kv, key, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			subtrees, leaves = append(subtrees, s...), append(leaves, l...)
+		default:
+			subtrees = append(subtrees, key)
+		}
+	}
+	return subtrees, leaves, nil
+}
+
+// CanShare returns a boolean if this dependency is shareable.
+func (d *KVShardsQuery) CanShare() bool {
+	return false
+}
+
+// String returns the human-friendly version of this dependency. It includes
+// the depth and interval, so a prefix reloaded with different ones is watched
+// again.
+func (d *KVShardsQuery) String() string {
+	return fmt.Sprintf("kv.shards(%s@%s,depth=%d,interval=%s)", d.prefix, d.dc,
+		d.depth, d.interval)
+}
+
+// Stop halts the dependency's fetch function.
+func (d *KVShardsQuery) Stop() {
+	close(d.stopCh)
+}
+
+// Type returns the type of this dependency.
+func (d *KVShardsQuery) Type() dep.Type {
+	return dep.TypeConsul
+}
+
+// newShardPrefix returns the prefix that replicates the given shard of a
+// sharded prefix. It has its own watch and checkpoint, but is paused along
+// with its sharded prefix.
+func newShardPrefix(parent *PrefixConfig, shard string) (*PrefixConfig, error) {
+	s := shard
+	if dc := config.StringVal(parent.Datacenter); dc != "" {
+		s = s + "@" + dc
+	}
+	d, err := dep.NewKVListQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parent.Copy()
+	p.Source = config.String(shard)
+	p.Destination = config.String(destinationKey(parent, shard))
+	p.ShardDepth = config.Int(0)
+	p.Dependency = d
+	p.shardOf = parent
+	return p, nil
+}
+
+// allPrefixes returns the configured prefixes followed by the shards of the
+// sharded prefixes. The caller must hold the lock.
+func (r *Runner) allPrefixes() []*PrefixConfig {
+	prefixes := make([]*PrefixConfig, 0, len(*r.config.Prefixes))
+	prefixes = append(prefixes, *r.config.Prefixes...)
+	for _, prefix := range *r.config.Prefixes {
+		prefixes = append(prefixes, r.shards[prefix.Dependency.String()]...)
+	}
+	return prefixes
+}
+
+// updateShards replaces the shards of the sharded prefix with the given
+// subtrees, watching the added shards and forgetting the removed ones along
+// with their statuses. The caller must hold the lock.
+func (r *Runner) updateShards(parent *PrefixConfig, subtrees []string) error {
+	id := parent.Dependency.String()
+
+	current := make(map[string]*PrefixConfig, len(r.shards[id]))
+	for _, shard := range r.shards[id] {
+		current[config.StringVal(shard.Source)] = shard
+	}
+
+	shards := make([]*PrefixConfig, 0, len(subtrees))
+	var added int
+	for _, subtree := range subtrees {
+		shard, err := newShardPrefix(parent, subtree)
+		if err != nil {
+			return err
+		}
+
+		if existing, ok := current[subtree]; ok {
+			// Keep the dependency that is already being watched
+			shard.Dependency = existing.Dependency
+			delete(current, subtree)
+		} else {
+			if _, err := r.watcher.Add(shard.Dependency); err != nil {
+				return fmt.Errorf("failed to add watch: %s", err)
+			}
+			added++
+		}
+		shards = append(shards, shard)
+	}
+
+	// The subtrees of removed shards are gone from the source, so their
+	// checkpoints are not needed again
+	for _, shard := range current {
+		r.removePrefix(shard)
+		if err := r.deleteStatus(shard); err != nil {
+			log.Printf("[WARN] (runner) failed to delete status of %s: %s",
+				shard.Dependency, err)
+		}
+	}
+
+	if len(shards) > 0 {
+		r.shards[id] = shards
+	} else {
+		delete(r.shards, id)
+	}
+
+	if added > 0 || len(current) > 0 {
+		log.Printf("[INFO] (runner) %s has %d shards (%d added, %d removed)",
+			id, len(shards), added, len(current))
+	}
+	return nil
+}
+
+// removeShards stops watching the shards of the sharded prefix. The caller
+// must hold the lock.
+func (r *Runner) removeShards(parent *PrefixConfig) {
+	id := parent.Dependency.String()
+	for _, shard := range r.shards[id] {
+		r.removePrefix(shard)
+	}
+	delete(r.shards, id)
+}
+
+// shardDestinations returns the destinations of the shards of the sharded
+// prefix, which are replicated by the shards rather than the prefix itself.
+func (r *Runner) shardDestinations(parent *PrefixConfig) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	shards := r.shards[parent.Dependency.String()]
+	dests := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		dests = append(dests, config.StringVal(shard.Destination))
+	}
+	return dests
+}
@@ -0,0 +1,233 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/watch"
+)
+
+func TestKVShardsQuery(t *testing.T) {
+	data := map[string]string{
+		"apps":             "root",
+		"apps/a":           "a",
+		"apps/app1/x":      "x",
+		"apps/app1/y/z":    "z",
+		"apps/app2/x":      "x",
+		"apps/team/svc1/x": "x",
+		"apps/team/svc2/x": "x",
+	}
+	clients := newTestKVServer(t, data)
+
+	pairPaths := func(pairs []*dep.KeyPair) []string {
+		var paths []string
+		for _, pair := range pairs {
+			paths = append(paths, pair.Path)
+		}
+		return paths
+	}
+
+	t.Run("depth_1", func(t *testing.T) {
+		d := NewKVShardsQuery("apps", "dc1", 1, time.Minute)
+		result, rm, err := d.Fetch(clients, &dep.QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rm.LastIndex != 5 {
+			t.Errorf("\nexp: %#v\nact: %#v", 5, rm.LastIndex)
+		}
+
+		shards := result.(*kvShards)
+		exp := []string{"apps/app1/", "apps/app2/", "apps/team/"}
+		if !reflect.DeepEqual(exp, shards.Shards) {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, shards.Shards)
+		}
+		exp = []string{"apps", "apps/a"}
+		if act := pairPaths(shards.Pairs); !reflect.DeepEqual(exp, act) {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+		}
+	})
+
+	t.Run("depth_2", func(t *testing.T) {
+		d := NewKVShardsQuery("apps/", "dc1", 2, time.Minute)
+		result, _, err := d.Fetch(clients, &dep.QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shards := result.(*kvShards)
+		exp := []string{"apps/app1/y/", "apps/team/svc1/", "apps/team/svc2/"}
+		if !reflect.DeepEqual(exp, shards.Shards) {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, shards.Shards)
+		}
+		exp = []string{"apps/a", "apps/app1/x", "apps/app2/x"}
+		if act := pairPaths(shards.Pairs); !reflect.DeepEqual(exp, act) {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		d := NewKVShardsQuery("apps", "dc1", 1, 10*time.Millisecond)
+		_, rm, err := d.Fetch(clients, &dep.QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The index is the same until the shards change
+		_, rm2, err := d.Fetch(clients, &dep.QueryOptions{WaitIndex: rm.LastIndex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rm2.LastIndex != rm.LastIndex {
+			t.Errorf("\nexp: %#v\nact: %#v", rm.LastIndex, rm2.LastIndex)
+		}
+
+		data["apps/app3/x"] = "x"
+		defer delete(data, "apps/app3/x")
+		result, rm3, err := d.Fetch(clients, &dep.QueryOptions{WaitIndex: rm2.LastIndex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rm3.LastIndex <= rm2.LastIndex {
+			t.Errorf("expected the index to move forward from %d, got %d",
+				rm2.LastIndex, rm3.LastIndex)
+		}
+		if n := len(result.(*kvShards).Shards); n != 4 {
+			t.Errorf("expected 4 shards, got %d", n)
+		}
+	})
+}
+
+func TestParse_ShardedDependency(t *testing.T) {
+	c, err := Parse(`prefix {
+		source      = "apps@dc1"
+		destination = "default"
+		shard_depth = 1
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := (*c.Prefixes)[0].Dependency
+	if _, ok := d.(*KVShardsQuery); !ok {
+		t.Fatalf("expected a shards query, got %T", d)
+	}
+	if exp := "kv.shards(apps@dc1,depth=1,interval=30s)"; d.String() != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, d.String())
+	}
+}
+
+func TestRunner_updateShards(t *testing.T) {
+	data := map[string]string{}
+	clients := newTestKVServer(t, data)
+
+	c, err := Parse(`prefix {
+		source      = "apps/@dc1"
+		destination = "default/"
+		shard_depth = 1
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = DefaultConfig().Merge(c)
+	c.Finalize()
+	parent := (*c.Prefixes)[0]
+
+	w := newWatcher(c, clients, false)
+	defer w.Stop()
+	r := &Runner{
+		config:            c,
+		clients:           clients,
+		watcher:           w,
+		data:              make(map[string]*watch.View),
+		prefixWriteLimits: make(map[string]*prefixWriteLimit),
+		indexes:           make(map[string]*destinationIndex),
+		shards:            make(map[string][]*PrefixConfig),
+	}
+
+	if err := r.updateShards(parent, []string{"apps/app1/", "apps/app2/"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != 2 {
+		t.Errorf("expected 2 watches, got %d", w.Size())
+	}
+
+	exp := []string{"default/app1/", "default/app2/"}
+	if act := r.shardDestinations(parent); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+	if n := len(r.allPrefixes()); n != 3 {
+		t.Errorf("expected 3 prefixes, got %d", n)
+	}
+
+	// Shards are paused along with the sharded prefix
+	shard := r.shards[parent.Dependency.String()][0]
+	if exp, act := r.pausePath(parent), r.pausePath(shard); exp != act {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	// Removed shards are no longer watched, and their statuses are deleted
+	removed := r.statusPath(shard)
+	kept := r.statusPath(r.shards[parent.Dependency.String()][1])
+	data[removed], data[kept] = "{}", "{}"
+	if err := r.updateShards(parent, []string{"apps/app2/"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data[removed]; ok {
+		t.Errorf("expected the status of the removed shard to be deleted")
+	}
+	if _, ok := data[kept]; !ok {
+		t.Errorf("expected the status of the kept shard to be kept")
+	}
+	if w.Size() != 1 {
+		t.Errorf("expected 1 watch, got %d", w.Size())
+	}
+	exp = []string{"default/app2/"}
+	if act := r.shardDestinations(parent); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	r.removeShards(parent)
+	if w.Size() != 0 {
+		t.Errorf("expected no watches, got %d", w.Size())
+	}
+}
+
+func TestPruneDestination_Owned(t *testing.T) {
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(t.TempDir()),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/a", "default/app1/x", "default/gone/x"} {
+		if err := dest.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := &PrefixConfig{
+		Destination:     config.String("default/"),
+		DestinationType: config.String(PrefixTypeFile),
+		Source:          config.String("apps/"),
+	}
+	usedKeys := map[string]struct{}{"default/a": {}}
+	deletes, err := pruneDestination(context.Background(), prefix,
+		DefaultExcludeConfigs(), dest, nil, usedKeys, []string{"default/app1/"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"default/gone/x"}
+	if !reflect.DeepEqual(exp, deletes) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, deletes)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetupTracing_Disabled(t *testing.T) {
+	before := otel.GetTracerProvider()
+
+	c := DefaultTracingConfig()
+	c.Finalize()
+	shutdown, err := setupTracing(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if otel.GetTracerProvider() != before {
+		t.Errorf("expected the tracer provider to be unchanged")
+	}
+}
+
+func TestPruneDestination_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	before := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(before)
+
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/keep", "default/stale"} {
+		if err := dest.Put(key, 0, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := &PrefixConfig{
+		Datacenter:  config.String("dc1"),
+		Destination: config.String("default"),
+		Source:      config.String("global"),
+	}
+
+	ctx, span := startSpan(context.Background(), "replicate", prefixSpanAttributes(prefix)...)
+	usedKeys := map[string]struct{}{"default/keep": {}}
+	if _, err := pruneDestination(ctx, prefix, DefaultExcludeConfigs(), dest, nil, usedKeys, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	endSpan(span, os.ErrNotExist)
+
+	spans := recorder.Ended()
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name()
+	}
+	exp := []string{"destination.keys", "destination.delete", "replicate"}
+	if !reflect.DeepEqual(exp, names) {
+		t.Fatalf("\nexp: %#v\nact: %#v", exp, names)
+	}
+
+	parent := spans[2].SpanContext().SpanID()
+	for _, s := range spans[:2] {
+		if s.Parent().SpanID() != parent {
+			t.Errorf("expected %s to be a child of replicate", s.Name())
+		}
+	}
+
+	if status := spans[2].Status(); status.Code != codes.Error {
+		t.Errorf("expected error status, got %#v", status)
+	}
+}
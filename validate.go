@@ -0,0 +1,181 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// configProblem is a logical error in a configuration that parses correctly,
+// such as two prefixes that write to the same keys.
+type configProblem struct {
+	// Prefix or Exclude is the block the problem was found in.
+	Prefix  *PrefixConfig
+	Exclude *ExcludeConfig
+
+	// Message describes the problem.
+	Message string
+}
+
+func (p *configProblem) Error() string {
+	switch {
+	case p.Prefix != nil:
+		return fmt.Sprintf("prefix %q: %s", prefixName(p.Prefix), p.Message)
+	case p.Exclude != nil:
+		return fmt.Sprintf("exclude %q: %s", config.StringVal(p.Exclude.Source), p.Message)
+	default:
+		return p.Message
+	}
+}
+
+// checkConfig returns the logical problems in the given finalized
+// configuration without contacting Consul. If localDatacenter is empty, the
+// checks that depend on the local datacenter are skipped.
+func checkConfig(c *Config, localDatacenter string) []*configProblem {
+	var problems []*configProblem
+	add := func(p *configProblem) {
+		problems = append(problems, p)
+	}
+
+	// Every version would be removed as soon as it is recorded
+	if h := c.History; h != nil && config.BoolVal(h.Enabled) && config.IntVal(h.Versions) < 1 {
+		add(&configProblem{Message: fmt.Sprintf(
+			"history versions must be at least 1, got %d", config.IntVal(h.Versions))})
+	}
+
+	statusDir := config.StringVal(c.StatusDir)
+	prefixes := *c.Prefixes
+
+	for i, prefix := range prefixes {
+		if err := validateDestination(prefix); err != nil {
+			add(&configProblem{Prefix: prefix, Message: err.Error()})
+			continue
+		}
+
+		dc := config.StringVal(prefix.Datacenter)
+		if localDatacenter != "" && dc == localDatacenter {
+			add(&configProblem{Prefix: prefix, Message: fmt.Sprintf(
+				"source datacenter %q is the local datacenter", dc)})
+		}
+
+		dest, isKV := destinationPath(prefix)
+		if isKV && overlaps(dest, statusDir) {
+			add(&configProblem{Prefix: prefix, Message: fmt.Sprintf(
+				"destination %q overlaps the status directory %q", dest, statusDir)})
+		}
+
+		// Compare against later prefixes only, so each pair is reported once
+		for _, other := range prefixes[i+1:] {
+			otherDest, otherIsKV := destinationPath(other)
+			if isKV == otherIsKV && overlaps(dest, otherDest) {
+				add(&configProblem{Prefix: prefix, Message: fmt.Sprintf(
+					"destination %q overlaps the destination %q of prefix %q",
+					dest, otherDest, prefixName(other))})
+			}
+		}
+
+		// Writing into a source that is read from the local datacenter causes
+		// the written keys to be replicated again.
+		if !isKV {
+			continue
+		}
+		for _, other := range prefixes {
+			if !readsLocalKV(other, localDatacenter) {
+				continue
+			}
+			source := config.StringVal(other.Source)
+			if !overlaps(dest, source) {
+				continue
+			}
+			if other == prefix {
+				add(&configProblem{Prefix: prefix, Message: fmt.Sprintf(
+					"destination %q overlaps its own source in the local datacenter",
+					dest)})
+				continue
+			}
+			add(&configProblem{Prefix: prefix, Message: fmt.Sprintf(
+				"destination %q overlaps the source %q of prefix %q in the local "+
+					"datacenter", dest, source, prefixName(other))})
+		}
+	}
+
+	for _, exclude := range *c.Excludes {
+		source := config.StringVal(exclude.Source)
+
+		var used bool
+		for _, prefix := range prefixes {
+			if overlaps(source, config.StringVal(prefix.Source)) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			add(&configProblem{Exclude: exclude, Message: "does not match any prefix"})
+		}
+	}
+
+	return problems
+}
+
+// checkRunnable returns an error if the given configuration has problems that
+// would make replication destructive, such as prefixes that delete each
+// other's keys. Problems that are harmless at runtime, such as unused excludes,
+// are only logged.
+func checkRunnable(c *Config, localDatacenter string) error {
+	var errs *multierror.Error
+	for _, p := range checkConfig(c, localDatacenter) {
+		if p.Exclude != nil {
+			log.Printf("[WARN] (runner) %s", p)
+			continue
+		}
+		errs = multierror.Append(errs, p)
+	}
+	return errs.ErrorOrNil()
+}
+
+// destinationPath returns the path that the prefix writes to and whether it
+// is in the Consul KV store. For file destinations, this is the path on disk.
+func destinationPath(prefix *PrefixConfig) (string, bool) {
+	dest := config.StringVal(prefix.Destination)
+	if config.StringVal(prefix.DestinationType) != PrefixTypeFile {
+		return dest, true
+	}
+
+	root, err := filepath.Abs(config.StringVal(prefix.DestinationFile.Path))
+	if err != nil {
+		root = config.StringVal(prefix.DestinationFile.Path)
+	}
+	return filepath.ToSlash(root) + "/" + dest, false
+}
+
+// readsLocalKV returns true if the prefix reads from the Consul KV store of the
+// local datacenter.
+func readsLocalKV(prefix *PrefixConfig, localDatacenter string) bool {
+	if config.StringVal(prefix.SourceType) == PrefixTypeFile {
+		return false
+	}
+	return localDatacenter != "" && config.StringVal(prefix.Datacenter) == localDatacenter
+}
+
+// overlaps returns true if either path is a prefix of the other, in which case
+// listing one returns keys under the other.
+func overlaps(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// prefixName returns the prefix in the same "source@datacenter" format that it
+// is given on the command line.
+func prefixName(prefix *PrefixConfig) string {
+	name := config.StringVal(prefix.Source)
+	if dc := config.StringVal(prefix.Datacenter); dc != "" {
+		name += "@" + dc
+	}
+	return name
+}
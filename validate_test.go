@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		prefixes []string
+		excludes []string
+		localDC  string
+		e        []string
+	}{
+		{
+			"valid",
+			[]string{"global@dc1", "other@dc2:other-dc2"},
+			[]string{"global/private"},
+			"dc3",
+			nil,
+		},
+		{
+			"overlapping_destinations",
+			[]string{"global@dc1", "glob@dc2:global/nested"},
+			nil,
+			"",
+			[]string{
+				`prefix "global@dc1": destination "global" overlaps the destination "global/nested" of prefix "glob@dc2"`,
+			},
+		},
+		{
+			"status_dir",
+			[]string{"service@dc1"},
+			nil,
+			"",
+			[]string{
+				`prefix "service@dc1": destination "service" overlaps the status directory "service/consul-replicate/statuses"`,
+			},
+		},
+		{
+			"local_source",
+			[]string{"global@dc1:local", "local/nested@dc3:copy"},
+			nil,
+			"dc3",
+			[]string{
+				`prefix "global@dc1": destination "local" overlaps the source "local/nested" of prefix "local/nested@dc3" in the local datacenter`,
+				`prefix "local/nested@dc3": source datacenter "dc3" is the local datacenter`,
+			},
+		},
+		{
+			"local_datacenter",
+			[]string{"global@dc1:other"},
+			nil,
+			"dc1",
+			[]string{
+				`prefix "global@dc1": source datacenter "dc1" is the local datacenter`,
+			},
+		},
+		{
+			"unused_exclude",
+			[]string{"global@dc1"},
+			[]string{"other/private"},
+			"",
+			[]string{
+				`exclude "other/private": does not match any prefix`,
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			c := DefaultConfig()
+			for _, s := range tc.prefixes {
+				p, err := ParsePrefixConfig(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				*c.Prefixes = append(*c.Prefixes, p)
+			}
+			for _, s := range tc.excludes {
+				e, err := ParseExcludeConfig(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				*c.Excludes = append(*c.Excludes, e)
+			}
+			c.Finalize()
+
+			var act []string
+			for _, p := range checkConfig(c, tc.localDC) {
+				act = append(act, p.Error())
+			}
+			if !reflect.DeepEqual(tc.e, act) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.e, act)
+			}
+		})
+	}
+}
+
+func TestCheckRunnable(t *testing.T) {
+	t.Parallel()
+
+	c := DefaultConfig()
+	for _, s := range []string{"global@dc1", "glob@dc2:global/nested"} {
+		p, err := ParsePrefixConfig(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*c.Prefixes = append(*c.Prefixes, p)
+	}
+	*c.Excludes = append(*c.Excludes, &ExcludeConfig{Source: config.String("other/")})
+	c.Finalize()
+
+	if err := checkRunnable(c, ""); err == nil {
+		t.Fatal("expected error for overlapping destinations")
+	}
+
+	*c.Prefixes = (*c.Prefixes)[:1]
+	if err := checkRunnable(c, ""); err != nil {
+		t.Errorf("expected unused exclude to be allowed: %s", err)
+	}
+}
+
+func TestCheckConfig_History(t *testing.T) {
+	t.Parallel()
+
+	// History enabled without a number of versions keeps the default
+	c := DefaultConfig()
+	c.History.Enabled = config.Bool(true)
+	c.Finalize()
+	if v := config.IntVal(c.History.Versions); v != DefaultHistoryVersions {
+		t.Errorf("\nexp: %#v\nact: %#v", DefaultHistoryVersions, v)
+	}
+	if problems := checkConfig(c, ""); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	c.History.Versions = config.Int(0)
+	var act []string
+	for _, p := range checkConfig(c, "") {
+		act = append(act, p.Error())
+	}
+	exp := []string{"history versions must be at least 1, got 0"}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+	if err := checkRunnable(c, ""); err == nil {
+		t.Error("expected error for history without versions")
+	}
+}
+
+func TestCLI_runValidate(t *testing.T) {
+	t.Parallel()
+
+	// Files may have prefixes without excludes, or neither
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"a.hcl": `prefix { source = "global@dc1" }`,
+		"b.hcl": `log_level = "info"`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	cli := NewCLI(&buf, &buf)
+	if code := cli.Run([]string{"consul-replicate", "validate", "-config", dir}); code != ExitCodeOK {
+		t.Errorf("expected exit code %d, got %d: %s", ExitCodeOK, code, buf.String())
+	}
+}
+
+func TestCLI_runValidate_History(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.hcl")
+	contents := "history {\n  enabled  = true\n  versions = 0\n}\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Problems with the whole configuration have no block to point to
+	var buf bytes.Buffer
+	cli := NewCLI(&buf, &buf)
+	if code := cli.Run([]string{"consul-replicate", "validate", "-config", path}); code != ExitCodeConfigError {
+		t.Errorf("expected exit code %d, got %d", ExitCodeConfigError, code)
+	}
+	exp := "history versions must be at least 1, got 0\n" +
+		"Found 1 problem(s) in the configuration.\n"
+	if buf.String() != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, buf.String())
+	}
+}
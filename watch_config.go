@@ -0,0 +1,254 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul/api"
+)
+
+// configWatcher polls the configuration files and folders given on the
+// command line and signals when any of them change.
+type configWatcher struct {
+	paths    []string
+	interval time.Duration
+
+	changeCh chan struct{}
+	stopCh   chan struct{}
+
+	// last is the checksum of the most recent scan.
+	last [md5.Size]byte
+}
+
+// newConfigWatcher creates a new watcher for the given configuration paths,
+// which are scanned for changes at the given interval.
+func newConfigWatcher(paths []string, interval time.Duration) *configWatcher {
+	return &configWatcher{
+		paths:    paths,
+		interval: interval,
+		changeCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		last:     configChecksum(paths),
+	}
+}
+
+// Start scans the paths until the watcher is stopped. This blocks and should
+// be called in a goroutine.
+func (w *configWatcher) Start() {
+	log.Printf("[INFO] (cli) watching %d configuration path(s) for changes", len(w.paths))
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		sum := configChecksum(w.paths)
+		if sum == w.last {
+			continue
+		}
+		w.last = sum
+
+		log.Printf("[DEBUG] (cli) configuration changed on disk")
+		select {
+		case w.changeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ChangeCh returns the channel that receives a value when the configuration
+// changes. It is nil if the watcher is nil, so it can be used in a select
+// whether or not watching is enabled.
+func (w *configWatcher) ChangeCh() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.changeCh
+}
+
+// Stop halts the watcher.
+func (w *configWatcher) Stop() {
+	close(w.stopCh)
+}
+
+// configChecksum returns a checksum of the name, size and modification time of
+// every file under the given paths. Paths that cannot be read are included by
+// name, so that a file appearing or disappearing is a change.
+func configChecksum(paths []string) [md5.Size]byte {
+	h := md5.New()
+	for _, path := range paths {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			io.WriteString(h, path+"\x00missing\x00")
+		}
+	}
+
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// configSourceWatcher watches the key in the Consul KV store that holds the
+// prefix and exclude blocks, and delivers its value each time it changes.
+type configSourceWatcher struct {
+	kv         *api.KV
+	key        string
+	datacenter string
+
+	dataCh chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lastIndex is the index of the most recent value.
+	lastIndex uint64
+}
+
+// newConfigSourceWatcher creates a new watcher for the key given in the
+// config_source block.
+func newConfigSourceWatcher(kv *api.KV, c *ConfigSourceConfig) *configSourceWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &configSourceWatcher{
+		kv:         kv,
+		key:        config.StringVal(c.Key),
+		datacenter: config.StringVal(c.Datacenter),
+		dataCh:     make(chan []byte, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Fetch reads the current value of the key, blocking until it changes if a
+// value has already been read. It returns nil if the key does not exist.
+func (w *configSourceWatcher) Fetch() ([]byte, error) {
+	opts := &api.QueryOptions{
+		Datacenter: w.datacenter,
+		WaitIndex:  w.lastIndex,
+	}
+	pair, meta, err := w.kv.Get(w.key, opts.WithContext(w.ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	// Reset the index if it goes backwards, such as after a snapshot restore
+	w.lastIndex = meta.LastIndex
+	if w.lastIndex < opts.WaitIndex {
+		w.lastIndex = 0
+	}
+
+	if pair == nil {
+		return nil, nil
+	}
+	return pair.Value, nil
+}
+
+// Start watches the key until the watcher is stopped, delivering each new
+// value on the data channel. This blocks and should be called in a goroutine
+// after the initial value has been read with Fetch.
+func (w *configSourceWatcher) Start() {
+	log.Printf("[INFO] (cli) watching %q for configuration changes", w.key)
+
+	for {
+		index := w.lastIndex
+		b, err := w.Fetch()
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] (cli) failed to read config_source %q: %s", w.key, err)
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(DefaultConfigSourceRetryInterval):
+			}
+			continue
+		}
+
+		if w.lastIndex == index {
+			continue
+		}
+
+		log.Printf("[DEBUG] (cli) config_source %q changed", w.key)
+		select {
+		case <-w.ctx.Done():
+			return
+		case w.dataCh <- b:
+		}
+	}
+}
+
+// DataCh returns the channel that receives the value of the key when it
+// changes. It is nil if the watcher is nil, so it can be used in a select
+// whether or not a config_source is given.
+func (w *configSourceWatcher) DataCh() <-chan []byte {
+	if w == nil {
+		return nil
+	}
+	return w.dataCh
+}
+
+// Stop halts the watcher.
+func (w *configSourceWatcher) Stop() {
+	w.cancel()
+}
+
+// parseConfigSource parses the value of the config_source key, which may only
+// contain prefix and exclude blocks. An empty value has no prefixes.
+func parseConfigSource(b []byte) (*Config, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return &Config{}, nil
+	}
+
+	c, err := Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	other := c.Copy()
+	other.Prefixes, other.Excludes = nil, nil
+	if !reflect.DeepEqual(other, &Config{}) {
+		return nil, fmt.Errorf("config_source may only contain prefix and " +
+			"exclude blocks")
+	}
+
+	return &Config{
+		Excludes: c.Excludes,
+		Prefixes: c.Prefixes,
+	}, nil
+}
+
+// mergeConfigSource adds the prefixes and excludes read from the config_source
+// key to the given configuration.
+func mergeConfigSource(c, source *Config) *Config {
+	if source == nil {
+		return c
+	}
+	c = c.Merge(source)
+	c.Finalize()
+	return c
+}
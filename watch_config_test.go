@@ -0,0 +1,183 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "config.hcl")
+	if err := os.WriteFile(path, []byte(`prefix { source = "foo" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newConfigWatcher([]string{root}, 10*time.Millisecond)
+	go w.Start()
+	defer w.Stop()
+
+	select {
+	case <-w.ChangeCh():
+		t.Fatal("expected no change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "other.hcl"), []byte(`exclude { source = "foo/bar" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-w.ChangeCh():
+	case <-time.After(time.Second):
+		t.Fatal("expected change after adding a file")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-w.ChangeCh():
+	case <-time.After(time.Second):
+		t.Fatal("expected change after removing a file")
+	}
+
+	var nilWatcher *configWatcher
+	if nilWatcher.ChangeCh() != nil {
+		t.Error("expected nil watcher to have a nil channel")
+	}
+}
+
+func TestParseConfigSource(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		i        string
+		prefixes int
+		excludes int
+		err      bool
+	}{
+		{
+			"empty",
+			"",
+			0,
+			0,
+			false,
+		},
+		{
+			"hcl",
+			`prefix { source = "global@dc1" }
+			prefix { source = "other@dc1" }
+			exclude { source = "global/private" }`,
+			2,
+			1,
+			false,
+		},
+		{
+			"json",
+			`{"prefix": [{"source": "global@dc1"}]}`,
+			1,
+			0,
+			false,
+		},
+		{
+			"other_options",
+			`prefix { source = "global@dc1" }
+			status_dir = "foo"`,
+			0,
+			0,
+			true,
+		},
+		{
+			"invalid",
+			`prefix {`,
+			0,
+			0,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			c, err := parseConfigSource([]byte(tc.i))
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+
+			c = mergeConfigSource(DefaultConfig(), c)
+			if l := len(*c.Prefixes); l != tc.prefixes {
+				t.Errorf("expected %d prefixes, got %d", tc.prefixes, l)
+			}
+			if l := len(*c.Excludes); l != tc.excludes {
+				t.Errorf("expected %d excludes, got %d", tc.excludes, l)
+			}
+		})
+	}
+}
+
+func TestRestartConfigSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/replicate/config" {
+			http.NotFound(w, r)
+			return
+		}
+		// Block once the value has been read, like a blocking query
+		if r.URL.Query().Get("index") == "10" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		fmt.Fprint(w, `[{"Key": "replicate/config", "Value": "cHJlZml4IHsgc291cmNlID0gImdsb2JhbCIgfQ=="}]`)
+	}))
+	defer srv.Close()
+
+	c := DefaultConfig()
+	c.Consul.Address = config.String(strings.TrimPrefix(srv.URL, "http://"))
+	c.ConfigSource.Key = config.String("replicate/config")
+	c.Finalize()
+
+	w, err := restartConfigSource(nil, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil {
+		t.Fatal("expected a watcher")
+	}
+	defer w.Stop()
+
+	// The current contents are delivered so they can be applied
+	select {
+	case b := <-w.DataCh():
+		if exp := `prefix { source = "global" }`; string(b) != exp {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, string(b))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the config_source")
+	}
+
+	// Without a config_source, the previous watcher is stopped
+	c.ConfigSource.Enabled = config.Bool(false)
+	if w, err = restartConfigSource(w, c, false); err != nil || w != nil {
+		t.Errorf("expected no watcher, got %#v, %v", w, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul-template/config"
+	"golang.org/x/time/rate"
+)
+
+// writeLimit bounds the writes to destinations by the number in flight and by
+// rate. A nil writeLimit, or one with neither bound, does not limit writes.
+type writeLimit struct {
+	sem     chan struct{}
+	limiter *rate.Limiter
+}
+
+// newWriteLimit returns a limit of the given number of writes in flight, if
+// concurrency is positive, and of the given rate, if it is enabled.
+func newWriteLimit(concurrency int, c *RateLimitConfig) *writeLimit {
+	l := &writeLimit{}
+	if concurrency > 0 {
+		l.sem = make(chan struct{}, concurrency)
+	}
+	if rateLimited(c) {
+		burst := config.IntVal(c.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(config.IntVal(c.Rate)), burst)
+	}
+	return l
+}
+
+// rateLimited returns true if the rate limit config is enabled with a rate.
+func rateLimited(c *RateLimitConfig) bool {
+	return c != nil && config.BoolVal(c.Enabled) && config.IntVal(c.Rate) > 0
+}
+
+// acquire blocks until a write is allowed, or ctx is done. Each successful
+// acquire must be followed by a release.
+func (l *writeLimit) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release marks a write as finished.
+func (l *writeLimit) release() {
+	if l != nil && l.sem != nil {
+		<-l.sem
+	}
+}
+
+// writeLimits is a set of limits that all apply to a write, such as the
+// global concurrency and the rate limit of a prefix.
+type writeLimits []*writeLimit
+
+// acquire blocks until every limit allows a write, releasing any limits
+// already acquired if ctx is done first.
+func (ls writeLimits) acquire(ctx context.Context) error {
+	for i, l := range ls {
+		if err := l.acquire(ctx); err != nil {
+			ls[:i].release()
+			return err
+		}
+	}
+	return nil
+}
+
+// release marks a write as finished for every limit.
+func (ls writeLimits) release() {
+	for i := len(ls) - 1; i >= 0; i-- {
+		ls[i].release()
+	}
+}
+
+// writeLimits returns the limits that apply to writes of the prefix: the
+// rate limit of the prefix if it has one, or else the global rate limit, and
+// the global concurrency shared by all prefixes. The prefix limit is kept
+// across passes so that its rate carries over, and is replaced if the
+// prefix's options change on reload. The shards of a sharded prefix share its
+// limit.
+func (r *Runner) writeLimits(prefix *PrefixConfig) writeLimits {
+	if !rateLimited(prefix.WriteRateLimit) {
+		return writeLimits{r.writeRateLimit, r.writeLimit}
+	}
+
+	r.writeLimitsLock.Lock()
+	defer r.writeLimitsLock.Unlock()
+
+	if prefix.shardOf != nil {
+		prefix = prefix.shardOf
+	}
+
+	id := prefix.Dependency.String()
+	p, ok := r.prefixWriteLimits[id]
+	if !ok || p.config.GoString() != prefix.WriteRateLimit.GoString() {
+		p = &prefixWriteLimit{
+			config: prefix.WriteRateLimit.Copy(),
+			limit:  newWriteLimit(0, prefix.WriteRateLimit),
+		}
+		r.prefixWriteLimits[id] = p
+	}
+	return writeLimits{p.limit, r.writeLimit}
+}
+
+// prefixWriteLimit is the rate limit of a prefix and the config it was
+// created from.
+type prefixWriteLimit struct {
+	config *RateLimitConfig
+	limit  *writeLimit
+}
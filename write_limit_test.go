@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestWriteLimit(t *testing.T) {
+	cases := []struct {
+		name        string
+		concurrency int
+		rate        *RateLimitConfig
+		inFlight    int32
+		minDuration time.Duration
+	}{
+		{
+			"unlimited",
+			0,
+			nil,
+			10,
+			0,
+		},
+		{
+			"concurrency",
+			2,
+			nil,
+			2,
+			0,
+		},
+		{
+			"rate",
+			0,
+			&RateLimitConfig{
+				Rate:  config.Int(50),
+				Burst: config.Int(1),
+			},
+			10,
+			150 * time.Millisecond,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			if tc.rate != nil {
+				tc.rate.Finalize()
+			}
+			l := newWriteLimit(tc.concurrency, tc.rate)
+
+			var current, max int32
+			var wg sync.WaitGroup
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := l.acquire(context.Background()); err != nil {
+						t.Error(err)
+						return
+					}
+					n := atomic.AddInt32(&current, 1)
+					for {
+						m := atomic.LoadInt32(&max)
+						if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt32(&current, -1)
+					l.release()
+				}()
+			}
+			wg.Wait()
+
+			if max > tc.inFlight {
+				t.Errorf("expected at most %d writes in flight, got %d", tc.inFlight, max)
+			}
+			if d := time.Since(start); d < tc.minDuration {
+				t.Errorf("expected writes to take at least %s, took %s", tc.minDuration, d)
+			}
+		})
+	}
+}
+
+func TestWriteLimits_AcquireCanceled(t *testing.T) {
+	global := newWriteLimit(1, nil)
+	prefix := newWriteLimit(1, nil)
+	limits := writeLimits{global, prefix}
+
+	// Hold the prefix limit, so acquiring both must release the global one
+	if err := prefix.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limits.acquire(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if err := global.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunner_writeLimits(t *testing.T) {
+	global := DefaultRateLimitConfig()
+	global.Rate = config.Int(10)
+	global.Finalize()
+
+	r := &Runner{
+		writeLimit:        newWriteLimit(2, nil),
+		writeRateLimit:    newWriteLimit(0, global),
+		prefixWriteLimits: make(map[string]*prefixWriteLimit),
+	}
+
+	prefix, err := ParsePrefixConfig("global@dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix.Finalize()
+
+	// Prefixes without their own rate limit use the global one
+	limits := r.writeLimits(prefix)
+	if exp := (writeLimits{r.writeRateLimit, r.writeLimit}); !reflect.DeepEqual(exp, limits) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, limits)
+	}
+
+	// A prefix rate limit is used instead of the global one
+	prefix.WriteRateLimit.Rate = config.Int(1000)
+	prefix.WriteRateLimit.Enabled = config.Bool(true)
+	limits = r.writeLimits(prefix)
+	if len(limits) != 2 || limits[0] == r.writeRateLimit || limits[1] != r.writeLimit {
+		t.Fatalf("expected the prefix rate limit and global concurrency, got %#v", limits)
+	}
+	if limits[0].limiter == nil || limits[0].limiter.Limit() != 1000 {
+		t.Errorf("expected a rate of 1000, got %#v", limits[0].limiter)
+	}
+
+	// Shards share the rate limit of their sharded prefix
+	shard, err := newShardPrefix(prefix, "global/app1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act := r.writeLimits(shard); act[0] != limits[0] {
+		t.Errorf("expected the shard to share the prefix rate limit")
+	}
+}
+
+func TestRunner_putKeys(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dest, err := newFileDestination(&FileDestinationConfig{
+		Path:  config.String(root),
+		Perms: config.FileMode(0600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := &PrefixConfig{
+		Destination:      config.String("default"),
+		Source:           config.String("global"),
+		WriteConcurrency: config.Int(4),
+	}
+
+	var pairs []*dep.KeyPair
+	var exp []string
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("key%02d", i)
+		pairs = append(pairs, &dep.KeyPair{Path: "global/" + path, Value: path})
+		exp = append(exp, "default/"+path)
+	}
+
+	r := &Runner{}
+	limits := writeLimits{newWriteLimit(2, nil)}
+	updates, err := r.putKeys(context.Background(), prefix, dest, pairs, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp, updates) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, updates)
+	}
+
+	for _, key := range exp {
+		if _, err := os.Stat(root + "/" + key); err != nil {
+			t.Errorf("expected %s to be written: %s", key, err)
+		}
+	}
+}